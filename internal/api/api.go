@@ -17,7 +17,10 @@ func (a *aApi) Reload() gin.HandlerFunc {
 		defer service.Cfg.MemoryUnlock(true)
 
 		cfg, _ := service.Cfg.LoadFromMemory()
+		service.Notify.Reload(cfg)
+		service.Cert.Reload(cfg)
 		service.Proxy.Reload(cfg)
+		service.Stream.Reload(cfg)
 		service.Api.Reload(cfg)
 
 		ctx.Set("resp", model.NewApiResponse(0))
@@ -73,9 +76,10 @@ func (a *aApi) SetApiConfig() gin.HandlerFunc {
 }
 
 type GetVhostListenResponse struct {
-	Http  []string `json:"http"`
-	Https []string `json:"https"`
-	Http3 []string `json:"http3"`
+	Http  []*model.ListenCfg `json:"http"`
+	Https []*model.ListenCfg `json:"https"`
+	// Http3 没有设置QUIC参数的监听地址返回字符串，否则返回对象，字段说明见model.Http3ListenCfg
+	Http3 []*model.Http3ListenCfg `json:"http3"`
 }
 
 func (a *aApi) GetVhostListen() gin.HandlerFunc {
@@ -94,9 +98,14 @@ func (a *aApi) GetVhostListen() gin.HandlerFunc {
 }
 
 type SetVhostListenRequest struct {
-	Http  []string `json:"http"`
-	Https []string `json:"https"`
-	Http3 []string `json:"http3"`
+	Http  []*model.ListenCfg `json:"http"`
+	Https []*model.ListenCfg `json:"https"`
+	// Http3 每一项可以是监听地址字符串，也可以是带QUIC参数的对象，例如
+	// {"addr": ":443", "max_idle_timeout": "60s", "keep_alive_period": "20s",
+	// "max_incoming_streams": 200, "initial_stream_window": 524288, "max_stream_window": 6291456,
+	// "initial_connection_window": 524288, "max_connection_window": 15728640,
+	// "disable_path_mtu_discovery": false, "retry": "always"}
+	Http3 []*model.Http3ListenCfg `json:"http3"`
 }
 
 func (a *aApi) SetVhostListen() gin.HandlerFunc {
@@ -121,3 +130,34 @@ func (a *aApi) SetVhostListen() gin.HandlerFunc {
 		ctx.Set("resp", model.NewApiResponse(0))
 	}
 }
+
+func (a *aApi) GetTrustedProxy() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		service.Cfg.MemoryLock(true)
+		defer service.Cfg.MemoryUnlock(true)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		ctx.Set("resp", model.NewApiResponse(0).SetData(cfg.TrustedProxy))
+	}
+}
+
+func (a *aApi) SetTrustedProxy() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req []string
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		cfg.TrustedProxy = req
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
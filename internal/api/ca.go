@@ -0,0 +1,230 @@
+package api
+
+import (
+	"encoding/pem"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abxuz/go-vhostd/internal/model"
+	"github.com/abxuz/go-vhostd/internal/service"
+	"github.com/abxuz/go-vhostd/utils"
+	"github.com/gin-gonic/gin"
+)
+
+var CA = &aCA{}
+
+type aCA struct {
+}
+
+type CAResponse struct {
+	*model.CACfg
+	Subject    string `json:"subject"`
+	ValidStart string `json:"valid_start"`
+	ValidStop  string `json:"valid_stop"`
+	// KeyEncrypted 私钥是否已用主密钥加密保存
+	KeyEncrypted bool `json:"key_encrypted"`
+	// Issued 已签发的证书
+	Issued []*IssuedCertResponse `json:"issued"`
+}
+
+type IssuedCertResponse struct {
+	Domain string `json:"domain"`
+	*model.CertInfo
+	Status *model.CertStatus `json:"status,omitempty"`
+}
+
+type CARequest struct {
+	model.CACfg
+	// Key 明文私钥，也可以直接放在content中
+	Key string `json:"key"`
+	// Pkcs12 base64编码的PKCS#12文件，与content二选一
+	Pkcs12 string `json:"pkcs12"`
+	// Password PKCS#12文件或加密私钥的密码
+	Password string `json:"password"`
+}
+
+type CAGenerateRequest struct {
+	CommonName string `json:"common_name"`
+	// Days 根证书有效期，单位天，默认10年
+	Days        int `json:"days"`
+	Validity    int `json:"validity"`
+	RenewBefore int `json:"renew_before"`
+	// Force 已经有CA时是否替换，替换后需要重新信任新的根证书
+	Force bool `json:"force"`
+}
+
+func (a *aCA) Get() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		service.Cfg.MemoryLock(true)
+		defer service.Cfg.MemoryUnlock(true)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		if cfg.CA == nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("ca not found"))
+			return
+		}
+
+		ca, err := cfg.CA.Certificate()
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		resp := &CAResponse{
+			CACfg:        cfg.CA,
+			Subject:      ca.Leaf.Subject.String(),
+			ValidStart:   ca.Leaf.NotBefore.Local().Format(time.DateTime),
+			ValidStop:    ca.Leaf.NotAfter.Local().Format(time.DateTime),
+			KeyEncrypted: utils.IsSealed(cfg.CA.Key),
+			Issued:       make([]*IssuedCertResponse, 0),
+		}
+		for _, domain := range cfg.InternalCertDomains() {
+			name := model.InternalCertName(domain)
+			issued := &IssuedCertResponse{Domain: domain, Status: service.Cert.Status(name)}
+			if cert := service.Cert.Get(name); cert != nil {
+				issued.CertInfo = model.NewCertInfo(cert)
+			}
+			resp.Issued = append(resp.Issued, issued)
+		}
+		slices.SortStableFunc(resp.Issued, func(a, b *IssuedCertResponse) int {
+			return strings.Compare(a.Domain, b.Domain)
+		})
+
+		ctx.Set("resp", model.NewApiResponse(0).SetData(resp))
+	}
+}
+
+// Root 以PEM格式下载根证书，用于导入到需要信任内置CA的机器上
+func (a *aCA) Root() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		service.Cfg.MemoryLock(true)
+		defer service.Cfg.MemoryUnlock(true)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		if cfg.CA == nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("ca not found"))
+			return
+		}
+
+		ca, err := cfg.CA.Certificate()
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		ctx.Header("Content-Disposition", `attachment; filename="vhostd-ca.pem"`)
+		ctx.Data(http.StatusOK, "application/x-pem-file",
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Leaf.Raw}))
+	}
+}
+
+// Set 导入根证书，content为空时只修改签发参数
+func (a *aCA) Set() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req CARequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		var err error
+		req.Content, req.CACfg.Key, err = normalizeCertKey(req.Content, req.Key, req.Pkcs12, req.Password)
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		if req.Content == "" {
+			if cfg.CA == nil {
+				ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("ca not found"))
+				return
+			}
+			req.Content, req.CACfg.Key = cfg.CA.Content, cfg.CA.Key
+		}
+
+		cfg.CA = &req.CACfg
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
+
+func (a *aCA) Generate() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req CAGenerateRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		if req.CommonName == "" {
+			req.CommonName = "vhostd internal ca"
+		}
+		if req.Days <= 0 {
+			req.Days = 3650
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		if cfg.CA != nil && !req.Force {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("ca already exists"))
+			return
+		}
+
+		ca, err := utils.GenerateCA(req.CommonName, time.Duration(req.Days)*24*time.Hour)
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		chain, key, err := utils.EncodeCertKey(ca)
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		cfg.CA = &model.CACfg{
+			Content:     string(chain),
+			Key:         string(key),
+			Validity:    req.Validity,
+			RenewBefore: req.RenewBefore,
+		}
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
+
+func (a *aCA) Del() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		if cfg.CA == nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("ca not found"))
+			return
+		}
+		if len(cfg.InternalCertDomains()) > 0 {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("ca is in use"))
+			return
+		}
+
+		cfg.CA = nil
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
@@ -1,12 +1,16 @@
 package api
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"slices"
 	"strings"
 
 	"github.com/abxuz/b-tools/bslice"
 	"github.com/abxuz/go-vhostd/internal/model"
 	"github.com/abxuz/go-vhostd/internal/service"
+	"github.com/abxuz/go-vhostd/utils"
 	"github.com/gin-gonic/gin"
 )
 
@@ -18,6 +22,111 @@ type aCert struct {
 type CertResponse struct {
 	*model.CertCfg
 	*model.CertInfo
+	Status *model.CertStatus `json:"status,omitempty"`
+	// KeyEncrypted 私钥是否已用主密钥加密保存
+	KeyEncrypted bool `json:"key_encrypted"`
+	// Warnings 证书链和域名的问题
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type CertRequest struct {
+	model.CertCfg
+	// Key 明文私钥，也可以直接放在content中
+	Key string `json:"key"`
+	// Pkcs12 base64编码的PKCS#12文件，与content二选一
+	Pkcs12 string `json:"pkcs12"`
+	// Password PKCS#12文件或加密私钥的密码，从文件加载时作为key_password保存
+	Password string `json:"password"`
+}
+
+// normalize 把PKCS#12和加密的私钥转换为PEM格式的证书链和明文私钥
+func (r *CertRequest) normalize() error {
+	r.CertCfg.Key = r.Key
+	if r.IsFile() {
+		if r.Pkcs12 != "" {
+			return errors.New("pkcs12 can not be used with cert_file")
+		}
+		r.KeyPassword = r.Password
+		return nil
+	}
+
+	var err error
+	r.Content, r.CertCfg.Key, err = normalizeCertKey(r.Content, r.Key, r.Pkcs12, r.Password)
+	return err
+}
+
+// normalizeCertKey 提供了PKCS#12或密码时转换为PEM格式的证书链和明文私钥，否则原样返回
+func normalizeCertKey(content, key, pkcs12, password string) (string, string, error) {
+	var data []byte
+	switch {
+	case pkcs12 != "":
+		if content != "" || key != "" {
+			return "", "", errors.New("pkcs12 can not be used with content or key")
+		}
+		der, err := base64.StdEncoding.DecodeString(pkcs12)
+		if err != nil {
+			return "", "", fmt.Errorf("malform pkcs12: %w", err)
+		}
+		data = der
+	case password != "":
+		data = []byte(content + "\n" + key)
+	default:
+		return content, key, nil
+	}
+
+	cert, err := utils.ParseCert(data, password)
+	if err != nil {
+		return "", "", err
+	}
+	chain, pem, err := utils.EncodeCertKey(cert)
+	if err != nil {
+		return "", "", err
+	}
+	return string(chain), string(pem), nil
+}
+
+type CertKeyRequest struct {
+	// Content 新的证书链，为空时沿用原来的证书链
+	Content string `json:"content"`
+	Key     string `json:"key" binding:"required"`
+	// Password 加密私钥的密码
+	Password string `json:"password"`
+}
+
+// newCertResponse 优先展示正在使用的证书，还没有生效的配置才从配置中解析
+func newCertResponse(cfg model.Cfg, c *model.CertCfg) (*CertResponse, error) {
+	resp := &CertResponse{
+		CertCfg:      c,
+		Status:       service.Cert.Status(c.Name),
+		KeyEncrypted: utils.IsSealed(c.Key),
+		Warnings:     c.Warnings(cfg.CertDomains(c.Name)),
+	}
+
+	if cert := service.Cert.Get(c.Name); cert != nil {
+		resp.CertInfo = model.NewCertInfo(cert)
+		return resp, nil
+	}
+
+	info, err := c.CertInfo()
+	if err != nil {
+		return nil, err
+	}
+	resp.CertInfo = info
+	return resp, nil
+}
+
+// certWarnings 检查证书的问题，保存配置后作为警告返回
+func certWarnings(cfg model.Cfg, names ...string) []string {
+	warnings := make([]string, 0)
+	for _, c := range cfg.Cert {
+		if !slices.Contains(names, c.Name) {
+			continue
+		}
+		for _, warning := range c.Warnings(cfg.CertDomains(c.Name)) {
+			warnings = append(warnings, fmt.Sprintf("cert %v: %v", c.Name, warning))
+		}
+	}
+	return warnings
 }
 
 func (a *aCert) List() gin.HandlerFunc {
@@ -29,15 +138,12 @@ func (a *aCert) List() gin.HandlerFunc {
 
 		list := make([]*CertResponse, 0)
 		for _, c := range cfg.Cert {
-			info, err := c.CertInfo()
+			resp, err := newCertResponse(cfg, c)
 			if err != nil {
 				ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
 				return
 			}
-			list = append(list, &CertResponse{
-				CertCfg:  c,
-				CertInfo: info,
-			})
+			list = append(list, resp)
 		}
 
 		slices.SortStableFunc(list, func(a, b *CertResponse) int {
@@ -67,50 +173,52 @@ func (a *aCert) Get() gin.HandlerFunc {
 			return
 		}
 
-		cert := cfg.Cert[i]
-		info, err := cert.CertInfo()
+		resp, err := newCertResponse(cfg, cfg.Cert[i])
 		if err != nil {
 			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
 			return
 		}
-
-		resp := &CertResponse{
-			CertCfg:  cert,
-			CertInfo: info,
-		}
 		ctx.Set("resp", model.NewApiResponse(0).SetData(resp))
 	}
 }
 
 func (a *aCert) Add() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		var req model.CertCfg
+		var req CertRequest
 		if err := ctx.ShouldBindJSON(&req); err != nil {
 			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
 			return
 		}
+		if err := req.normalize(); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
 
 		service.Cfg.MemoryLock(false)
 		defer service.Cfg.MemoryUnlock(false)
 
 		cfg, _ := service.Cfg.LoadFromMemory()
-		cfg.Cert = append(cfg.Cert, &req)
+		cfg.Cert = append(cfg.Cert, &req.CertCfg)
 
 		if err := service.Cfg.SaveToMemory(cfg); err != nil {
 			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
 			return
 		}
-		ctx.Set("resp", model.NewApiResponse(0))
+		ctx.Set("resp", model.NewApiResponse(0).SetWarnings(certWarnings(cfg, req.Name)))
 	}
 }
 
 func (a *aCert) Mod() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		var req model.CertCfg
+		var req CertRequest
 		if err := ctx.ShouldBindJSON(&req); err != nil {
 			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
 			return
 		}
+		if err := req.normalize(); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
 
 		service.Cfg.MemoryLock(false)
 		defer service.Cfg.MemoryUnlock(false)
@@ -127,12 +235,20 @@ func (a *aCert) Mod() gin.HandlerFunc {
 			return
 		}
 
-		*cfg.Cert[i] = req
+		// 没有提供新私钥时沿用原来的私钥，更换私钥使用单独的接口
+		if _, key := utils.SplitCertKey([]byte(req.Content)); req.CertCfg.Key == "" && len(key) == 0 && !req.IsFile() {
+			req.CertCfg.Key = cfg.Cert[i].Key
+		}
+		if req.IsFile() && req.Password == "" && cfg.Cert[i].IsFile() {
+			req.KeyPassword = cfg.Cert[i].KeyPassword
+		}
+
+		*cfg.Cert[i] = req.CertCfg
 		if err := service.Cfg.SaveToMemory(cfg); err != nil {
 			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
 			return
 		}
-		ctx.Set("resp", model.NewApiResponse(0))
+		ctx.Set("resp", model.NewApiResponse(0).SetWarnings(certWarnings(cfg, req.Name)))
 	}
 }
 
@@ -145,19 +261,36 @@ func (a *aCert) Del() gin.HandlerFunc {
 
 		cfg, _ := service.Cfg.LoadFromMemory()
 		for _, vhost := range cfg.Https.Vhost {
-			if vhost.Cert == name {
+			if slices.Contains(vhost.GetCerts(), name) {
 				ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("cert is in use"))
 				return
 			}
 		}
 
 		for _, vhost := range cfg.Http3.Vhost {
-			if vhost.Cert == name {
+			if slices.Contains(vhost.GetCerts(), name) {
+				ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("cert is in use"))
+				return
+			}
+		}
+
+		if cfg.Https.DefaultCert == name || cfg.Http3.DefaultCert == name {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("cert is in use"))
+			return
+		}
+
+		for _, stream := range cfg.Stream {
+			if stream.Cert == name {
 				ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("cert is in use"))
 				return
 			}
 		}
 
+		if slices.Contains(cfg.UpstreamCerts(), name) {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("cert is in use"))
+			return
+		}
+
 		i := bslice.FindIndex(cfg.Cert,
 			func(c *model.CertCfg) bool {
 				return c.Name == name
@@ -177,3 +310,55 @@ func (a *aCert) Del() gin.HandlerFunc {
 		ctx.Set("resp", model.NewApiResponse(0))
 	}
 }
+
+func (a *aCert) SetKey() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		name := ctx.Param("name")
+
+		var req CertKeyRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		i := bslice.FindIndex(cfg.Cert,
+			func(c *model.CertCfg) bool {
+				return c.Name == name
+			},
+		)
+
+		if i == -1 {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("cert not found"))
+			return
+		}
+		if cfg.Cert[i].IsFile() {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("cert is loaded from file"))
+			return
+		}
+
+		cert := *cfg.Cert[i]
+		cert.Key = req.Key
+		if req.Content != "" {
+			cert.Content = req.Content
+		}
+		var err error
+		cert.Content, cert.Key, err = normalizeCertKey(cert.Content, cert.Key, "", req.Password)
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		// 校验失败时不能影响内存中的配置
+		cfg.Cert = slices.Clone(cfg.Cert)
+		cfg.Cert[i] = &cert
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0).SetWarnings(certWarnings(cfg, name)))
+	}
+}
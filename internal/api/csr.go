@@ -0,0 +1,277 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abxuz/b-tools/bslice"
+	"github.com/abxuz/go-vhostd/internal/model"
+	"github.com/abxuz/go-vhostd/internal/service"
+	"github.com/abxuz/go-vhostd/utils"
+	"github.com/gin-gonic/gin"
+)
+
+type CsrResponse struct {
+	*model.CsrCfg
+	Subject string   `json:"subject"`
+	Domain  []string `json:"domain"`
+	// KeyEncrypted 私钥是否已用主密钥加密保存
+	KeyEncrypted bool `json:"key_encrypted"`
+}
+
+type CsrRequest struct {
+	Name string `json:"name" binding:"required"`
+	// KeyType 可选ec256/ec384/rsa2048/rsa3072/rsa4096/ed25519，默认ec256
+	KeyType            string `json:"key_type"`
+	CommonName         string `json:"common_name"`
+	Organization       string `json:"organization"`
+	OrganizationalUnit string `json:"organizational_unit"`
+	Country            string `json:"country"`
+	Province           string `json:"province"`
+	Locality           string `json:"locality"`
+	// San 域名或者IP，为空时使用common_name
+	San []string `json:"san"`
+}
+
+type CsrIssueRequest struct {
+	// Content CA签发的证书链，PEM格式
+	Content string `json:"content" binding:"required"`
+}
+
+func newCsrResponse(c *model.CsrCfg) (*CsrResponse, error) {
+	csr, err := c.Request()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &CsrResponse{
+		CsrCfg:       c,
+		Subject:      csr.Subject.String(),
+		Domain:       csr.DNSNames,
+		KeyEncrypted: utils.IsSealed(c.Key),
+	}
+	for _, ip := range csr.IPAddresses {
+		resp.Domain = append(resp.Domain, ip.String())
+	}
+	if resp.Domain == nil {
+		resp.Domain = []string{}
+	}
+	return resp, nil
+}
+
+func (a *aCert) ListCsr() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		service.Cfg.MemoryLock(true)
+		defer service.Cfg.MemoryUnlock(true)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+
+		list := make([]*CsrResponse, 0)
+		for _, c := range cfg.Csr {
+			resp, err := newCsrResponse(c)
+			if err != nil {
+				ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+				return
+			}
+			list = append(list, resp)
+		}
+
+		slices.SortStableFunc(list, func(a, b *CsrResponse) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+
+		ctx.Set("resp", model.NewApiResponse(0).SetData(list))
+	}
+}
+
+func (a *aCert) GetCsr() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		name := ctx.Param("name")
+
+		service.Cfg.MemoryLock(true)
+		defer service.Cfg.MemoryUnlock(true)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		i := bslice.FindIndex(cfg.Csr,
+			func(c *model.CsrCfg) bool {
+				return c.Name == name
+			},
+		)
+
+		if i == -1 {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("csr not found"))
+			return
+		}
+
+		resp, err := newCsrResponse(cfg.Csr[i])
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0).SetData(resp))
+	}
+}
+
+// AddCsr 生成私钥和证书签名请求，私钥保存在配置中，不会通过api返回
+func (a *aCert) AddCsr() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req CsrRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		if req.CommonName == "" && len(req.San) == 0 {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("common_name or san required"))
+			return
+		}
+		if req.CommonName == "" {
+			req.CommonName = req.San[0]
+		}
+		if len(req.San) == 0 {
+			req.San = []string{req.CommonName}
+		}
+
+		key, err := utils.GenerateKey(req.KeyType)
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		subject := pkix.Name{CommonName: req.CommonName}
+		if req.Organization != "" {
+			subject.Organization = []string{req.Organization}
+		}
+		if req.OrganizationalUnit != "" {
+			subject.OrganizationalUnit = []string{req.OrganizationalUnit}
+		}
+		if req.Country != "" {
+			subject.Country = []string{req.Country}
+		}
+		if req.Province != "" {
+			subject.Province = []string{req.Province}
+		}
+		if req.Locality != "" {
+			subject.Locality = []string{req.Locality}
+		}
+
+		csr, err := utils.CreateCSR(key, subject, req.San)
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		_, pem, err := utils.EncodeCertKey(&tls.Certificate{PrivateKey: key})
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		c := &model.CsrCfg{
+			Name:      req.Name,
+			KeyType:   req.KeyType,
+			Csr:       string(csr),
+			Key:       string(pem),
+			CreatedAt: time.Now().Format(time.DateTime),
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		cfg.Csr = append(slices.Clone(cfg.Csr), c)
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		resp, err := newCsrResponse(c)
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0).SetData(resp))
+	}
+}
+
+func (a *aCert) DelCsr() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		name := ctx.Param("name")
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		i := bslice.FindIndex(cfg.Csr,
+			func(c *model.CsrCfg) bool {
+				return c.Name == name
+			},
+		)
+
+		if i == -1 {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("csr not found"))
+			return
+		}
+		cfg.Csr = slices.Delete(slices.Clone(cfg.Csr), i, i+1)
+
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
+
+// IssueCsr 把签发的证书链和等待签发的私钥合并为证书，同名证书存在时替换
+func (a *aCert) IssueCsr() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		name := ctx.Param("name")
+
+		var req CsrIssueRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		i := bslice.FindIndex(cfg.Csr,
+			func(c *model.CsrCfg) bool {
+				return c.Name == name
+			},
+		)
+
+		if i == -1 {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("csr not found"))
+			return
+		}
+
+		cert := cfg.Csr[i].Cert(req.Content)
+		cfg.Csr = slices.Delete(slices.Clone(cfg.Csr), i, i+1)
+
+		// 校验失败时不能影响内存中的配置
+		cfg.Cert = slices.Clone(cfg.Cert)
+		j := bslice.FindIndex(cfg.Cert,
+			func(c *model.CertCfg) bool {
+				return c.Name == name
+			},
+		)
+		if j == -1 {
+			cfg.Cert = append(cfg.Cert, cert)
+		} else if cfg.Cert[j].IsFile() {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("cert is loaded from file"))
+			return
+		} else {
+			cfg.Cert[j] = cert
+		}
+
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0).SetWarnings(certWarnings(cfg, name)))
+	}
+}
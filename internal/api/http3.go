@@ -72,7 +72,7 @@ func (a *aHttp3) AddVhost() gin.HandlerFunc {
 			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
 			return
 		}
-		ctx.Set("resp", model.NewApiResponse(0))
+		ctx.Set("resp", model.NewApiResponse(0).SetWarnings(certWarnings(cfg, req.GetCerts()...)))
 	}
 }
 
@@ -103,7 +103,7 @@ func (a *aHttp3) ModVhost() gin.HandlerFunc {
 			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
 			return
 		}
-		ctx.Set("resp", model.NewApiResponse(0))
+		ctx.Set("resp", model.NewApiResponse(0).SetWarnings(certWarnings(cfg, req.GetCerts()...)))
 	}
 }
 
@@ -134,3 +134,34 @@ func (a *aHttp3) DelVhost() gin.HandlerFunc {
 		ctx.Set("resp", model.NewApiResponse(0))
 	}
 }
+
+func (a *aHttp3) GetDefaultCert() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		service.Cfg.MemoryLock(true)
+		defer service.Cfg.MemoryUnlock(true)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		ctx.Set("resp", model.NewApiResponse(0).SetData(cfg.Http3.DefaultCertCfg))
+	}
+}
+
+func (a *aHttp3) SetDefaultCert() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req model.DefaultCertCfg
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		cfg.Http3.DefaultCertCfg = req
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
@@ -72,7 +72,7 @@ func (a *aHttps) AddVhost() gin.HandlerFunc {
 			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
 			return
 		}
-		ctx.Set("resp", model.NewApiResponse(0))
+		ctx.Set("resp", model.NewApiResponse(0).SetWarnings(certWarnings(cfg, req.GetCerts()...)))
 	}
 }
 
@@ -103,7 +103,7 @@ func (a *aHttps) ModVhost() gin.HandlerFunc {
 			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
 			return
 		}
-		ctx.Set("resp", model.NewApiResponse(0))
+		ctx.Set("resp", model.NewApiResponse(0).SetWarnings(certWarnings(cfg, req.GetCerts()...)))
 	}
 }
 
@@ -134,3 +134,65 @@ func (a *aHttps) DelVhost() gin.HandlerFunc {
 		ctx.Set("resp", model.NewApiResponse(0))
 	}
 }
+
+func (a *aHttps) GetPassthrough() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		service.Cfg.MemoryLock(true)
+		defer service.Cfg.MemoryUnlock(true)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		ctx.Set("resp", model.NewApiResponse(0).SetData(cfg.Https.Passthrough))
+	}
+}
+
+func (a *aHttps) SetPassthrough() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req []*model.StreamSniCfg
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		cfg.Https.Passthrough = req
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
+
+func (a *aHttps) GetDefaultCert() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		service.Cfg.MemoryLock(true)
+		defer service.Cfg.MemoryUnlock(true)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		ctx.Set("resp", model.NewApiResponse(0).SetData(cfg.Https.DefaultCertCfg))
+	}
+}
+
+func (a *aHttps) SetDefaultCert() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req model.DefaultCertCfg
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		cfg.Https.DefaultCertCfg = req
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
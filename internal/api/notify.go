@@ -0,0 +1,84 @@
+package api
+
+import (
+	"time"
+
+	"github.com/abxuz/go-vhostd/internal/model"
+	"github.com/abxuz/go-vhostd/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+var Notify = &aNotify{}
+
+type aNotify struct {
+}
+
+type NotifyResponse struct {
+	*model.NotifyCfg
+	// SmtpPasswordSet 是否配置了SMTP密码，密码不会通过api返回
+	SmtpPasswordSet bool `json:"smtp_password_set"`
+}
+
+type NotifyRequest struct {
+	model.NotifyCfg
+	// SmtpPassword SMTP密码，为空时沿用原来的密码
+	SmtpPassword string `json:"smtp_password"`
+}
+
+func (a *aNotify) Get() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		service.Cfg.MemoryLock(true)
+		defer service.Cfg.MemoryUnlock(true)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		resp := &NotifyResponse{NotifyCfg: cfg.Notify}
+		if cfg.Notify != nil && cfg.Notify.Smtp != nil {
+			resp.SmtpPasswordSet = cfg.Notify.Smtp.Password != ""
+		}
+		ctx.Set("resp", model.NewApiResponse(0).SetData(resp))
+	}
+}
+
+func (a *aNotify) Set() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req *NotifyRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		if req.Smtp != nil {
+			if req.SmtpPassword != "" {
+				req.Smtp.Password = req.SmtpPassword
+			} else if cfg.Notify != nil && cfg.Notify.Smtp != nil {
+				req.Smtp.Password = cfg.Notify.Smtp.Password
+			}
+		}
+		cfg.Notify = &req.NotifyCfg
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
+
+// Test 使用当前生效的配置发送测试通知，修改配置后需要先reload
+func (a *aNotify) Test() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := service.Notify.Test(&model.Notification{
+			Event:   model.EventTest,
+			Message: "test notification from vhostd",
+			Time:    time.Now(),
+		})
+		if err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/abxuz/b-tools/bslice"
+	"github.com/abxuz/go-vhostd/internal/model"
+	"github.com/abxuz/go-vhostd/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+var Stream = &aStream{}
+
+type aStream struct {
+}
+
+func (a *aStream) List() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		service.Cfg.MemoryLock(true)
+		defer service.Cfg.MemoryUnlock(true)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+
+		stream := make([]*model.StreamCfg, len(cfg.Stream))
+		copy(stream, cfg.Stream)
+
+		slices.SortStableFunc(stream, func(a, b *model.StreamCfg) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+
+		ctx.Set("resp", model.NewApiResponse(0).SetData(stream))
+	}
+}
+
+func (a *aStream) Get() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		name := ctx.Param("name")
+
+		service.Cfg.MemoryLock(true)
+		defer service.Cfg.MemoryUnlock(true)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		i := bslice.FindIndex(cfg.Stream,
+			func(c *model.StreamCfg) bool {
+				return c.Name == name
+			},
+		)
+
+		if i == -1 {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("stream not found"))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0).SetData(cfg.Stream[i]))
+	}
+}
+
+func (a *aStream) Add() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req model.StreamCfg
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		cfg.Stream = append(slices.Clone(cfg.Stream), &req)
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
+
+func (a *aStream) Mod() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req model.StreamCfg
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+		i := bslice.FindIndex(cfg.Stream,
+			func(c *model.StreamCfg) bool {
+				return c.Name == req.Name
+			},
+		)
+
+		if i == -1 {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("stream not found"))
+			return
+		}
+		// 在副本上修改，校验失败时不影响内存中的配置
+		cfg.Stream = slices.Clone(cfg.Stream)
+		cfg.Stream[i] = &req
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
+
+func (a *aStream) Del() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		name := ctx.Param("name")
+
+		service.Cfg.MemoryLock(false)
+		defer service.Cfg.MemoryUnlock(false)
+
+		cfg, _ := service.Cfg.LoadFromMemory()
+
+		i := bslice.FindIndex(cfg.Stream,
+			func(c *model.StreamCfg) bool {
+				return c.Name == name
+			},
+		)
+		if i == -1 {
+			ctx.Set("resp", model.NewApiResponse(1).SetErrMsg("stream not found"))
+			return
+		}
+		cfg.Stream = slices.Delete(slices.Clone(cfg.Stream), i, i+1)
+
+		if err := service.Cfg.SaveToMemory(cfg); err != nil {
+			ctx.Set("resp", model.NewApiResponse(1).SetErr(err))
+			return
+		}
+		ctx.Set("resp", model.NewApiResponse(0))
+	}
+}
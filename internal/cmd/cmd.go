@@ -1,22 +1,29 @@
 package cmd
 
 import (
+	"errors"
+	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 	_ "time/tzdata"
 
 	"github.com/abxuz/go-vhostd/internal/service"
 	_ "github.com/abxuz/go-vhostd/internal/service/logic"
+	_ "github.com/abxuz/go-vhostd/internal/xconnect"
+	"github.com/abxuz/go-vhostd/utils"
 	"github.com/spf13/cobra"
 )
 
 func NewCmd() *cobra.Command {
 	var (
-		config string
-		init   bool
+		config        string
+		init          bool
+		masterKeyFile string
+		ocspCacheDir  string
 	)
 
 	c := &cobra.Command{
@@ -30,8 +37,21 @@ func NewCmd() *cobra.Command {
 			}
 			time.Local = zone
 
+			if err := loadMasterKeys(masterKeyFile); err != nil {
+				cmd.PrintErrln(err)
+				os.Exit(1)
+			}
+
+			if !cmd.Flags().Changed("ocsp-cache-dir") {
+				ocspCacheDir = filepath.Join(filepath.Dir(config), "ocsp-cache")
+			}
+
 			service.Cfg.SetFilePath(config, init)
+			service.Notify.Init()
+			service.Cert.SetOCSPCacheDir(ocspCacheDir)
+			service.Cert.Init()
 			service.Proxy.Init()
+			service.Stream.Init()
 			service.Api.Init()
 
 			cfg, err := service.Cfg.LoadFromFile()
@@ -39,12 +59,33 @@ func NewCmd() *cobra.Command {
 				cmd.PrintErrln(err)
 				os.Exit(1)
 			}
+			if len(cfg.Secrets()) > 0 && !utils.HasMasterKey() {
+				log.Println("[cfg] warning: no master key configured, private keys and passwords are saved in plain text")
+			}
+			// 没有配置upstream_tls的https上游以前不校验证书，现在按系统根证书校验
+			for _, upstream := range cfg.UnverifiedUpstreams() {
+				log.Printf("[cfg] warning: upstream %v is verified against system roots, set upstream_tls verify to ca or insecure for self-signed certificates", upstream)
+			}
+			reseal := cfg.NeedReseal()
 			service.Cfg.SaveToMemory(cfg)
+			// 配置文件中未加密或者用旧主密钥加密的内容，启动时重新加密后写回
+			if reseal {
+				func() {
+					service.Cfg.FileLock(false)
+					defer service.Cfg.FileUnlock(false)
+					if err := service.Cfg.SaveToFile(cfg); err != nil {
+						log.Printf("[cfg] unable to save resealed config: %v", err)
+					}
+				}()
+			}
 
 			func() {
 				service.Cfg.MemoryLock(true)
 				defer service.Cfg.MemoryUnlock(true)
+				service.Notify.Reload(cfg)
+				service.Cert.Reload(cfg)
 				service.Proxy.Reload(cfg)
+				service.Stream.Reload(cfg)
 				service.Api.Reload(cfg)
 			}()
 
@@ -56,6 +97,35 @@ func NewCmd() *cobra.Command {
 
 	c.Flags().StringVarP(&config, "config", "c", "config.yaml", "config file path")
 	c.Flags().BoolVarP(&init, "init", "i", false, "auto initialize config file")
+	c.Flags().StringVarP(&masterKeyFile, "master-key-file", "k", "", "master key file for encrypting private keys, one key per line, the first one is used for encryption")
+	c.Flags().StringVar(&ocspCacheDir, "ocsp-cache-dir", "", "directory for caching ocsp responses across restarts, defaults to ocsp-cache next to the config file, set to empty to disable")
 	c.MarkFlagFilename("config")
+	c.MarkFlagFilename("master-key-file")
 	return c
 }
+
+// loadMasterKeys 主密钥依次从命令行参数指定的文件、VHOSTD_MASTER_KEY_FILE、VHOSTD_MASTER_KEY中读取
+func loadMasterKeys(file string) error {
+	if file == "" {
+		file = os.Getenv("VHOSTD_MASTER_KEY_FILE")
+	}
+
+	var secrets []string
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				secrets = append(secrets, line)
+			}
+		}
+		if len(secrets) == 0 {
+			return errors.New("no master key found in " + file)
+		}
+	} else if secret := os.Getenv("VHOSTD_MASTER_KEY"); secret != "" {
+		secrets = append(secrets, secret)
+	}
+	return utils.SetMasterKeys(secrets)
+}
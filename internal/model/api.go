@@ -4,6 +4,8 @@ type ApiResponse struct {
 	ErrNo  int    `json:"errno"`
 	ErrMsg string `json:"errmsg,omitempty"`
 	Data   any    `json:"data,omitempty"`
+	// Warnings 不影响保存配置的问题，例如证书链不完整
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 func NewApiResponse(errno int) *ApiResponse {
@@ -31,3 +33,8 @@ func (r *ApiResponse) SetData(data any) *ApiResponse {
 	r.Data = data
 	return r
 }
+
+func (r *ApiResponse) SetWarnings(warnings []string) *ApiResponse {
+	r.Warnings = warnings
+	return r
+}
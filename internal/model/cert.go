@@ -1,8 +1,58 @@
 package model
 
+import "time"
+
 type CertInfo struct {
 	Domain     []string `json:"domain"`
 	Issuer     string   `json:"issuer"`
 	ValidStart string   `json:"valid_start"`
 	ValidStop  string   `json:"valid_stop"`
+	// NotAfter 与ValidStop相同，RFC3339格式
+	NotAfter time.Time `json:"not_after"`
+	// DaysRemaining 剩余有效天数，已过期时为负数
+	DaysRemaining int `json:"days_remaining"`
+}
+
+type CertStatus struct {
+	// Source 证书来源，content、file或internal
+	Source string `json:"source"`
+	// LoadedAt 当前使用的证书的加载时间
+	LoadedAt string `json:"loaded_at,omitempty"`
+	// Error 最近一次重新加载失败的原因，失败时继续使用之前的证书
+	Error string `json:"error,omitempty"`
+	// Completed 证书链缺少中间证书时，从AIA下载中间证书的地址
+	Completed []string `json:"completed,omitempty"`
+	// CompleteError 最近一次补全证书链失败的原因
+	CompleteError string `json:"complete_error,omitempty"`
+	// Expiry 可选valid/expiring/expired，剩余天数小于等于最大的提醒天数时为expiring
+	Expiry string `json:"expiry,omitempty"`
+	// OCSP 最近一次查询OCSP的结果，证书没有OCSP地址时为空
+	OCSP *OCSPStatus `json:"ocsp,omitempty"`
+}
+
+type OCSPStatus struct {
+	// Status 可选pending/good/revoked/unknown/error
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Source 当前响应的来源，responder为在线查询，cache为启动时从磁盘读取
+	Source    string `json:"source,omitempty"`
+	Responder string `json:"responder,omitempty"`
+	// Stapled 是否在TLS握手时发送给客户端，只发送有效期内的good响应
+	Stapled    bool   `json:"stapled"`
+	MustStaple bool   `json:"must_staple"`
+	RevokedAt  string `json:"revoked_at,omitempty"`
+	ThisUpdate string `json:"this_update,omitempty"`
+	NextUpdate string `json:"next_update,omitempty"`
+	UpdatedAt  string `json:"updated_at,omitempty"`
+	// NextRefresh 下一次查询的时间
+	NextRefresh string `json:"next_refresh,omitempty"`
+}
+
+// DaysRemaining 距离过期的天数，不足一天按0天计算，已过期时为负数
+func DaysRemaining(notAfter time.Time) int {
+	d := time.Until(notAfter)
+	if d < 0 {
+		return -int((-d).Hours()/24) - 1
+	}
+	return int(d.Hours() / 24)
 }
@@ -1,13 +1,20 @@
 package model
 
 import (
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"os"
+	"reflect"
+	"slices"
 	"strings"
 	"time"
 
@@ -15,6 +22,7 @@ import (
 	"github.com/abxuz/b-tools/bset"
 	"github.com/abxuz/b-tools/bslice"
 	"github.com/abxuz/go-vhostd/utils"
+	"gopkg.in/yaml.v3"
 )
 
 type Cfg struct {
@@ -23,9 +31,23 @@ type Cfg struct {
 	Https *HttpsCfg  `yaml:"https,omitempty" json:"https,omitempty"`
 	Http3 *Http3Cfg  `yaml:"http3,omitempty" json:"http3,omitempty"`
 	Cert  []*CertCfg `yaml:"cert,omitempty" json:"cert,omitempty"`
+	// CA 内置的私有CA，为证书配置为internal的vhost签发证书
+	CA *CACfg `yaml:"ca,omitempty" json:"ca,omitempty"`
+	// Csr 等待签发的证书签名请求，签发后转换为证书配置
+	Csr []*CsrCfg `yaml:"csr,omitempty" json:"csr,omitempty"`
+	// Notify 证书过期和吊销的通知方式，没有配置时只输出到日志
+	Notify *NotifyCfg `yaml:"notify,omitempty" json:"notify,omitempty"`
+
+	Stream []*StreamCfg `yaml:"stream,omitempty" json:"stream,omitempty"`
+
+	TrustedProxy []string `yaml:"trusted_proxy,omitempty" json:"trusted_proxy,omitempty"`
 }
 
 func (c *Cfg) CheckValid() error {
+	if _, err := c.GetTrustedProxy(); err != nil {
+		return err
+	}
+
 	if c.Http != nil {
 		if err := c.Http.CheckValid(); err != nil {
 			return err
@@ -38,10 +60,39 @@ func (c *Cfg) CheckValid() error {
 		}
 	}
 
-	listens := append(c.Api.Listen, c.Http.Listen...)
-	listens = append(listens, c.Https.Listen...)
+	listens := append([]string{}, c.Api.Listen...)
+	for _, l := range c.Http.Listen {
+		listens = append(listens, l.Addr)
+	}
+	for _, l := range c.Https.Listen {
+		listens = append(listens, l.Addr)
+	}
+	for _, stream := range c.Stream {
+		if stream.GetNetwork() != "tcp" {
+			continue
+		}
+		for _, l := range stream.Listen {
+			listens = append(listens, l.Addr)
+		}
+	}
 	if !bslice.Unique(listens, func(l string) string { return l }) {
-		return errors.New("duplicate listen address in api/http/https config")
+		return errors.New("duplicate listen address in api/http/https/stream config")
+	}
+
+	udpListens := make([]string, 0)
+	for _, l := range c.Http3.Listen {
+		udpListens = append(udpListens, l.Addr)
+	}
+	for _, stream := range c.Stream {
+		if stream.GetNetwork() != "udp" {
+			continue
+		}
+		for _, l := range stream.Listen {
+			udpListens = append(udpListens, l.Addr)
+		}
+	}
+	if !bslice.Unique(udpListens, func(l string) string { return l }) {
+		return errors.New("duplicate listen address in http3/udp stream config")
 	}
 
 	if c.Http3 != nil {
@@ -60,26 +111,205 @@ func (c *Cfg) CheckValid() error {
 		return errors.New("duplicate cert name in config")
 	}
 
+	for _, stream := range c.Stream {
+		if err := stream.CheckValid(); err != nil {
+			return err
+		}
+	}
+
+	if !bslice.Unique(c.Stream, func(stream *StreamCfg) string { return stream.Name }) {
+		return errors.New("duplicate stream name in config")
+	}
+
+	for _, csr := range c.Csr {
+		if err := csr.CheckValid(); err != nil {
+			return err
+		}
+	}
+
+	if !bslice.Unique(c.Csr, func(csr *CsrCfg) string { return csr.Name }) {
+		return errors.New("duplicate csr name in config")
+	}
+
+	if c.CA != nil {
+		if err := c.CA.CheckValid(); err != nil {
+			return err
+		}
+	}
+
+	if c.Notify != nil {
+		if err := c.Notify.CheckValid(); err != nil {
+			return err
+		}
+	}
+	if len(c.InternalCertDomains()) > 0 && c.CA == nil {
+		return errors.New("ca required for internal cert")
+	}
+
 	certs := bmap.NewMapFromSlice(c.Cert, func(cert *CertCfg) string { return cert.Name })
+	certs[InternalCert] = nil
 	if c.Https != nil {
 		for _, vhost := range c.Https.Vhost {
-			if _, ok := certs[vhost.Cert]; !ok {
-				return fmt.Errorf("cert %v not found", vhost.Cert)
+			for _, name := range vhost.GetCerts() {
+				if _, ok := certs[name]; !ok {
+					return fmt.Errorf("cert %v not found", name)
+				}
 			}
 		}
 	}
 
 	if c.Http3 != nil {
 		for _, vhost := range c.Http3.Vhost {
-			if _, ok := certs[vhost.Cert]; !ok {
-				return fmt.Errorf("cert %v not found", vhost.Cert)
+			for _, name := range vhost.GetCerts() {
+				if _, ok := certs[name]; !ok {
+					return fmt.Errorf("cert %v not found", name)
+				}
 			}
 		}
 	}
 
+	delete(certs, InternalCert)
+	for _, name := range []string{c.Https.DefaultCert, c.Http3.DefaultCert} {
+		if name == "" {
+			continue
+		}
+		if _, ok := certs[name]; !ok {
+			return fmt.Errorf("cert %v not found", name)
+		}
+	}
+
+	for _, stream := range c.Stream {
+		if stream.Cert == "" {
+			continue
+		}
+		if _, ok := certs[stream.Cert]; !ok {
+			return fmt.Errorf("cert %v not found", stream.Cert)
+		}
+	}
+
+	for _, name := range c.UpstreamCerts() {
+		if _, ok := certs[name]; !ok {
+			return fmt.Errorf("cert %v not found", name)
+		}
+	}
+
 	return nil
 }
 
+// CertDomains 返回使用该证书的vhost域名
+func (c *Cfg) CertDomains(name string) []string {
+	domains := make([]string, 0)
+	for _, vhost := range c.Https.Vhost {
+		if slices.Contains(vhost.GetCerts(), name) && !slices.Contains(domains, vhost.Domain) {
+			domains = append(domains, vhost.Domain)
+		}
+	}
+	for _, vhost := range c.Http3.Vhost {
+		if slices.Contains(vhost.GetCerts(), name) && !slices.Contains(domains, vhost.Domain) {
+			domains = append(domains, vhost.Domain)
+		}
+	}
+	return domains
+}
+
+// InternalCertDomains 返回证书配置为internal的vhost域名
+func (c *Cfg) InternalCertDomains() []string {
+	return c.CertDomains(InternalCert)
+}
+
+// UpstreamCerts 返回所有mapping中用于上游客户端证书的证书名称
+func (c *Cfg) UpstreamCerts() []string {
+	mappings := make([]*MappingCfg, 0)
+	for _, vhost := range c.Http.Vhost {
+		mappings = append(mappings, vhost.Mapping...)
+	}
+	for _, vhost := range c.Https.Vhost {
+		mappings = append(mappings, vhost.Mapping...)
+	}
+	for _, vhost := range c.Http3.Vhost {
+		mappings = append(mappings, vhost.Mapping...)
+	}
+
+	names := make([]string, 0)
+	for _, m := range mappings {
+		if m.UpstreamTLS != nil && m.UpstreamTLS.Cert != "" {
+			names = append(names, m.UpstreamTLS.Cert)
+		}
+	}
+	return names
+}
+
+// UnverifiedUpstreams 返回没有配置upstream_tls的https/http3上游，
+// 这些上游按系统根证书校验，自签名证书的上游需要配置upstream_tls
+func (c *Cfg) UnverifiedUpstreams() []string {
+	upstreams := make([]string, 0)
+	add := func(domain string, mappings []*MappingCfg) {
+		for _, m := range mappings {
+			if m.UpstreamTLS != nil || m.ConnectUdp != nil {
+				continue
+			}
+			u, err := m.GetTarget()
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http3") {
+				continue
+			}
+			upstreams = append(upstreams, domain+m.Path+" -> "+m.Target)
+		}
+	}
+	for _, vhost := range c.Http.Vhost {
+		add(vhost.Domain, vhost.Mapping)
+	}
+	for _, vhost := range c.Https.Vhost {
+		add(vhost.Domain, vhost.Mapping)
+	}
+	for _, vhost := range c.Http3.Vhost {
+		add(vhost.Domain, vhost.Mapping)
+	}
+	return upstreams
+}
+
+// Secrets 返回需要加密保存的私钥和密码，包括证书内容中还没有拆分出来的私钥
+func (c *Cfg) Secrets() []string {
+	secrets := make([]string, 0)
+	add := func(s string) {
+		if s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+	for _, cert := range c.Cert {
+		add(cert.KeyPassword)
+		add(cert.Key)
+		if !cert.IsFile() {
+			_, key := utils.SplitCertKey([]byte(cert.Content))
+			add(string(key))
+		}
+	}
+	for _, csr := range c.Csr {
+		add(csr.Key)
+	}
+	if c.CA != nil {
+		add(c.CA.Key)
+		_, key := utils.SplitCertKey([]byte(c.CA.Content))
+		add(string(key))
+	}
+	if c.Notify != nil && c.Notify.Smtp != nil {
+		add(c.Notify.Smtp.Password)
+	}
+	return secrets
+}
+
+// NeedReseal 有私钥或密码未加密或者不是用当前主密钥加密时，需要重新保存配置文件
+func (c *Cfg) NeedReseal() bool {
+	return slices.ContainsFunc(c.Secrets(), utils.NeedReseal)
+}
+
+func (c *Cfg) GetTrustedProxy() ([]netip.Prefix, error) {
+	prefixes, err := utils.ParsePrefixes(c.TrustedProxy)
+	if err != nil {
+		return nil, fmt.Errorf("malform trusted_proxy: %w", err)
+	}
+	return prefixes, nil
+}
+
 type ApiCfg struct {
 	Listen []string `yaml:"listen" json:"listen"`
 	Auth   *AuthCfg `yaml:"auth,omitempty" json:"auth,omitempty"`
@@ -90,12 +320,109 @@ type AuthCfg struct {
 	Password string `yaml:"password" json:"password"`
 }
 
+type ListenCfg struct {
+	Addr          string            `yaml:"addr" json:"addr"`
+	ProxyProtocol *ProxyProtocolCfg `yaml:"proxy_protocol,omitempty" json:"proxy_protocol,omitempty"`
+	// Plaintext 仅用于https监听，明文http请求的处理方式，
+	// redirect跳转到https，http交给http vhost处理，为空则不识别
+	Plaintext string `yaml:"plaintext,omitempty" json:"plaintext,omitempty"`
+}
+
+type rawListenCfg ListenCfg
+
+// 没有额外选项的监听地址可以直接写成字符串，兼容旧的配置格式
+func (c *ListenCfg) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&c.Addr)
+	}
+	return node.Decode((*rawListenCfg)(c))
+}
+
+func (c ListenCfg) MarshalYAML() (any, error) {
+	if c.isPlain() {
+		return c.Addr, nil
+	}
+	return (rawListenCfg)(c), nil
+}
+
+func (c *ListenCfg) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &c.Addr)
+	}
+	return json.Unmarshal(data, (*rawListenCfg)(c))
+}
+
+func (c ListenCfg) MarshalJSON() ([]byte, error) {
+	if c.isPlain() {
+		return json.Marshal(c.Addr)
+	}
+	return json.Marshal((rawListenCfg)(c))
+}
+
+func (c *ListenCfg) isPlain() bool {
+	return c.ProxyProtocol == nil && c.Plaintext == ""
+}
+
+func (c *ListenCfg) Equal(o *ListenCfg) bool {
+	return reflect.DeepEqual(c, o)
+}
+
+func (c *ListenCfg) CheckValid() error {
+	if utils.ExistEmptyString(true, c.Addr) {
+		return errors.New("addr required for listen config")
+	}
+
+	if c.ProxyProtocol != nil {
+		if err := c.ProxyProtocol.CheckValid(); err != nil {
+			return err
+		}
+	}
+
+	switch c.Plaintext {
+	case "", "redirect", "http":
+	default:
+		return errors.New("malform listen plaintext, should be redirect or http")
+	}
+	return nil
+}
+
+type ProxyProtocolCfg struct {
+	// Allow 允许发送PROXY protocol头部的来源地址或网段，其他来源的连接不解析头部
+	Allow []string `yaml:"allow" json:"allow"`
+}
+
+func (c *ProxyProtocolCfg) CheckValid() error {
+	// 不限制来源时任何客户端都可以伪造头部冒充其他地址
+	if len(c.Allow) == 0 {
+		return errors.New("allow required for proxy_protocol config")
+	}
+	_, err := c.GetAllow()
+	return err
+}
+
+func (c *ProxyProtocolCfg) GetAllow() ([]netip.Prefix, error) {
+	prefixes, err := utils.ParsePrefixes(c.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("malform proxy_protocol allow: %w", err)
+	}
+	return prefixes, nil
+}
+
 type HttpCfg struct {
-	Listen []string        `yaml:"listen" json:"listen"`
+	Listen []*ListenCfg    `yaml:"listen" json:"listen"`
 	Vhost  []*HttpVhostCfg `yaml:"vhost,omitempty" json:"vhost,omitempty"`
 }
 
 func (c *HttpCfg) CheckValid() error {
+	for _, l := range c.Listen {
+		if err := l.CheckValid(); err != nil {
+			return err
+		}
+		if l.Plaintext != "" {
+			return errors.New("plaintext is only supported for https listen")
+		}
+	}
+
 	for _, h := range c.Vhost {
 		if err := h.CheckValid(); err != nil {
 			return err
@@ -110,11 +437,23 @@ func (c *HttpCfg) CheckValid() error {
 }
 
 type HttpsCfg struct {
-	Listen []string         `yaml:"listen" json:"listen"`
+	Listen []*ListenCfg     `yaml:"listen" json:"listen"`
 	Vhost  []*HttpsVhostCfg `yaml:"vhost,omitempty" json:"vhost,omitempty"`
+	// Passthrough 匹配的sni不在本地卸载TLS，原样转发给持有证书的后端
+	Passthrough []*StreamSniCfg `yaml:"passthrough,omitempty" json:"passthrough,omitempty"`
+	// TLS 全局的TLS策略，vhost中的配置优先
+	TLS *TLSCfg `yaml:"tls,omitempty" json:"tls,omitempty"`
+
+	DefaultCertCfg `yaml:",inline"`
 }
 
 func (c *HttpsCfg) CheckValid() error {
+	for _, l := range c.Listen {
+		if err := l.CheckValid(); err != nil {
+			return err
+		}
+	}
+
 	for _, h := range c.Vhost {
 		if err := h.CheckValid(); err != nil {
 			return err
@@ -125,15 +464,52 @@ func (c *HttpsCfg) CheckValid() error {
 		return errors.New("duplicate domain found in https vhost config")
 	}
 
+	for _, p := range c.Passthrough {
+		if err := p.CheckValid(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.DefaultCertCfg.CheckValid(); err != nil {
+		return err
+	}
+
+	domains := make([]string, 0)
+	for _, h := range c.Vhost {
+		domains = append(domains, h.Domain)
+	}
+	for _, p := range c.Passthrough {
+		domains = append(domains, p.Domain)
+	}
+	if !bslice.Unique(domains, func(d string) string { return d }) {
+		return errors.New("duplicate domain found in https vhost/passthrough config")
+	}
+
+	if c.TLS != nil {
+		return c.TLS.CheckValid()
+	}
 	return nil
 }
 
 type Http3Cfg struct {
-	Listen []string         `yaml:"listen" json:"listen"`
-	Vhost  []*Http3VhostCfg `yaml:"vhost,omitempty" json:"vhost,omitempty"`
+	Listen []*Http3ListenCfg `yaml:"listen" json:"listen"`
+	Vhost  []*Http3VhostCfg  `yaml:"vhost,omitempty" json:"vhost,omitempty"`
+	// AltSvcMaxAge 同时配置了https vhost的域名通过Alt-Svc通告http3的有效期，单位秒，
+	// 为0时默认86400，小于0时不通告
+	AltSvcMaxAge int `yaml:"alt_svc_max_age,omitempty" json:"alt_svc_max_age,omitempty"`
+	// TLS 全局的TLS策略，vhost中的配置优先
+	TLS *TLSCfg `yaml:"tls,omitempty" json:"tls,omitempty"`
+
+	DefaultCertCfg `yaml:",inline"`
 }
 
 func (c *Http3Cfg) CheckValid() error {
+	for _, l := range c.Listen {
+		if err := l.CheckValid(); err != nil {
+			return err
+		}
+	}
+
 	for _, h := range c.Vhost {
 		if err := h.CheckValid(); err != nil {
 			return err
@@ -144,132 +520,614 @@ func (c *Http3Cfg) CheckValid() error {
 		return errors.New("duplicate domain found in http3 vhost config")
 	}
 
+	if err := c.DefaultCertCfg.CheckValid(); err != nil {
+		return err
+	}
+
+	if c.TLS != nil {
+		return c.TLS.CheckValidForQUIC()
+	}
 	return nil
 }
 
-type HttpVhostCfg struct {
-	VhostCfg `yaml:",inline"`
+// EarlyDataEnabled 有vhost开启了0-RTT时才在监听端口上接受早期数据
+func (c *Http3Cfg) EarlyDataEnabled() bool {
+	return slices.ContainsFunc(c.Vhost, func(v *Http3VhostCfg) bool { return v.EarlyData })
 }
 
-type HttpsVhostCfg struct {
-	VhostCfg `yaml:",inline"`
-	Cert     string `yaml:"cert" json:"cert"`
+func (c *Http3Cfg) GetAltSvcMaxAge() int {
+	if c.AltSvcMaxAge == 0 {
+		return 86400
+	}
+	return c.AltSvcMaxAge
 }
 
-func (c *HttpsVhostCfg) CheckValid() error {
-	if err := c.VhostCfg.CheckValid(); err != nil {
-		return err
-	}
+// Http3ListenCfg http3监听地址和QUIC传输参数，参数为空时使用quic-go的默认值
+type Http3ListenCfg struct {
+	Addr string `yaml:"addr" json:"addr"`
+	// MaxIdleTimeout 连接空闲超时时间，例如30s，默认30s
+	MaxIdleTimeout string `yaml:"max_idle_timeout,omitempty" json:"max_idle_timeout,omitempty"`
+	// KeepAlivePeriod 发送keep-alive的间隔，例如15s，为空时不发送，需要小于max_idle_timeout
+	KeepAlivePeriod string `yaml:"keep_alive_period,omitempty" json:"keep_alive_period,omitempty"`
+	// MaxIncomingStreams 每个连接上客户端可以同时发起的请求数，默认100
+	MaxIncomingStreams int64 `yaml:"max_incoming_streams,omitempty" json:"max_incoming_streams,omitempty"`
+	// InitialStreamWindow 单个请求的初始流量控制窗口，单位字节，默认512KB，
+	// 随传输速度自动增大到max_stream_window，默认6MB
+	InitialStreamWindow uint64 `yaml:"initial_stream_window,omitempty" json:"initial_stream_window,omitempty"`
+	MaxStreamWindow     uint64 `yaml:"max_stream_window,omitempty" json:"max_stream_window,omitempty"`
+	// InitialConnectionWindow 整个连接的初始流量控制窗口，单位字节，默认512KB，
+	// 随传输速度自动增大到max_connection_window，默认15MB
+	InitialConnectionWindow uint64 `yaml:"initial_connection_window,omitempty" json:"initial_connection_window,omitempty"`
+	MaxConnectionWindow     uint64 `yaml:"max_connection_window,omitempty" json:"max_connection_window,omitempty"`
+	// DisablePathMTUDiscovery 关闭路径MTU探测，固定使用1200字节的数据包
+	DisablePathMTUDiscovery bool `yaml:"disable_path_mtu_discovery,omitempty" json:"disable_path_mtu_discovery,omitempty"`
+	// Retry 客户端地址校验策略，always为每个新连接先发送Retry确认客户端地址，
+	// 可以防止伪造源地址的放大攻击，但握手多一个往返，never为不校验，默认never
+	Retry string `yaml:"retry,omitempty" json:"retry,omitempty"`
+}
 
-	if utils.ExistEmptyString(true, c.Cert) {
-		return errors.New("cert required for vhost config")
-	}
+type rawHttp3ListenCfg Http3ListenCfg
 
-	return nil
+// 没有额外选项的监听地址可以直接写成字符串，兼容旧的配置格式
+func (c *Http3ListenCfg) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&c.Addr)
+	}
+	return node.Decode((*rawHttp3ListenCfg)(c))
 }
 
-type Http3VhostCfg struct {
-	VhostCfg `yaml:",inline"`
-	Cert     string `yaml:"cert" json:"cert"`
+func (c Http3ListenCfg) MarshalYAML() (any, error) {
+	if c.isPlain() {
+		return c.Addr, nil
+	}
+	return (rawHttp3ListenCfg)(c), nil
 }
 
-func (c *Http3VhostCfg) CheckValid() error {
-	if err := c.VhostCfg.CheckValid(); err != nil {
-		return err
+func (c *Http3ListenCfg) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &c.Addr)
 	}
+	return json.Unmarshal(data, (*rawHttp3ListenCfg)(c))
+}
 
-	if utils.ExistEmptyString(true, c.Cert) {
-		return errors.New("cert required for vhost config")
+func (c Http3ListenCfg) MarshalJSON() ([]byte, error) {
+	if c.isPlain() {
+		return json.Marshal(c.Addr)
 	}
+	return json.Marshal((rawHttp3ListenCfg)(c))
+}
 
-	return nil
+func (c *Http3ListenCfg) isPlain() bool {
+	return *c == Http3ListenCfg{Addr: c.Addr}
 }
 
-type VhostCfg struct {
-	Name    string        `yaml:"name" json:"name"`
-	Domain  string        `yaml:"domain" json:"domain"`
-	Mapping []*MappingCfg `yaml:"mapping" json:"mapping"`
+func (c *Http3ListenCfg) Equal(o *Http3ListenCfg) bool {
+	return *c == *o
 }
 
-func (c *VhostCfg) CheckValid() error {
-	if utils.ExistEmptyString(true, c.Domain) {
-		return errors.New("domain required for vhost config")
+func (c *Http3ListenCfg) CheckValid() error {
+	if utils.ExistEmptyString(true, c.Addr) {
+		return errors.New("addr required for http3 listen config")
 	}
 
-	if len(c.Mapping) == 0 {
-		return errors.New("mapping required for vhost config")
+	idle, err := c.GetMaxIdleTimeout()
+	if err != nil {
+		return err
 	}
-
-	for _, m := range c.Mapping {
-		if err := m.CheckValid(); err != nil {
-			return err
-		}
+	keepAlive, err := c.GetKeepAlivePeriod()
+	if err != nil {
+		return err
+	}
+	if keepAlive > 0 && idle > 0 && keepAlive >= idle {
+		return errors.New("http3 listen keep_alive_period should be less than max_idle_timeout")
 	}
 
-	if !bslice.Unique(c.Mapping, func(c *MappingCfg) string { return c.Path }) {
-		return errors.New("duplicate mapping path in vhost config")
+	if c.MaxIncomingStreams < 0 {
+		return errors.New("http3 listen max_incoming_streams should not be negative")
+	}
+	if c.InitialStreamWindow > 0 && c.MaxStreamWindow > 0 && c.InitialStreamWindow > c.MaxStreamWindow {
+		return errors.New("http3 listen initial_stream_window should not be greater than max_stream_window")
+	}
+	if c.InitialConnectionWindow > 0 && c.MaxConnectionWindow > 0 && c.InitialConnectionWindow > c.MaxConnectionWindow {
+		return errors.New("http3 listen initial_connection_window should not be greater than max_connection_window")
 	}
 
+	if _, err := c.GetRetry(); err != nil {
+		return err
+	}
 	return nil
 }
 
-type MappingCfg struct {
-	Path        string   `yaml:"path" json:"path"`
-	Target      string   `yaml:"target" json:"target"`
-	AddHeader   []string `yaml:"add_header" json:"add_header"`
-	BasicAuth   []string `yaml:"basic_auth" json:"basic_auth"`
-	ProxyHeader bool     `yaml:"proxy_header" json:"proxy_header"`
-	Redirect    bool     `yaml:"redirect" json:"redirect"`
+func (c *Http3ListenCfg) GetMaxIdleTimeout() (time.Duration, error) {
+	return parseQUICDuration("max_idle_timeout", c.MaxIdleTimeout)
 }
 
-func (c *MappingCfg) CheckValid() error {
-	if utils.ExistEmptyString(true, c.Path) {
-		return errors.New("path required for vhost mapping config")
-	}
+func (c *Http3ListenCfg) GetKeepAlivePeriod() (time.Duration, error) {
+	return parseQUICDuration("keep_alive_period", c.KeepAlivePeriod)
+}
 
-	_, err := c.GetTarget()
-	if err != nil {
-		return err
+func (c *Http3ListenCfg) GetRetry() (string, error) {
+	switch c.Retry {
+	case "":
+		return "never", nil
+	case "always", "never":
+		return c.Retry, nil
 	}
+	return "", errors.New("malform http3 listen retry, should be always or never")
+}
 
-	_, err = c.GetAddHeader()
+func parseQUICDuration(name, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("malform http3 listen %v: %w", name, err)
 	}
+	if d <= 0 {
+		return 0, fmt.Errorf("http3 listen %v must be positive", name)
+	}
+	return d, nil
+}
 
-	_, err = c.GetBasicAuthEncoded()
-	return err
+type DefaultCertCfg struct {
+	// DefaultCert 客户端没有发送sni或sni没有对应证书时使用的证书
+	DefaultCert string `yaml:"default_cert,omitempty" json:"default_cert,omitempty"`
+	// UnknownSni 没有对应证书时的处理方式，可选default/self_signed/reject，为空时为default，
+	// 没有配置default_cert时使用第一个vhost的证书，与之前的版本保持一致，reject需要显式配置
+	UnknownSni string `yaml:"unknown_sni,omitempty" json:"unknown_sni,omitempty"`
 }
 
-func (c *MappingCfg) GetTarget() (*url.URL, error) {
-	u, err := url.ParseRequestURI(c.Target)
-	if err != nil {
-		return nil, err
+func (c *DefaultCertCfg) CheckValid() error {
+	if _, err := c.GetUnknownSni(); err != nil {
+		return err
 	}
-	if utils.ExistEmptyString(false, u.Scheme, u.Host) {
-		return nil, errors.New("malform target, missing scheme or host")
+	if c.UnknownSni == "default" && c.DefaultCert == "" {
+		return errors.New("default_cert required when unknown_sni is default")
 	}
-	return u, nil
+	return nil
 }
 
-func (c *MappingCfg) GetAddHeader() (http.Header, error) {
-	header := make(http.Header)
-	for _, h := range c.AddHeader {
-		items := strings.SplitN(h, ":", 2)
-		if len(items) != 2 {
-			return nil, errors.New("malform add_header")
-		}
-		k := strings.TrimSpace(items[0])
-		v := strings.TrimSpace(items[1])
-		if k == "" {
-			return nil, errors.New("malform add_header")
-		}
-		header.Add(k, v)
+func (c *DefaultCertCfg) GetUnknownSni() (string, error) {
+	switch c.UnknownSni {
+	case "":
+		return "default", nil
+	case "default", "self_signed", "reject":
+		return c.UnknownSni, nil
 	}
-	return header, nil
+	return "", errors.New("malform unknown_sni, should be default, self_signed or reject")
 }
 
-func (c *MappingCfg) GetBasicAuthEncoded() (*bset.SetString, error) {
+type HttpVhostCfg struct {
+	VhostCfg `yaml:",inline"`
+}
+
+func (c *HttpVhostCfg) CheckValid() error {
+	if err := c.VhostCfg.CheckValid(); err != nil {
+		return err
+	}
+	if err := c.checkNoConnectUdp(); err != nil {
+		return err
+	}
+	// 明文http没有开启h2c，不会收到extended CONNECT请求
+	for _, m := range c.Mapping {
+		if m.WebSocket != nil {
+			return errors.New("websocket is only supported in https and http3 vhost")
+		}
+	}
+	return nil
+}
+
+type HttpsVhostCfg struct {
+	VhostCfg `yaml:",inline"`
+	Cert     string `yaml:"cert" json:"cert"`
+	// Certs 额外的证书，例如同时配置RSA和ECDSA证书，握手时按客户端支持的算法选择
+	Certs      []string       `yaml:"certs,omitempty" json:"certs,omitempty"`
+	ClientAuth *ClientAuthCfg `yaml:"client_auth,omitempty" json:"client_auth,omitempty"`
+	TLS        *TLSCfg        `yaml:"tls,omitempty" json:"tls,omitempty"`
+}
+
+func (c *HttpsVhostCfg) CheckValid() error {
+	if err := c.VhostCfg.CheckValid(); err != nil {
+		return err
+	}
+	if err := c.checkNoConnectUdp(); err != nil {
+		return err
+	}
+
+	if utils.ExistEmptyString(true, c.Cert) || utils.ExistEmptyString(true, c.Certs...) {
+		return errors.New("cert required for vhost config")
+	}
+
+	if c.ClientAuth != nil {
+		if err := c.ClientAuth.CheckValid(); err != nil {
+			return err
+		}
+	}
+
+	if c.TLS != nil {
+		return c.TLS.CheckValid()
+	}
+	return nil
+}
+
+// GetCerts 返回vhost使用的所有证书名称，cert排在最前面
+func (c *HttpsVhostCfg) GetCerts() []string {
+	return vhostCerts(c.Cert, c.Certs)
+}
+
+type Http3VhostCfg struct {
+	VhostCfg `yaml:",inline"`
+	Cert     string `yaml:"cert" json:"cert"`
+	// Certs 额外的证书，例如同时配置RSA和ECDSA证书，握手时按客户端支持的算法选择
+	Certs      []string       `yaml:"certs,omitempty" json:"certs,omitempty"`
+	ClientAuth *ClientAuthCfg `yaml:"client_auth,omitempty" json:"client_auth,omitempty"`
+	TLS        *TLSCfg        `yaml:"tls,omitempty" json:"tls,omitempty"`
+	// EarlyData 接受0-RTT早期数据中的幂等请求，转发时带上Early-Data: 1，
+	// 非幂等请求和没有开启的vhost返回425，客户端会在握手完成后重试
+	EarlyData bool `yaml:"early_data,omitempty" json:"early_data,omitempty"`
+}
+
+func (c *Http3VhostCfg) CheckValid() error {
+	if err := c.VhostCfg.CheckValid(); err != nil {
+		return err
+	}
+
+	if utils.ExistEmptyString(true, c.Cert) || utils.ExistEmptyString(true, c.Certs...) {
+		return errors.New("cert required for vhost config")
+	}
+
+	if c.ClientAuth != nil {
+		if err := c.ClientAuth.CheckValid(); err != nil {
+			return err
+		}
+	}
+
+	if c.TLS != nil {
+		return c.TLS.CheckValidForQUIC()
+	}
+	return nil
+}
+
+func (c *Http3VhostCfg) GetCerts() []string {
+	return vhostCerts(c.Cert, c.Certs)
+}
+
+func vhostCerts(cert string, certs []string) []string {
+	names := []string{cert}
+	for _, name := range certs {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+type ClientAuthCfg struct {
+	// Mode 可选none/optional/require
+	Mode string `yaml:"mode" json:"mode"`
+	// CA 用于校验客户端证书的CA证书，PEM格式，可以包含多个
+	CA string `yaml:"ca" json:"ca"`
+	// CRL 证书吊销列表，PEM格式，可以包含多个
+	CRL string `yaml:"crl,omitempty" json:"crl,omitempty"`
+}
+
+func (c *ClientAuthCfg) CheckValid() error {
+	mode, err := c.GetClientAuthType()
+	if err != nil {
+		return err
+	}
+	if mode == tls.NoClientCert {
+		return nil
+	}
+
+	if _, err := c.GetCAPool(); err != nil {
+		return err
+	}
+
+	_, err = c.GetCRL()
+	return err
+}
+
+func (c *ClientAuthCfg) GetClientAuthType() (tls.ClientAuthType, error) {
+	switch c.Mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, errors.New("malform client_auth mode, should be none, optional or require")
+}
+
+func (c *ClientAuthCfg) GetCAPool() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(c.CA)) {
+		return nil, errors.New("no ca certificate found for client_auth")
+	}
+	return pool, nil
+}
+
+func (c *ClientAuthCfg) GetCRL() ([]*x509.RevocationList, error) {
+	crls, err := utils.ParseCRL([]byte(c.CRL))
+	if err != nil {
+		return nil, fmt.Errorf("malform client_auth crl: %w", err)
+	}
+	return crls, nil
+}
+
+type TLSCfg struct {
+	MinVersion   string   `yaml:"min_version,omitempty" json:"min_version,omitempty"`
+	MaxVersion   string   `yaml:"max_version,omitempty" json:"max_version,omitempty"`
+	CipherSuites []string `yaml:"cipher_suites,omitempty" json:"cipher_suites,omitempty"`
+	Curves       []string `yaml:"curves,omitempty" json:"curves,omitempty"`
+	// ALPN 可选h2、http/1.1，默认两者都开启
+	ALPN []string `yaml:"alpn,omitempty" json:"alpn,omitempty"`
+	// SessionTicket 是否开启session ticket，默认开启
+	SessionTicket *bool `yaml:"session_ticket,omitempty" json:"session_ticket,omitempty"`
+	// SessionTicketRotation session ticket密钥的轮换周期，为空时不主动轮换
+	SessionTicketRotation string `yaml:"session_ticket_rotation,omitempty" json:"session_ticket_rotation,omitempty"`
+}
+
+func (c *TLSCfg) CheckValid() error {
+	minVersion, maxVersion, err := c.GetVersion()
+	if err != nil {
+		return err
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		return errors.New("tls min_version is greater than max_version")
+	}
+
+	if _, err := c.GetCipherSuites(); err != nil {
+		return err
+	}
+	if _, err := c.GetCurves(); err != nil {
+		return err
+	}
+
+	for _, proto := range c.ALPN {
+		if proto != "h2" && proto != "http/1.1" {
+			return errors.New("malform tls alpn, should be h2 or http/1.1")
+		}
+	}
+	if !bslice.Unique(c.ALPN, func(p string) string { return p }) {
+		return errors.New("duplicate tls alpn")
+	}
+
+	_, err = c.GetSessionTicketRotation()
+	return err
+}
+
+// CheckValidForQUIC QUIC固定使用TLS1.3和h3，不允许配置版本、加密套件和ALPN
+func (c *TLSCfg) CheckValidForQUIC() error {
+	if err := c.CheckValid(); err != nil {
+		return err
+	}
+	if (c.MinVersion != "" && c.MinVersion != "1.3") || (c.MaxVersion != "" && c.MaxVersion != "1.3") {
+		return errors.New("http3 only supports tls 1.3")
+	}
+	if len(c.CipherSuites) > 0 {
+		return errors.New("tls cipher_suites is not supported for http3")
+	}
+	if len(c.ALPN) > 0 {
+		return errors.New("tls alpn is not supported for http3")
+	}
+	return nil
+}
+
+// Merge 用o中配置了的字段覆盖c，返回新的配置
+func (c *TLSCfg) Merge(o *TLSCfg) *TLSCfg {
+	merged := &TLSCfg{}
+	if c != nil {
+		*merged = *c
+	}
+	if o == nil {
+		return merged
+	}
+
+	if o.MinVersion != "" {
+		merged.MinVersion = o.MinVersion
+	}
+	if o.MaxVersion != "" {
+		merged.MaxVersion = o.MaxVersion
+	}
+	if len(o.CipherSuites) > 0 {
+		merged.CipherSuites = o.CipherSuites
+	}
+	if len(o.Curves) > 0 {
+		merged.Curves = o.Curves
+	}
+	if len(o.ALPN) > 0 {
+		merged.ALPN = o.ALPN
+	}
+	if o.SessionTicket != nil {
+		merged.SessionTicket = o.SessionTicket
+	}
+	if o.SessionTicketRotation != "" {
+		merged.SessionTicketRotation = o.SessionTicketRotation
+	}
+	return merged
+}
+
+func (c *TLSCfg) GetVersion() (uint16, uint16, error) {
+	minVersion, err := utils.ParseTLSVersion(c.MinVersion)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malform tls min_version: %w", err)
+	}
+	maxVersion, err := utils.ParseTLSVersion(c.MaxVersion)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malform tls max_version: %w", err)
+	}
+	return minVersion, maxVersion, nil
+}
+
+func (c *TLSCfg) GetCipherSuites() ([]uint16, error) {
+	if len(c.CipherSuites) == 0 {
+		return nil, nil
+	}
+	return utils.ParseCipherSuites(c.CipherSuites)
+}
+
+func (c *TLSCfg) GetCurves() ([]tls.CurveID, error) {
+	if len(c.Curves) == 0 {
+		return nil, nil
+	}
+	return utils.ParseCurves(c.Curves)
+}
+
+func (c *TLSCfg) SessionTicketEnabled() bool {
+	return c.SessionTicket == nil || *c.SessionTicket
+}
+
+func (c *TLSCfg) GetSessionTicketRotation() (time.Duration, error) {
+	if c.SessionTicketRotation == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.SessionTicketRotation)
+	if err != nil {
+		return 0, fmt.Errorf("malform tls session_ticket_rotation: %w", err)
+	}
+	if d <= 0 {
+		return 0, errors.New("tls session_ticket_rotation must be positive")
+	}
+	return d, nil
+}
+
+type VhostCfg struct {
+	Name    string        `yaml:"name" json:"name"`
+	Domain  string        `yaml:"domain" json:"domain"`
+	Mapping []*MappingCfg `yaml:"mapping" json:"mapping"`
+}
+
+func (c *VhostCfg) CheckValid() error {
+	if utils.ExistEmptyString(true, c.Domain) {
+		return errors.New("domain required for vhost config")
+	}
+
+	if len(c.Mapping) == 0 {
+		return errors.New("mapping required for vhost config")
+	}
+
+	for _, m := range c.Mapping {
+		if err := m.CheckValid(); err != nil {
+			return err
+		}
+	}
+
+	if !bslice.Unique(c.Mapping, func(c *MappingCfg) string { return c.Path }) {
+		return errors.New("duplicate mapping path in vhost config")
+	}
+
+	return nil
+}
+
+// checkNoConnectUdp CONNECT-UDP依赖http3的datagram，只能用于http3 vhost
+func (c *VhostCfg) checkNoConnectUdp() error {
+	for _, m := range c.Mapping {
+		if m.ConnectUdp != nil {
+			return errors.New("connect_udp is only supported in http3 vhost")
+		}
+	}
+	return nil
+}
+
+type MappingCfg struct {
+	Path        string   `yaml:"path" json:"path"`
+	Target      string   `yaml:"target" json:"target"`
+	AddHeader   []string `yaml:"add_header" json:"add_header"`
+	BasicAuth   []string `yaml:"basic_auth" json:"basic_auth"`
+	ProxyHeader bool     `yaml:"proxy_header" json:"proxy_header"`
+	Redirect    bool     `yaml:"redirect" json:"redirect"`
+
+	// ProxyProtocol 向上游建立连接时发送的PROXY protocol版本，可选v1/v2，为空则不发送
+	ProxyProtocol string `yaml:"proxy_protocol,omitempty" json:"proxy_protocol,omitempty"`
+	// UpstreamTLS 连接https/http3上游时的TLS策略，为空时使用系统根证书校验
+	UpstreamTLS *UpstreamTLSCfg `yaml:"upstream_tls,omitempty" json:"upstream_tls,omitempty"`
+	// ConnectUdp 不转发给target，作为CONNECT-UDP代理，只能用于http3 vhost
+	ConnectUdp *ConnectUdpCfg `yaml:"connect_udp,omitempty" json:"connect_udp,omitempty"`
+	// WebSocket http2/http3 extended CONNECT转发websocket时的限制
+	WebSocket *WebSocketCfg `yaml:"websocket,omitempty" json:"websocket,omitempty"`
+}
+
+func (c *MappingCfg) CheckValid() error {
+	if utils.ExistEmptyString(true, c.Path) {
+		return errors.New("path required for vhost mapping config")
+	}
+
+	if c.ConnectUdp != nil {
+		if c.Target != "" || c.Redirect {
+			return errors.New("target and redirect are not supported for connect_udp mapping")
+		}
+		if err := c.ConnectUdp.CheckValid(); err != nil {
+			return err
+		}
+	} else if _, err := c.GetTarget(); err != nil {
+		return err
+	}
+
+	if c.WebSocket != nil {
+		if c.ConnectUdp != nil {
+			return errors.New("websocket is not supported for connect_udp mapping")
+		}
+		if err := c.WebSocket.CheckValid(); err != nil {
+			return err
+		}
+	}
+
+	_, err := c.GetAddHeader()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.GetBasicAuthEncoded()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.GetProxyProtocolVersion()
+	if err != nil {
+		return err
+	}
+
+	if c.UpstreamTLS != nil {
+		return c.UpstreamTLS.CheckValid()
+	}
+	return nil
+}
+
+func (c *MappingCfg) GetTarget() (*url.URL, error) {
+	u, err := url.ParseRequestURI(c.Target)
+	if err != nil {
+		return nil, err
+	}
+	if utils.ExistEmptyString(false, u.Scheme, u.Host) {
+		return nil, errors.New("malform target, missing scheme or host")
+	}
+	if u.Scheme == "http3" && c.ProxyProtocol != "" {
+		return nil, errors.New("proxy_protocol is not supported for http3 target")
+	}
+	return u, nil
+}
+
+func (c *MappingCfg) GetAddHeader() (http.Header, error) {
+	header := make(http.Header)
+	for _, h := range c.AddHeader {
+		items := strings.SplitN(h, ":", 2)
+		if len(items) != 2 {
+			return nil, errors.New("malform add_header")
+		}
+		k := strings.TrimSpace(items[0])
+		v := strings.TrimSpace(items[1])
+		if k == "" {
+			return nil, errors.New("malform add_header")
+		}
+		header.Add(k, v)
+	}
+	return header, nil
+}
+
+func (c *MappingCfg) GetBasicAuthEncoded() (*bset.SetString, error) {
 	set := bset.New[string]()
 	for _, auth := range c.BasicAuth {
 		auth = base64.StdEncoding.EncodeToString([]byte(auth))
@@ -281,30 +1139,422 @@ func (c *MappingCfg) GetBasicAuthEncoded() (*bset.SetString, error) {
 	return set, nil
 }
 
+func (c *MappingCfg) GetProxyProtocolVersion() (int, error) {
+	switch c.ProxyProtocol {
+	case "":
+		return 0, nil
+	case "v1":
+		return 1, nil
+	case "v2":
+		return 2, nil
+	}
+	return 0, errors.New("malform proxy_protocol, should be v1 or v2")
+}
+
+// ConnectUdpCfg RFC 9298 CONNECT-UDP代理，mapping的path为URI模板中{target_host}之前的部分，
+// 例如/.well-known/masque/udp/，客户端使用mapping的basic_auth认证
+type ConnectUdpCfg struct {
+	// Allow 允许访问的目标，格式为host:port，host可以是域名、*.域名、IP、CIDR或*，
+	// port可以是端口、端口范围1000-2000或*，ipv6地址和网段需要放在方括号中，
+	// 回环、私有、链路本地、组播和运营商级NAT等内部地址（包括NAT64、6to4中内嵌的）只能由包含它的IP或CIDR规则允许，域名和*都不能访问
+	Allow []string `yaml:"allow" json:"allow"`
+	// IdleTimeout 两个方向都没有数据时关闭，默认60s
+	IdleTimeout string `yaml:"idle_timeout,omitempty" json:"idle_timeout,omitempty"`
+}
+
+func (c *ConnectUdpCfg) CheckValid() error {
+	if len(c.Allow) == 0 {
+		return errors.New("allow required for connect_udp config")
+	}
+	if _, err := c.GetAllow(); err != nil {
+		return err
+	}
+	_, err := c.GetIdleTimeout()
+	return err
+}
+
+func (c *ConnectUdpCfg) GetAllow() ([]*utils.TargetRule, error) {
+	rules, err := utils.ParseTargetRules(c.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("malform connect_udp allow: %w", err)
+	}
+	return rules, nil
+}
+
+func (c *ConnectUdpCfg) GetIdleTimeout() (time.Duration, error) {
+	if c.IdleTimeout == "" {
+		return 60 * time.Second, nil
+	}
+	d, err := time.ParseDuration(c.IdleTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("malform connect_udp idle_timeout: %w", err)
+	}
+	if d <= 0 {
+		return 0, errors.New("malform connect_udp idle_timeout, should be positive")
+	}
+	return d, nil
+}
+
+// WebSocketCfg 只对http2/http3 extended CONNECT的websocket生效，HTTP/1.1的Upgrade请求原样转发
+type WebSocketCfg struct {
+	// IdleTimeout 两个方向都没有数据帧时关闭，如5m，为空时不限制
+	IdleTimeout string `yaml:"idle_timeout,omitempty" json:"idle_timeout,omitempty"`
+	// MaxFrameSize 单个帧负载的最大字节数，超过时以1009关闭，为0时不限制
+	MaxFrameSize int64 `yaml:"max_frame_size,omitempty" json:"max_frame_size,omitempty"`
+}
+
+func (c *WebSocketCfg) CheckValid() error {
+	if _, err := c.GetIdleTimeout(); err != nil {
+		return err
+	}
+	if c.MaxFrameSize < 0 {
+		return errors.New("malform websocket max_frame_size, should not be negative")
+	}
+	return nil
+}
+
+func (c *WebSocketCfg) GetIdleTimeout() (time.Duration, error) {
+	if c.IdleTimeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.IdleTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("malform websocket idle_timeout: %w", err)
+	}
+	if d <= 0 {
+		return 0, errors.New("malform websocket idle_timeout, should be positive")
+	}
+	return d, nil
+}
+
+type StreamCfg struct {
+	Name string `yaml:"name" json:"name"`
+	// Network 可选tcp/udp，默认为tcp
+	Network string       `yaml:"network,omitempty" json:"network,omitempty"`
+	Listen  []*ListenCfg `yaml:"listen" json:"listen"`
+	// Target 默认转发目标，没有匹配到sni规则时使用
+	Target string `yaml:"target,omitempty" json:"target,omitempty"`
+	// Cert 不为空时使用证书库中的证书卸载TLS，否则TLS连接原样透传
+	Cert string          `yaml:"cert,omitempty" json:"cert,omitempty"`
+	Sni  []*StreamSniCfg `yaml:"sni,omitempty" json:"sni,omitempty"`
+
+	// IdleTimeout udp会话的空闲超时时间，如30s、5m，默认60s
+	IdleTimeout string `yaml:"idle_timeout,omitempty" json:"idle_timeout,omitempty"`
+	// BufferSize udp报文的缓冲区大小，默认65535
+	BufferSize int `yaml:"buffer_size,omitempty" json:"buffer_size,omitempty"`
+	// MaxSessions 每个监听地址最多同时存在的udp会话数，达到后丢弃新客户端的报文，默认1024
+	MaxSessions int `yaml:"max_sessions,omitempty" json:"max_sessions,omitempty"`
+}
+
+func (c *StreamCfg) GetNetwork() string {
+	if c.Network == "" {
+		return "tcp"
+	}
+	return c.Network
+}
+
+func (c *StreamCfg) GetIdleTimeout() (time.Duration, error) {
+	if c.IdleTimeout == "" {
+		return 60 * time.Second, nil
+	}
+	d, err := time.ParseDuration(c.IdleTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("malform stream idle_timeout: %w", err)
+	}
+	if d <= 0 {
+		return 0, errors.New("malform stream idle_timeout, should be positive")
+	}
+	return d, nil
+}
+
+func (c *StreamCfg) GetBufferSize() int {
+	if c.BufferSize <= 0 {
+		return 65535
+	}
+	return c.BufferSize
+}
+
+func (c *StreamCfg) GetMaxSessions() int {
+	if c.MaxSessions <= 0 {
+		return 1024
+	}
+	return c.MaxSessions
+}
+
+func (c *StreamCfg) CheckValid() error {
+	if utils.ExistEmptyString(true, c.Name) {
+		return errors.New("name required for stream config")
+	}
+
+	if len(c.Listen) == 0 {
+		return errors.New("listen required for stream config")
+	}
+
+	for _, l := range c.Listen {
+		if err := l.CheckValid(); err != nil {
+			return err
+		}
+		if l.Plaintext != "" {
+			return errors.New("plaintext is only supported for https listen")
+		}
+	}
+
+	switch c.GetNetwork() {
+	case "tcp":
+	case "udp":
+		if c.Target == "" {
+			return errors.New("target required for udp stream config")
+		}
+		if c.Cert != "" || len(c.Sni) > 0 {
+			return errors.New("cert and sni are not supported for udp stream config")
+		}
+		for _, l := range c.Listen {
+			if l.ProxyProtocol != nil {
+				return errors.New("proxy_protocol is not supported for udp stream config")
+			}
+		}
+		if _, err := c.GetIdleTimeout(); err != nil {
+			return err
+		}
+		if c.BufferSize < 0 || c.BufferSize > 65535 {
+			return errors.New("malform stream buffer_size, should be in range 0-65535")
+		}
+		if c.MaxSessions < 0 {
+			return errors.New("malform stream max_sessions, should not be negative")
+		}
+	default:
+		return errors.New("malform stream network, should be tcp or udp")
+	}
+
+	if c.Target == "" && len(c.Sni) == 0 {
+		return errors.New("target or sni required for stream config")
+	}
+
+	if c.Target != "" {
+		if err := utils.CheckHostPort(c.Target); err != nil {
+			return fmt.Errorf("malform stream target: %w", err)
+		}
+	}
+
+	for _, sni := range c.Sni {
+		if err := sni.CheckValid(); err != nil {
+			return err
+		}
+	}
+
+	if !bslice.Unique(c.Sni, func(sni *StreamSniCfg) string { return sni.Domain }) {
+		return errors.New("duplicate domain found in stream sni config")
+	}
+
+	return nil
+}
+
+type StreamSniCfg struct {
+	// Domain 支持*.example.com形式的通配符
+	Domain string `yaml:"domain" json:"domain"`
+	Target string `yaml:"target" json:"target"`
+}
+
+func (c *StreamSniCfg) CheckValid() error {
+	if utils.ExistEmptyString(true, c.Domain, c.Target) {
+		return errors.New("domain or target required for stream sni config")
+	}
+
+	if err := utils.CheckHostPort(c.Target); err != nil {
+		return fmt.Errorf("malform stream sni target: %w", err)
+	}
+	return nil
+}
+
+type UpstreamTLSCfg struct {
+	// Verify 上游证书的校验方式，system使用系统根证书，ca使用CA字段中的证书，
+	// insecure不校验，默认为system
+	Verify string `yaml:"verify,omitempty" json:"verify,omitempty"`
+	CA     string `yaml:"ca,omitempty" json:"ca,omitempty"`
+	// ServerName 覆盖发送给上游的sni以及校验证书时使用的域名
+	ServerName string `yaml:"server_name,omitempty" json:"server_name,omitempty"`
+	MinVersion string `yaml:"min_version,omitempty" json:"min_version,omitempty"`
+	MaxVersion string `yaml:"max_version,omitempty" json:"max_version,omitempty"`
+	// Cert 证书库中的证书名称，用于向上游出示客户端证书
+	Cert string `yaml:"cert,omitempty" json:"cert,omitempty"`
+}
+
+func (c *UpstreamTLSCfg) CheckValid() error {
+	switch c.Verify {
+	case "", "system", "insecure":
+	case "ca":
+		if _, err := c.GetCAPool(); err != nil {
+			return err
+		}
+	default:
+		return errors.New("malform upstream_tls verify, should be system, ca or insecure")
+	}
+
+	minVersion, err := utils.ParseTLSVersion(c.MinVersion)
+	if err != nil {
+		return fmt.Errorf("malform upstream_tls min_version: %w", err)
+	}
+	maxVersion, err := utils.ParseTLSVersion(c.MaxVersion)
+	if err != nil {
+		return fmt.Errorf("malform upstream_tls max_version: %w", err)
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		return errors.New("upstream_tls min_version is greater than max_version")
+	}
+	return nil
+}
+
+func (c *UpstreamTLSCfg) GetCAPool() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(c.CA)) {
+		return nil, errors.New("no ca certificate found for upstream_tls")
+	}
+	return pool, nil
+}
+
 type CertCfg struct {
-	Name    string `yaml:"name" json:"name"`
-	Content string `yaml:"content" json:"content"`
+	Name string `yaml:"name" json:"name"`
+	// Content 证书链，PEM格式
+	Content string `yaml:"content,omitempty" json:"content,omitempty"`
+	// Key 私钥，配置了主密钥时加密保存，不会通过api返回
+	Key string `yaml:"key,omitempty" json:"-"`
+	// CertFile 从文件加载证书，文件变化时自动重新加载，与content二选一
+	CertFile string `yaml:"cert_file,omitempty" json:"cert_file,omitempty"`
+	// KeyFile 私钥文件，私钥和证书在同一个文件中时可以不填
+	KeyFile string `yaml:"key_file,omitempty" json:"key_file,omitempty"`
+	// KeyPassword 加密私钥或PKCS#12文件的密码，只用于从文件加载的证书
+	KeyPassword string `yaml:"key_password,omitempty" json:"-"`
+}
+
+// IsFile 证书是否从文件加载
+func (c *CertCfg) IsFile() bool {
+	return c.CertFile != ""
+}
+
+// Files 返回证书用到的所有文件
+func (c *CertCfg) Files() []string {
+	files := make([]string, 0, 2)
+	if c.CertFile != "" {
+		files = append(files, c.CertFile)
+	}
+	if c.KeyFile != "" {
+		files = append(files, c.KeyFile)
+	}
+	return files
+}
+
+// Seal 把content中的私钥拆分到key中，配置了主密钥时加密保存
+func (c *CertCfg) Seal() error {
+	if c.IsFile() {
+		var err error
+		c.KeyPassword, err = reseal(c.KeyPassword)
+		return err
+	}
+
+	chain, key := utils.SplitCertKey([]byte(c.Content))
+	if len(key) > 0 {
+		c.Content = string(chain)
+		if c.Key == "" {
+			c.Key = string(key)
+		}
+	}
+
+	var err error
+	if c.Key, err = reseal(c.Key); err != nil {
+		return err
+	}
+	return nil
+}
+
+func reseal(s string) (string, error) {
+	if s == "" || !utils.NeedReseal(s) {
+		return s, nil
+	}
+	plaintext, err := utils.Open(s)
+	if err != nil {
+		return "", err
+	}
+	return utils.Seal(plaintext)
 }
 
 func (c *CertCfg) Certificate() (*tls.Certificate, error) {
-	cert, err := utils.ParseCert([]byte(c.Content))
+	content, password, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := utils.ParseCert(content, password)
 	if err != nil {
 		return nil, err
 	}
 	if len(cert.Certificate) == 0 {
 		return nil, errors.New("no certificate found")
 	}
+	if cert.PrivateKey == nil {
+		return nil, errors.New("no private key found")
+	}
+	return cert, nil
+}
+
+// Warnings 检查证书链的顺序、有效期、中间证书，以及是否包含使用该证书的vhost域名，
+// 这些问题不影响保存配置
+func (c *CertCfg) Warnings(domains []string) []string {
+	content, password, err := c.load()
+	if err != nil {
+		return nil
+	}
+	cert, err := utils.ParseCert(content, password)
+	if err != nil || cert.Leaf == nil {
+		return nil
+	}
+
+	warnings := utils.ChainWarnings(cert, utils.SystemRoots())
+	if !utils.ChainOrdered(content, cert) {
+		warnings = append(warnings, "certificate chain is not in order, leaf certificate should be the first one followed by its issuers")
+	}
+	for _, domain := range domains {
+		if cert.Leaf.VerifyHostname(domain) != nil {
+			warnings = append(warnings, fmt.Sprintf("certificate does not cover domain %v", domain))
+		}
+	}
+	return warnings
+}
 
-	for i, der := range cert.Certificate {
-		x509Cert, err := x509.ParseCertificate(der)
+// load 读取证书和私钥的原始内容，以及私钥的密码
+func (c *CertCfg) load() ([]byte, string, error) {
+	content := []byte(c.Content)
+	if c.Key != "" {
+		key, err := utils.Open(c.Key)
 		if err != nil {
-			return nil, err
+			return nil, "", fmt.Errorf("unable to open private key of cert %v: %w", c.Name, err)
+		}
+		content = append(content, '\n')
+		content = append(content, key...)
+	}
+	var password string
+	if c.IsFile() {
+		content = make([]byte, 0)
+		for i, file := range c.Files() {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, "", err
+			}
+			// 单个PKCS#12文件是二进制格式，不能追加换行
+			if i > 0 {
+				content = append(content, '\n')
+			}
+			content = append(content, data...)
 		}
-		if i == 0 {
-			cert.Leaf = x509Cert
+
+		if c.KeyPassword != "" {
+			plaintext, err := utils.Open(c.KeyPassword)
+			if err != nil {
+				return nil, "", fmt.Errorf("unable to open key password of cert %v: %w", c.Name, err)
+			}
+			password = string(plaintext)
 		}
 	}
-	return cert, nil
+	return content, password, nil
 }
 
 func (c *CertCfg) CertInfo() (*CertInfo, error) {
@@ -312,12 +1562,18 @@ func (c *CertCfg) CertInfo() (*CertInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewCertInfo(cert), nil
+}
 
+func NewCertInfo(cert *tls.Certificate) *CertInfo {
 	info := &CertInfo{
 		Domain:     cert.Leaf.DNSNames,
 		Issuer:     cert.Leaf.Issuer.String(),
 		ValidStart: cert.Leaf.NotBefore.Local().Format(time.DateTime),
 		ValidStop:  cert.Leaf.NotAfter.Local().Format(time.DateTime),
+
+		NotAfter:      cert.Leaf.NotAfter,
+		DaysRemaining: DaysRemaining(cert.Leaf.NotAfter),
 	}
 
 	for _, ip := range cert.Leaf.IPAddresses {
@@ -327,13 +1583,240 @@ func (c *CertCfg) CertInfo() (*CertInfo, error) {
 	if info.Domain == nil {
 		info.Domain = []string{}
 	}
-	return info, nil
+	return info
 }
 
 func (c *CertCfg) CheckValid() error {
-	if utils.ExistEmptyString(true, c.Name, c.Content) {
-		return errors.New("name or content required for cert config")
+	if utils.ExistEmptyString(true, c.Name) {
+		return errors.New("name required for cert config")
+	}
+	if c.Name == InternalCert || strings.HasPrefix(c.Name, InternalCert+":") {
+		return fmt.Errorf("cert name %v is reserved", c.Name)
+	}
+	if utils.ExistEmptyString(true, c.Content) == utils.ExistEmptyString(true, c.CertFile) {
+		return errors.New("either content or cert_file required for cert config")
+	}
+	if c.KeyFile != "" && c.CertFile == "" {
+		return errors.New("key_file requires cert_file")
+	}
+	if c.Key != "" && c.CertFile != "" {
+		return errors.New("key can not be used with cert_file")
+	}
+	if c.KeyPassword != "" && c.CertFile == "" {
+		return errors.New("key_password requires cert_file")
 	}
 	_, err := c.Certificate()
 	return err
 }
+
+// InternalCert vhost的证书配置为该名称时，使用内置CA签发的证书
+const InternalCert = "internal"
+
+// InternalCertName 内置CA为vhost签发的证书在证书库中的名称
+func InternalCertName(domain string) string {
+	return InternalCert + ":" + domain
+}
+
+type CACfg struct {
+	// Content 根证书，PEM格式
+	Content string `yaml:"content" json:"content"`
+	// Key 根证书私钥，配置了主密钥时加密保存，不会通过api返回
+	Key string `yaml:"key,omitempty" json:"-"`
+	// Validity 签发证书的有效期，单位天，默认90天
+	Validity int `yaml:"validity,omitempty" json:"validity,omitempty"`
+	// RenewBefore 证书剩余有效期少于该天数时重新签发，默认30天
+	RenewBefore int `yaml:"renew_before,omitempty" json:"renew_before,omitempty"`
+}
+
+func (c *CACfg) GetValidity() time.Duration {
+	if c.Validity <= 0 {
+		return 90 * 24 * time.Hour
+	}
+	return time.Duration(c.Validity) * 24 * time.Hour
+}
+
+func (c *CACfg) GetRenewBefore() time.Duration {
+	if c.RenewBefore <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return time.Duration(c.RenewBefore) * 24 * time.Hour
+}
+
+// Seal 把content中的私钥拆分到key中，配置了主密钥时加密保存
+func (c *CACfg) Seal() error {
+	chain, key := utils.SplitCertKey([]byte(c.Content))
+	if len(key) > 0 {
+		c.Content = string(chain)
+		if c.Key == "" {
+			c.Key = string(key)
+		}
+	}
+
+	var err error
+	c.Key, err = reseal(c.Key)
+	return err
+}
+
+func (c *CACfg) Certificate() (*tls.Certificate, error) {
+	key, err := utils.Open(c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open private key of ca: %w", err)
+	}
+
+	cert, err := utils.ParseCert([]byte(c.Content+"\n"+string(key)), "")
+	if err != nil {
+		return nil, err
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no ca certificate found")
+	}
+	if cert.PrivateKey == nil {
+		return nil, errors.New("no ca private key found")
+	}
+	// 没有keyUsage扩展时不限制用途
+	if !cert.Leaf.IsCA || (cert.Leaf.KeyUsage != 0 && cert.Leaf.KeyUsage&x509.KeyUsageCertSign == 0) {
+		return nil, errors.New("certificate can not be used as ca")
+	}
+	return cert, nil
+}
+
+func (c *CACfg) CheckValid() error {
+	if utils.ExistEmptyString(true, c.Content) {
+		return errors.New("content required for ca config")
+	}
+	if c.Validity < 0 || c.RenewBefore < 0 {
+		return errors.New("invalid validity or renew_before of ca config")
+	}
+	if c.GetRenewBefore() >= c.GetValidity() {
+		return errors.New("renew_before must be less than validity")
+	}
+	_, err := c.Certificate()
+	return err
+}
+
+type CsrCfg struct {
+	// Name 签发后的证书名称，与已有证书同名时签发后替换该证书
+	Name    string `yaml:"name" json:"name"`
+	KeyType string `yaml:"key_type,omitempty" json:"key_type,omitempty"`
+	// Csr 证书签名请求，PEM格式
+	Csr string `yaml:"csr" json:"csr"`
+	// Key 私钥，配置了主密钥时加密保存，不会通过api返回
+	Key       string `yaml:"key" json:"-"`
+	CreatedAt string `yaml:"created_at,omitempty" json:"created_at,omitempty"`
+}
+
+func (c *CsrCfg) Seal() error {
+	var err error
+	c.Key, err = reseal(c.Key)
+	return err
+}
+
+func (c *CsrCfg) Request() (*x509.CertificateRequest, error) {
+	return utils.ParseCSR([]byte(c.Csr))
+}
+
+// Cert 使用签发的证书链和等待签发的私钥生成证书配置
+func (c *CsrCfg) Cert(chain string) *CertCfg {
+	return &CertCfg{Name: c.Name, Content: chain, Key: c.Key}
+}
+
+func (c *CsrCfg) CheckValid() error {
+	if utils.ExistEmptyString(true, c.Name, c.Csr, c.Key) {
+		return errors.New("name, csr and key required for csr config")
+	}
+
+	csr, err := c.Request()
+	if err != nil {
+		return fmt.Errorf("malform csr %v: %w", c.Name, err)
+	}
+
+	key, err := utils.Open(c.Key)
+	if err != nil {
+		return fmt.Errorf("unable to open private key of csr %v: %w", c.Name, err)
+	}
+	cert, err := utils.ParseCert(key, "")
+	if err != nil {
+		return err
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("no private key found for csr %v", c.Name)
+	}
+	pub, ok := csr.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(signer.Public()) {
+		return fmt.Errorf("private key does not match csr %v", c.Name)
+	}
+	return nil
+}
+
+type NotifyCfg struct {
+	// Thresholds 证书剩余有效期小于等于这些天数时提醒，默认30、14、7、1天
+	Thresholds []int `yaml:"thresholds,omitempty" json:"thresholds,omitempty"`
+	// Webhook 以POST方式发送JSON格式的通知
+	Webhook []string `yaml:"webhook,omitempty" json:"webhook,omitempty"`
+	Smtp    *SmtpCfg `yaml:"smtp,omitempty" json:"smtp,omitempty"`
+}
+
+// GetThresholds 返回从大到小排列的提醒天数
+func (c *NotifyCfg) GetThresholds() []int {
+	if c == nil || len(c.Thresholds) == 0 {
+		return []int{30, 14, 7, 1}
+	}
+	thresholds := slices.Clone(c.Thresholds)
+	slices.Sort(thresholds)
+	slices.Reverse(thresholds)
+	return slices.Compact(thresholds)
+}
+
+func (c *NotifyCfg) CheckValid() error {
+	for _, t := range c.Thresholds {
+		if t <= 0 {
+			return errors.New("notify thresholds must be positive")
+		}
+	}
+	for _, webhook := range c.Webhook {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("malform notify webhook %v", webhook)
+		}
+	}
+	if c.Smtp != nil {
+		return c.Smtp.CheckValid()
+	}
+	return nil
+}
+
+type SmtpCfg struct {
+	// Addr SMTP服务器地址，例如smtp.example.com:587，服务器支持时使用STARTTLS
+	Addr     string `yaml:"addr" json:"addr"`
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	// Password 配置了主密钥时加密保存，不会通过api返回
+	Password string   `yaml:"password,omitempty" json:"-"`
+	From     string   `yaml:"from" json:"from"`
+	To       []string `yaml:"to" json:"to"`
+}
+
+// Seal 配置了主密钥时加密保存密码
+func (c *SmtpCfg) Seal() error {
+	var err error
+	c.Password, err = reseal(c.Password)
+	return err
+}
+
+func (c *SmtpCfg) GetPassword() (string, error) {
+	password, err := utils.Open(c.Password)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt smtp password: %w", err)
+	}
+	return string(password), nil
+}
+
+func (c *SmtpCfg) CheckValid() error {
+	if utils.ExistEmptyString(true, c.Addr, c.From) || len(c.To) == 0 {
+		return errors.New("addr, from and to required for smtp config")
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return fmt.Errorf("malform smtp addr: %w", err)
+	}
+	return nil
+}
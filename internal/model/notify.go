@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+const (
+	EventCertExpiring = "cert_expiring"
+	EventCertExpired  = "cert_expired"
+	EventCertRevoked  = "cert_revoked"
+	// EventCertStapleMissing Must-Staple证书没有可用的OCSP响应，客户端会拒绝连接
+	EventCertStapleMissing = "cert_staple_missing"
+	// EventCertReloadFailed 证书文件变化后加载失败，继续使用原来的证书
+	EventCertReloadFailed = "cert_reload_failed"
+	EventTest             = "test"
+)
+
+type Notification struct {
+	Event   string `json:"event"`
+	Cert    string `json:"cert,omitempty"`
+	Message string `json:"message"`
+	// CertInfo 证书相关的通知才有
+	*CertInfo
+	Time time.Time `json:"time"`
+}
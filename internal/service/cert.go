@@ -0,0 +1,26 @@
+package service
+
+import (
+	"crypto/tls"
+
+	"github.com/abxuz/go-vhostd/internal/model"
+)
+
+type CertService interface {
+	// SetOCSPCacheDir 设置保存OCSP响应的目录，需要在Init之前调用，为空时不保存
+	SetOCSPCacheDir(dir string)
+	Init()
+	Reload(cfg model.Cfg)
+
+	// Get 返回当前使用的证书，证书不存在时返回nil
+	Get(name string) *tls.Certificate
+	// Certificates 返回当前使用的所有证书，key为证书名称
+	Certificates() map[string]*tls.Certificate
+	Status(name string) *model.CertStatus
+}
+
+var Cert CertService
+
+func RegisterCertService(s CertService) {
+	Cert = s
+}
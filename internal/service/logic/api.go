@@ -56,6 +56,13 @@ func (l *lApi) Init() {
 		v1.GET("/api-config", api.Api.GetApiConfig())
 		v1.POST("/api-config", api.Api.SetApiConfig())
 
+		v1.GET("/trusted-proxy", api.Api.GetTrustedProxy())
+		v1.POST("/trusted-proxy", api.Api.SetTrustedProxy())
+
+		v1.GET("/notify", api.Notify.Get())
+		v1.POST("/notify", api.Notify.Set())
+		v1.POST("/notify/test", api.Notify.Test())
+
 		g := v1.Group("/http-vhost/")
 		{
 			g.POST("/", api.Http.AddVhost())
@@ -74,6 +81,12 @@ func (l *lApi) Init() {
 			g.GET("/:domain", api.Https.GetVhost())
 		}
 
+		v1.GET("/https-passthrough", api.Https.GetPassthrough())
+		v1.POST("/https-passthrough", api.Https.SetPassthrough())
+
+		v1.GET("/https-default-cert", api.Https.GetDefaultCert())
+		v1.POST("/https-default-cert", api.Https.SetDefaultCert())
+
 		g = v1.Group("/http3-vhost/")
 		{
 			g.POST("/", api.Http3.AddVhost())
@@ -83,6 +96,18 @@ func (l *lApi) Init() {
 			g.GET("/:domain", api.Http3.GetVhost())
 		}
 
+		v1.GET("/http3-default-cert", api.Http3.GetDefaultCert())
+		v1.POST("/http3-default-cert", api.Http3.SetDefaultCert())
+
+		g = v1.Group("/stream/")
+		{
+			g.POST("/", api.Stream.Add())
+			g.DELETE("/:name", api.Stream.Del())
+			g.PATCH("/", api.Stream.Mod())
+			g.GET("/", api.Stream.List())
+			g.GET("/:name", api.Stream.Get())
+		}
+
 		g = v1.Group("/cert/")
 		{
 			g.POST("/", api.Cert.Add())
@@ -90,6 +115,22 @@ func (l *lApi) Init() {
 			g.PATCH("/", api.Cert.Mod())
 			g.GET("/", api.Cert.List())
 			g.GET("/:name", api.Cert.Get())
+			g.POST("/:name/key", api.Cert.SetKey())
+
+			g.POST("/csr/", api.Cert.AddCsr())
+			g.DELETE("/csr/:name", api.Cert.DelCsr())
+			g.GET("/csr/", api.Cert.ListCsr())
+			g.GET("/csr/:name", api.Cert.GetCsr())
+			g.POST("/csr/:name/issue", api.Cert.IssueCsr())
+		}
+
+		g = v1.Group("/ca/")
+		{
+			g.GET("/", api.CA.Get())
+			g.POST("/", api.CA.Set())
+			g.DELETE("/", api.CA.Del())
+			g.POST("/generate", api.CA.Generate())
+			g.GET("/root.pem", api.CA.Root())
 		}
 	}
 }
@@ -0,0 +1,488 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/abxuz/go-vhostd/internal/model"
+	"github.com/abxuz/go-vhostd/internal/service"
+	"github.com/abxuz/go-vhostd/utils"
+)
+
+const (
+	// certFileCheckInterval 检查证书文件是否变化的间隔
+	certFileCheckInterval = 10 * time.Second
+	// internalCertCheckInterval 检查内置CA签发的证书是否需要续期的间隔
+	internalCertCheckInterval = time.Hour
+	// chainCompleteRetryInterval 补全证书链失败后重试的间隔
+	chainCompleteRetryInterval = 10 * time.Minute
+	// certExpiryCheckInterval 检查证书是否快要过期或者已被吊销的间隔
+	certExpiryCheckInterval = time.Hour
+)
+
+type certEntry struct {
+	cfg      model.CertCfg
+	cert     *tls.Certificate
+	loadedAt time.Time
+	err      error
+
+	// stamp 最近一次尝试加载时文件的修改时间和大小，变化时才重新加载
+	stamp []fileStamp
+	// domain 内置CA为该域名签发的证书，不是来自配置
+	domain string
+
+	// completed 补全证书链时下载中间证书的地址
+	completed   []string
+	completeErr error
+	completeAt  time.Time
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFiles(files []string) []fileStamp {
+	stamp := make([]fileStamp, 0, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			stamp = append(stamp, fileStamp{})
+			continue
+		}
+		stamp = append(stamp, fileStamp{modTime: info.ModTime(), size: info.Size()})
+	}
+	return stamp
+}
+
+type lCert struct {
+	lock    sync.RWMutex
+	entries map[string]*certEntry
+
+	// ca 内置CA，没有配置时为nil
+	ca    *tls.Certificate
+	caCfg model.CACfg
+
+	// completeLock 同一时间只有一个补全证书链的任务
+	completeLock sync.Mutex
+	httpClient   *http.Client
+
+	// thresholds 从大到小排列的提醒天数
+	thresholds []int
+
+	// stapleLock 同一时间只有一个查询OCSP的任务，不保护ocsp
+	stapleLock sync.Mutex
+	// ocsp 每张证书的OCSP查询状态，和entries一样由lock保护，ocspCacheDir为空时不保存到磁盘
+	ocsp         map[string]*ocspState
+	ocspCacheDir string
+
+	// notified 已经发送过的通知，只在checkExpiry中使用
+	expiryLock sync.Mutex
+	notified   map[string]*notifyState
+}
+
+// notifyState 同一张证书每个提醒天数只通知一次，证书更换后重新计算
+type notifyState struct {
+	serial    string
+	threshold int
+	expired   bool
+	revoked   bool
+	// stapleMissing Must-Staple证书没有可用的OCSP响应
+	stapleMissing bool
+}
+
+func init() {
+	service.RegisterCertService(&lCert{})
+}
+
+func (l *lCert) Init() {
+	l.entries = make(map[string]*certEntry)
+	l.ocsp = make(map[string]*ocspState)
+	l.notified = make(map[string]*notifyState)
+	l.httpClient = &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		Timeout:   10 * time.Second,
+	}
+	go l.timerCheckFiles()
+	go l.timerRenewInternal()
+	go l.timerCheckExpiry()
+	go l.timerStaple()
+}
+
+func (l *lCert) SetOCSPCacheDir(dir string) {
+	l.ocspCacheDir = dir
+}
+
+func (l *lCert) Reload(cfg model.Cfg) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entries := make(map[string]*certEntry)
+	for _, c := range cfg.Cert {
+		old, ok := l.entries[c.Name]
+		if ok && reflect.DeepEqual(old.cfg, *c) {
+			// 配置没有变化，文件证书交给定时检查处理
+			entries[c.Name] = old
+			continue
+		}
+
+		entry := &certEntry{cfg: *c}
+		entry.stamp = statFiles(c.Files())
+		entry.cert, entry.err = c.Certificate()
+		if entry.err == nil {
+			entry.loadedAt = time.Now()
+		} else if ok && old.cert != nil {
+			entry.cert = old.cert
+			entry.loadedAt = old.loadedAt
+		}
+		entries[c.Name] = entry
+	}
+
+	l.ca, l.caCfg = nil, model.CACfg{}
+	if cfg.CA != nil {
+		ca, err := cfg.CA.Certificate()
+		if err == nil {
+			l.ca, l.caCfg = ca, *cfg.CA
+		}
+	}
+	for _, domain := range cfg.InternalCertDomains() {
+		name := model.InternalCertName(domain)
+		old, ok := l.entries[name]
+		if ok && !l.needIssue(old) {
+			entries[name] = old
+			continue
+		}
+		entries[name] = l.issue(domain, old)
+	}
+	// OCSP状态按证书内容区分，证书更换后会重新查询，这里只需要删除不存在的证书
+	for name := range l.ocsp {
+		if _, ok := entries[name]; !ok {
+			delete(l.ocsp, name)
+		}
+	}
+	l.entries = entries
+	l.thresholds = cfg.Notify.GetThresholds()
+
+	go l.completeChains()
+	go l.staple()
+	go l.checkExpiry()
+}
+
+// needIssue 证书不是当前CA签发的或者快要过期时需要重新签发
+func (l *lCert) needIssue(entry *certEntry) bool {
+	if l.ca == nil {
+		return false
+	}
+	if entry.cert == nil || entry.cert.Leaf.CheckSignatureFrom(l.ca.Leaf) != nil {
+		return true
+	}
+	return time.Now().Add(l.caCfg.GetRenewBefore()).After(entry.cert.Leaf.NotAfter)
+}
+
+// issue 用内置CA签发证书，失败时保留原来的证书
+func (l *lCert) issue(domain string, old *certEntry) *certEntry {
+	name := model.InternalCertName(domain)
+	entry := &certEntry{cfg: model.CertCfg{Name: name}, domain: domain}
+	if l.ca == nil {
+		entry.err = errors.New("ca not available")
+	} else {
+		entry.cert, entry.err = utils.IssueCert(l.ca, l.caCfg.GetValidity(), domain)
+	}
+
+	if entry.err == nil {
+		entry.loadedAt = time.Now()
+	} else if old != nil && old.cert != nil {
+		entry.cert = old.cert
+		entry.loadedAt = old.loadedAt
+	}
+	return entry
+}
+
+func (l *lCert) Get(name string) *tls.Certificate {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	entry, ok := l.entries[name]
+	if !ok {
+		return nil
+	}
+	return entry.cert
+}
+
+func (l *lCert) Certificates() map[string]*tls.Certificate {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	certs := make(map[string]*tls.Certificate)
+	for name, entry := range l.entries {
+		if entry.cert != nil {
+			certs[name] = entry.cert
+		}
+	}
+	return certs
+}
+
+func (l *lCert) Status(name string) *model.CertStatus {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	entry, ok := l.entries[name]
+	if !ok {
+		return nil
+	}
+
+	status := &model.CertStatus{Source: "content"}
+	if entry.cfg.IsFile() {
+		status.Source = "file"
+	}
+	if entry.domain != "" {
+		status.Source = "internal"
+	}
+	if !entry.loadedAt.IsZero() {
+		status.LoadedAt = entry.loadedAt.Format(time.DateTime)
+	}
+	if entry.err != nil {
+		status.Error = entry.err.Error()
+	}
+	status.Completed = entry.completed
+	if entry.completeErr != nil {
+		status.CompleteError = entry.completeErr.Error()
+	}
+	if entry.cert != nil {
+		status.Expiry = expiry(entry.cert, l.thresholds)
+	}
+	if state := l.ocsp[name]; state != nil && entry.cert != nil && bytes.Equal(state.leaf, entry.cert.Leaf.Raw) {
+		status.OCSP = state.status(time.Now())
+	}
+	return status
+}
+
+func expiry(cert *tls.Certificate, thresholds []int) string {
+	days := model.DaysRemaining(cert.Leaf.NotAfter)
+	switch {
+	case days < 0:
+		return "expired"
+	case len(thresholds) > 0 && days <= thresholds[0]:
+		return "expiring"
+	}
+	return "valid"
+}
+
+// timerCheckFiles 定时检查证书文件
+func (l *lCert) timerCheckFiles() {
+	timer := time.NewTicker(certFileCheckInterval)
+	for range timer.C {
+		l.checkFiles()
+		l.completeChains()
+		l.staple()
+	}
+}
+
+// checkFiles 证书文件变化后重新加载，加载失败时保留原来的证书
+func (l *lCert) checkFiles() {
+	l.lock.RLock()
+	entries := maps.Clone(l.entries)
+	l.lock.RUnlock()
+
+	for name, entry := range entries {
+		if !entry.cfg.IsFile() {
+			continue
+		}
+
+		stamp := statFiles(entry.cfg.Files())
+		if reflect.DeepEqual(stamp, entry.stamp) {
+			continue
+		}
+
+		reloaded := &certEntry{cfg: entry.cfg, stamp: stamp}
+		reloaded.cert, reloaded.err = entry.cfg.Certificate()
+		if reloaded.err == nil {
+			reloaded.loadedAt = time.Now()
+		} else {
+			reloaded.cert = entry.cert
+			reloaded.loadedAt = entry.loadedAt
+			log.Printf("[cert] unable to reload cert %v: %v", name, reloaded.err)
+			n := &model.Notification{
+				Event:   model.EventCertReloadFailed,
+				Cert:    name,
+				Message: fmt.Sprintf("cert %v reload failed, keep using the previous cert: %v", name, reloaded.err),
+				Time:    time.Now(),
+			}
+			if entry.cert != nil {
+				n.CertInfo = model.NewCertInfo(entry.cert)
+			}
+			service.Notify.Send(n)
+		}
+
+		l.lock.Lock()
+		// 检查期间配置可能已经重新加载过
+		if l.entries[name] == entry {
+			l.entries[name] = reloaded
+		}
+		l.lock.Unlock()
+	}
+}
+
+// completeChains 通过AIA中的签发者地址为缺少中间证书的证书补全证书链，
+// 失败时继续使用原来的证书，间隔一段时间后重试
+func (l *lCert) completeChains() {
+	l.completeLock.Lock()
+	defer l.completeLock.Unlock()
+
+	l.lock.RLock()
+	entries := maps.Clone(l.entries)
+	l.lock.RUnlock()
+
+	for name, entry := range entries {
+		if entry.cert == nil || entry.domain != "" || entry.completed != nil {
+			continue
+		}
+		if entry.completeErr != nil && time.Since(entry.completeAt) < chainCompleteRetryInterval {
+			continue
+		}
+		if !utils.IncompleteChain(entry.cert, utils.SystemRoots()) {
+			continue
+		}
+
+		completed := *entry
+		completed.completeAt = time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		cert, urls, err := utils.CompleteChain(ctx, l.httpClient, entry.cert, utils.SystemRoots())
+		cancel()
+		if err == nil {
+			completed.cert, completed.completed, completed.completeErr = cert, urls, nil
+		} else {
+			completed.completeErr = err
+		}
+
+		l.lock.Lock()
+		if l.entries[name] == entry {
+			l.entries[name] = &completed
+		}
+		l.lock.Unlock()
+	}
+}
+
+// timerRenewInternal 定时为快要过期的内置CA证书续期
+func (l *lCert) timerRenewInternal() {
+	timer := time.NewTicker(internalCertCheckInterval)
+	for range timer.C {
+		l.renewInternal()
+	}
+}
+
+func (l *lCert) renewInternal() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for name, entry := range l.entries {
+		if entry.domain != "" && l.needIssue(entry) {
+			l.entries[name] = l.issue(entry.domain, entry)
+		}
+	}
+}
+
+// timerCheckExpiry 定时检查证书是否快要过期或者已被吊销
+func (l *lCert) timerCheckExpiry() {
+	timer := time.NewTicker(certExpiryCheckInterval)
+	for range timer.C {
+		l.checkExpiry()
+	}
+}
+
+// checkExpiry 证书剩余天数每低于一个提醒天数、过期或者被吊销时发送一次通知，
+// 内置CA签发的证书会自动续期，不需要提醒
+func (l *lCert) checkExpiry() {
+	l.expiryLock.Lock()
+	defer l.expiryLock.Unlock()
+
+	l.lock.RLock()
+	entries := maps.Clone(l.entries)
+	states := maps.Clone(l.ocsp)
+	thresholds := l.thresholds
+	l.lock.RUnlock()
+
+	for name := range l.notified {
+		if _, ok := entries[name]; !ok {
+			delete(l.notified, name)
+		}
+	}
+
+	now := time.Now()
+	for name, entry := range entries {
+		if entry.cert == nil || entry.domain != "" {
+			continue
+		}
+
+		leaf := entry.cert.Leaf
+		state, ok := l.notified[name]
+		if !ok || state.serial != leaf.SerialNumber.String() {
+			state = &notifyState{serial: leaf.SerialNumber.String(), threshold: math.MaxInt}
+			l.notified[name] = state
+		}
+
+		n := &model.Notification{
+			Cert:     name,
+			CertInfo: model.NewCertInfo(entry.cert),
+			Time:     now,
+		}
+
+		if n.DaysRemaining < 0 {
+			if !state.expired {
+				state.expired = true
+				n.Event = model.EventCertExpired
+				n.Message = fmt.Sprintf("cert %v expired at %v", name, leaf.NotAfter.Local().Format(time.DateTime))
+				service.Notify.Send(n)
+			}
+		} else {
+			// 找出不小于剩余天数的最小提醒天数
+			threshold := math.MaxInt
+			for _, t := range thresholds {
+				if n.DaysRemaining <= t {
+					threshold = t
+				}
+			}
+			if threshold < state.threshold {
+				state.threshold = threshold
+				n.Event = model.EventCertExpiring
+				n.Message = fmt.Sprintf("cert %v will expire in %v days at %v",
+					name, n.DaysRemaining, leaf.NotAfter.Local().Format(time.DateTime))
+				service.Notify.Send(n)
+			}
+		}
+
+		ocspState := states[name]
+		if ocspState == nil || !bytes.Equal(ocspState.leaf, leaf.Raw) {
+			continue
+		}
+		status := ocspState.status(now)
+		if status.Status == "revoked" && !state.revoked {
+			state.revoked = true
+			revoked := *n
+			revoked.Event = model.EventCertRevoked
+			revoked.Message = fmt.Sprintf("cert %v was revoked at %v", name, status.RevokedAt)
+			service.Notify.Send(&revoked)
+		}
+
+		// 还没有查询过时不提醒，查询失败后才提醒
+		missing := status.MustStaple && !status.Stapled && status.Status != "pending"
+		if missing && !state.stapleMissing {
+			missing := *n
+			missing.Event = model.EventCertStapleMissing
+			missing.Message = fmt.Sprintf("cert %v requires ocsp stapling but no valid ocsp response is available: %v",
+				name, status.Error)
+			service.Notify.Send(&missing)
+		}
+		state.stapleMissing = missing
+	}
+}
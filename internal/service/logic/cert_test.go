@@ -0,0 +1,295 @@
+package logic
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abxuz/go-vhostd/internal/model"
+	"github.com/abxuz/go-vhostd/internal/service"
+	"github.com/abxuz/go-vhostd/utils"
+)
+
+// testCfg 和从文件加载的配置一样填充默认值
+func testCfg(cfg model.Cfg) model.Cfg {
+	(&lCfg{}).autofill(&cfg)
+	return cfg
+}
+
+// recordNotify 记录发送的通知，替换service.Notify用于测试
+type recordNotify struct {
+	sent chan *model.Notification
+}
+
+func (n *recordNotify) Init()                            {}
+func (n *recordNotify) Reload(model.Cfg)                 {}
+func (n *recordNotify) Send(m *model.Notification)       { n.sent <- m }
+func (n *recordNotify) Test(m *model.Notification) error { return nil }
+
+// events 返回已经发送的指定类型的通知
+func (n *recordNotify) events(event string) []*model.Notification {
+	events := make([]*model.Notification, 0)
+	for {
+		select {
+		case m := <-n.sent:
+			if m.Event == event {
+				events = append(events, m)
+			}
+		default:
+			return events
+		}
+	}
+}
+
+func setRecordNotify(t *testing.T) *recordNotify {
+	t.Helper()
+	old := service.Notify
+	n := &recordNotify{sent: make(chan *model.Notification, 100)}
+	service.Notify = n
+	t.Cleanup(func() { service.Notify = old })
+	return n
+}
+
+// writeFile 写入文件并设置修改时间，保证检查时能发现变化
+func writeFile(t *testing.T, file string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeCertFiles(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	cert, err := utils.GenerateSelfSignedCert(commonName, commonName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, key, err := utils.EncodeCertKey(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, certFile, chain, modTime)
+	writeFile(t, keyFile, key, modTime)
+}
+
+func TestCertCheckFiles(t *testing.T) {
+	notify := setRecordNotify(t)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	modTime := time.Now().Add(-time.Hour)
+	writeCertFiles(t, certFile, keyFile, "a.test", modTime)
+
+	l := &lCert{}
+	l.Init()
+	l.Reload(testCfg(model.Cfg{Cert: []*model.CertCfg{{Name: "file", CertFile: certFile, KeyFile: keyFile}}}))
+
+	commonName := func() string {
+		cert := l.Get("file")
+		if cert == nil {
+			return ""
+		}
+		return cert.Leaf.Subject.CommonName
+	}
+	if got := commonName(); got != "a.test" {
+		t.Fatalf("loaded %q, want a.test", got)
+	}
+
+	// 文件没有变化时不重新加载
+	cert := l.Get("file")
+	l.checkFiles()
+	if l.Get("file") != cert {
+		t.Errorf("cert reloaded without file change")
+	}
+
+	// 文件变化后加载新的证书
+	modTime = modTime.Add(time.Minute)
+	writeCertFiles(t, certFile, keyFile, "b.test", modTime)
+	l.checkFiles()
+	if got := commonName(); got != "b.test" {
+		t.Errorf("loaded %q after file change, want b.test", got)
+	}
+	if status := l.Status("file"); status.Source != "file" || status.Error != "" || status.LoadedAt == "" {
+		t.Errorf("status = %+v, want loaded from file", status)
+	}
+
+	// 加载失败时保留原来的证书，只通知一次
+	modTime = modTime.Add(time.Minute)
+	writeFile(t, certFile, []byte("not a certificate"), modTime)
+	l.checkFiles()
+	l.checkFiles()
+	if got := commonName(); got != "b.test" {
+		t.Errorf("loaded %q after broken file, want previous b.test", got)
+	}
+	if status := l.Status("file"); status.Error == "" {
+		t.Errorf("status = %+v, want reload error", status)
+	}
+	events := notify.events(model.EventCertReloadFailed)
+	if len(events) != 1 {
+		t.Fatalf("%v %v notifications, want 1", len(events), model.EventCertReloadFailed)
+	}
+	if events[0].Cert != "file" || events[0].CertInfo == nil {
+		t.Errorf("notification = %+v, want cert file with info of the previous cert", events[0])
+	}
+
+	// 文件修复后恢复
+	modTime = modTime.Add(time.Minute)
+	writeCertFiles(t, certFile, keyFile, "c.test", modTime)
+	l.checkFiles()
+	if got := commonName(); got != "c.test" {
+		t.Errorf("loaded %q after file fixed, want c.test", got)
+	}
+	if status := l.Status("file"); status.Error != "" {
+		t.Errorf("status error = %v after file fixed, want empty", status.Error)
+	}
+}
+
+func TestCertReloadKeepsPrevious(t *testing.T) {
+	setRecordNotify(t)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertFiles(t, certFile, keyFile, "a.test", time.Now().Add(-time.Hour))
+
+	l := &lCert{}
+	l.Init()
+	cfg := &model.CertCfg{Name: "file", CertFile: certFile, KeyFile: keyFile}
+	l.Reload(testCfg(model.Cfg{Cert: []*model.CertCfg{cfg}}))
+	cert := l.Get("file")
+
+	// 配置没有变化时保留原来的条目
+	l.Reload(testCfg(model.Cfg{Cert: []*model.CertCfg{cfg}}))
+	if l.Get("file") != cert {
+		t.Errorf("cert reloaded without config change")
+	}
+
+	// 配置变化后加载失败时继续使用原来的证书
+	broken := *cfg
+	broken.KeyFile = filepath.Join(dir, "missing.pem")
+	l.Reload(testCfg(model.Cfg{Cert: []*model.CertCfg{&broken}}))
+	if l.Get("file") != cert {
+		t.Errorf("previous cert not kept after failed reload")
+	}
+	if status := l.Status("file"); status.Error == "" {
+		t.Errorf("status = %+v, want reload error", status)
+	}
+
+	l.Reload(testCfg(model.Cfg{}))
+	if l.Get("file") != nil {
+		t.Errorf("cert still available after removed from config")
+	}
+}
+
+func caCfg(t *testing.T) *model.CACfg {
+	t.Helper()
+	ca, err := utils.GenerateCA("test ca", 365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, key, err := utils.EncodeCertKey(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &model.CACfg{Content: string(chain), Key: string(key)}
+}
+
+func internalCfg(ca *model.CACfg, domains ...string) model.Cfg {
+	cfg := model.Cfg{CA: ca, Https: &model.HttpsCfg{}}
+	for _, domain := range domains {
+		cfg.Https.Vhost = append(cfg.Https.Vhost, &model.HttpsVhostCfg{
+			VhostCfg: model.VhostCfg{Domain: domain},
+			Cert:     model.InternalCert,
+		})
+	}
+	return testCfg(cfg)
+}
+
+func TestCertInternal(t *testing.T) {
+	setRecordNotify(t)
+	ca := caCfg(t)
+	l := &lCert{}
+	l.Init()
+	l.Reload(internalCfg(ca, "a.test"))
+
+	name := model.InternalCertName("a.test")
+	cert := l.Get(name)
+	if cert == nil {
+		t.Fatalf("no internal cert issued for a.test")
+	}
+	if err := cert.Leaf.CheckSignatureFrom(l.ca.Leaf); err != nil {
+		t.Errorf("internal cert not signed by the ca: %v", err)
+	}
+	if err := cert.Leaf.VerifyHostname("a.test"); err != nil {
+		t.Errorf("internal cert: %v", err)
+	}
+	if status := l.Status(name); status.Source != "internal" || status.Error != "" {
+		t.Errorf("status = %+v, want internal without error", status)
+	}
+
+	// 证书有效时重新加载配置不会重新签发
+	l.Reload(internalCfg(ca, "a.test", "b.test"))
+	if l.Get(name) != cert {
+		t.Errorf("internal cert reissued without change")
+	}
+	if l.Get(model.InternalCertName("b.test")) == nil {
+		t.Errorf("no internal cert issued for added vhost b.test")
+	}
+
+	// 更换CA后重新签发
+	other := caCfg(t)
+	l.Reload(internalCfg(other, "a.test"))
+	reissued := l.Get(name)
+	if reissued == nil || reissued == cert || reissued.Leaf.CheckSignatureFrom(l.ca.Leaf) != nil {
+		t.Errorf("internal cert not reissued by the new ca")
+	}
+	if l.Get(model.InternalCertName("b.test")) != nil {
+		t.Errorf("internal cert of removed vhost b.test still available")
+	}
+
+	// 删除CA后继续使用原来的证书
+	l.Reload(internalCfg(nil, "a.test"))
+	if l.Get(name) != reissued {
+		t.Errorf("previous internal cert not kept without ca")
+	}
+
+	// 没有CA时新的vhost无法签发证书
+	l.Reload(internalCfg(nil, "a.test", "c.test"))
+	c := model.InternalCertName("c.test")
+	if l.Get(c) != nil {
+		t.Errorf("internal cert issued for c.test without ca")
+	}
+	if status := l.Status(c); status == nil || status.Error == "" {
+		t.Errorf("status = %+v, want ca not available error", status)
+	}
+}
+
+func TestCertRenewInternal(t *testing.T) {
+	setRecordNotify(t)
+	ca := caCfg(t)
+	l := &lCert{}
+	l.Init()
+	l.Reload(internalCfg(ca, "a.test"))
+
+	name := model.InternalCertName("a.test")
+	cert := l.Get(name)
+	l.renewInternal()
+	if l.Get(name) != cert {
+		t.Errorf("internal cert renewed before renew_before")
+	}
+
+	// 剩余有效期少于renew_before时续期
+	ca.RenewBefore = 365
+	l.Reload(internalCfg(ca, "a.test"))
+	renewed := l.Get(name)
+	if renewed == nil || renewed == cert {
+		t.Fatalf("internal cert not renewed on reload")
+	}
+	l.renewInternal()
+	if l.Get(name) == renewed {
+		t.Errorf("internal cert not renewed by renewInternal")
+	}
+}
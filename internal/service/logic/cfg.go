@@ -1,6 +1,7 @@
 package logic
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"sync"
@@ -102,6 +103,9 @@ func (l *lCfg) LoadFromMemory() (cfg model.Cfg, err error) {
 
 func (l *lCfg) SaveToMemory(cfg model.Cfg) error {
 	l.autofill(&cfg)
+	if err := l.seal(&cfg); err != nil {
+		return err
+	}
 	if err := cfg.CheckValid(); err != nil {
 		return err
 	}
@@ -122,6 +126,9 @@ func (l *lCfg) decode(r io.Reader) (cfg model.Cfg, err error) {
 
 func (l *lCfg) encode(cfg *model.Cfg, w io.Writer) error {
 	l.autofill(cfg)
+	if err := l.seal(cfg); err != nil {
+		return err
+	}
 	if err := cfg.CheckValid(); err != nil {
 		return err
 	}
@@ -130,6 +137,31 @@ func (l *lCfg) encode(cfg *model.Cfg, w io.Writer) error {
 	return encoder.Encode(cfg)
 }
 
+// seal 私钥与证书分开保存，配置了主密钥时加密私钥和密码，旧主密钥加密的内容会用新主密钥重新加密
+func (l *lCfg) seal(cfg *model.Cfg) error {
+	for _, c := range cfg.Cert {
+		if err := c.Seal(); err != nil {
+			return fmt.Errorf("unable to seal private key of cert %v: %w", c.Name, err)
+		}
+	}
+	for _, c := range cfg.Csr {
+		if err := c.Seal(); err != nil {
+			return fmt.Errorf("unable to seal private key of csr %v: %w", c.Name, err)
+		}
+	}
+	if cfg.CA != nil {
+		if err := cfg.CA.Seal(); err != nil {
+			return fmt.Errorf("unable to seal private key of ca: %w", err)
+		}
+	}
+	if cfg.Notify != nil && cfg.Notify.Smtp != nil {
+		if err := cfg.Notify.Smtp.Seal(); err != nil {
+			return fmt.Errorf("unable to seal smtp password: %w", err)
+		}
+	}
+	return nil
+}
+
 func (l *lCfg) autofill(cfg *model.Cfg) {
 	if cfg.Api == nil {
 		cfg.Api = &model.ApiCfg{}
@@ -143,7 +175,7 @@ func (l *lCfg) autofill(cfg *model.Cfg) {
 		cfg.Http = &model.HttpCfg{}
 	}
 	if cfg.Http.Listen == nil {
-		cfg.Http.Listen = make([]string, 0)
+		cfg.Http.Listen = make([]*model.ListenCfg, 0)
 	}
 	if cfg.Http.Vhost == nil {
 		cfg.Http.Vhost = make([]*model.HttpVhostCfg, 0)
@@ -166,11 +198,14 @@ func (l *lCfg) autofill(cfg *model.Cfg) {
 		cfg.Https = &model.HttpsCfg{}
 	}
 	if cfg.Https.Listen == nil {
-		cfg.Https.Listen = make([]string, 0)
+		cfg.Https.Listen = make([]*model.ListenCfg, 0)
 	}
 	if cfg.Https.Vhost == nil {
 		cfg.Https.Vhost = make([]*model.HttpsVhostCfg, 0)
 	}
+	if cfg.Https.Passthrough == nil {
+		cfg.Https.Passthrough = make([]*model.StreamSniCfg, 0)
+	}
 	for _, vhost := range cfg.Https.Vhost {
 		if vhost.Mapping == nil {
 			vhost.Mapping = make([]*model.MappingCfg, 0)
@@ -186,7 +221,7 @@ func (l *lCfg) autofill(cfg *model.Cfg) {
 		cfg.Http3 = &model.Http3Cfg{}
 	}
 	if cfg.Http3.Listen == nil {
-		cfg.Http3.Listen = make([]string, 0)
+		cfg.Http3.Listen = make([]*model.Http3ListenCfg, 0)
 	}
 	if cfg.Http3.Vhost == nil {
 		cfg.Http3.Vhost = make([]*model.Http3VhostCfg, 0)
@@ -205,4 +240,20 @@ func (l *lCfg) autofill(cfg *model.Cfg) {
 	if cfg.Cert == nil {
 		cfg.Cert = make([]*model.CertCfg, 0)
 	}
+
+	if cfg.Stream == nil {
+		cfg.Stream = make([]*model.StreamCfg, 0)
+	}
+	for _, stream := range cfg.Stream {
+		if stream.Listen == nil {
+			stream.Listen = make([]*model.ListenCfg, 0)
+		}
+		if stream.Sni == nil {
+			stream.Sni = make([]*model.StreamSniCfg, 0)
+		}
+	}
+
+	if cfg.TrustedProxy == nil {
+		cfg.TrustedProxy = make([]string, 0)
+	}
 }
@@ -0,0 +1,278 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abxuz/go-vhostd/utils"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+var ErrTargetNotAllowed = errors.New("target not allowed")
+
+// serveWebSocket RFC 8441/9220 把extended CONNECT的websocket请求转换成HTTP/1.1的Upgrade请求转发给上游，
+// 上游返回101后在请求流和上游连接之间按帧双向转发数据
+func (l *lProxy) serveWebSocket(lock *sync.RWMutex, mappings map[string][]*Mapping, transport http.RoundTripper, resp http.ResponseWriter, req *http.Request) {
+	// 只用于获取websocket的限制，匹配失败时由director返回对应的错误
+	t, _ := l.matchMapping(lock, mappings, req)
+	if t == nil {
+		t = &Mapping{}
+	}
+	// 转发给上游时会改成GET，需要按原始的CONNECT请求判断，CONNECT不能在早期数据中建立隧道
+	if utils.IsEarlyData(req) {
+		l.errorHandler(resp, req, ErrTooEarly)
+		return
+	}
+
+	out := req.Clone(req.Context())
+	out.Method = http.MethodGet
+	out.Proto, out.ProtoMajor, out.ProtoMinor = "HTTP/1.1", 1, 1
+	out.RequestURI = ""
+	out.Body, out.ContentLength = http.NoBody, 0
+	out.Header.Del(":protocol")
+	out.Header.Set("Connection", "Upgrade")
+	out.Header.Set("Upgrade", "websocket")
+	// 客户端到vhostd之间不需要握手校验，Sec-WebSocket-Accept由上游按这里生成的key计算
+	out.Header.Set("Sec-WebSocket-Key", utils.NewWebSocketKey())
+	if out.Header.Get("Sec-WebSocket-Version") == "" {
+		out.Header.Set("Sec-WebSocket-Version", "13")
+	}
+
+	res, err := transport.RoundTrip(out)
+	if err != nil {
+		l.errorHandler(resp, out, err)
+		return
+	}
+	defer res.Body.Close()
+
+	// 认证、跳转以及上游拒绝升级时按普通响应返回
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		for k, vs := range res.Header {
+			resp.Header()[k] = vs
+		}
+		resp.WriteHeader(res.StatusCode)
+		io.Copy(resp, res.Body)
+		return
+	}
+
+	upstream, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		l.errorHandler(resp, out, errors.New("upstream does not support upgrade"))
+		return
+	}
+	for k, vs := range res.Header {
+		switch k {
+		case "Connection", "Upgrade", "Sec-Websocket-Accept":
+			continue
+		}
+		resp.Header()[k] = vs
+	}
+	resp.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(resp).Flush(); err != nil {
+		return
+	}
+
+	defer upstream.Close()
+
+	active := func() {}
+	if t.WebSocketIdleTimeout > 0 {
+		// 关闭上游连接后两个方向的转发都会结束
+		timer := time.AfterFunc(t.WebSocketIdleTimeout, func() { upstream.Close() })
+		defer timer.Stop()
+		active = func() { timer.Reset(t.WebSocketIdleTimeout) }
+	}
+
+	client := utils.NewFlushWriter(resp)
+	up := make(chan error, 1)
+	down := make(chan error, 1)
+	go func() {
+		up <- utils.CopyWebSocketFrames(upstream, req.Body, t.WebSocketMaxFrameSize, active)
+	}()
+	go func() {
+		down <- utils.CopyWebSocketFrames(client, upstream, t.WebSocketMaxFrameSize, active)
+	}()
+
+	// handler返回后不能再写resp，必须等上游到客户端的转发结束。
+	// 超过帧大小限制时，停止转发的方向正好处在帧边界，向该方向的接收方发送关闭帧
+	select {
+	case err := <-up:
+		if err == utils.ErrWebSocketFrameTooLarge {
+			upstream.Write(utils.WebSocketCloseFrame(utils.WebSocketCloseMessageTooBig, true))
+		}
+		upstream.Close()
+		<-down
+	case err := <-down:
+		if err == utils.ErrWebSocketFrameTooLarge {
+			client.Write(utils.WebSocketCloseFrame(utils.WebSocketCloseMessageTooBig, false))
+		}
+	}
+}
+
+// serveConnectUdp RFC 9298 通过http3的datagram转发udp数据，只支持context id为0的udp负载
+func (l *lProxy) serveConnectUdp(lock *sync.RWMutex, mappings map[string][]*Mapping, resp http.ResponseWriter, req *http.Request) {
+	t, err := l.matchMapping(lock, mappings, req)
+	if err != nil {
+		l.errorHandler(resp, req, err)
+		return
+	}
+	if t.ConnectUdp == nil {
+		l.errorHandler(resp, req, ErrVhostNotFound)
+		return
+	}
+	// CONNECT不是幂等请求，不能在早期数据中建立隧道
+	if utils.IsEarlyData(req) {
+		l.errorHandler(resp, req, ErrTooEarly)
+		return
+	}
+
+	if t.BasicAuthEncoded.Size() > 0 {
+		if !t.checkBasicAuth(req.Header.Get("Proxy-Authorization")) && !t.checkBasicAuth(req.Header.Get("Authorization")) {
+			resp.Header().Set("Proxy-Authenticate", "Basic realm=Authorization Required")
+			resp.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+	}
+
+	streamer, ok := resp.(http3.HTTPStreamer)
+	if !ok {
+		resp.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if req.Header.Get(http3.CapsuleProtocolHeader) != "?1" {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	host, port, err := utils.ParseConnectUdpTarget(req.URL.Path[len(t.Path):])
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	addr, err := resolveConnectUdpTarget(req.Context(), t.ConnectUdpAllow, host, port)
+	if err != nil {
+		if err == ErrTargetNotAllowed {
+			resp.WriteHeader(http.StatusForbidden)
+		} else {
+			resp.WriteHeader(http.StatusBadGateway)
+		}
+		return
+	}
+
+	conn, err := StreamDialer.DialContext(req.Context(), "udp", addr.String())
+	if err != nil {
+		resp.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	session := &udpStreamSession{UDPConn: conn.(*net.UDPConn)}
+	session.active()
+	defer session.Close()
+
+	for k, vs := range t.AddHeader {
+		resp.Header()[k] = vs
+	}
+	resp.Header().Set(http3.CapsuleProtocolHeader, "?1")
+	resp.WriteHeader(http.StatusOK)
+	str := streamer.HTTPStream()
+	defer str.Close()
+	defer str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	// 客户端发来的datagram，context id为0时负载是完整的udp包
+	go func() {
+		defer cancel()
+		for {
+			data, err := str.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			contextID, n, err := quicvarint.Parse(data)
+			if err != nil || contextID != 0 {
+				continue
+			}
+			session.active()
+			session.Write(data[n:])
+		}
+	}()
+
+	// 请求流上只会有capsule，全部丢弃，客户端关闭请求流时结束隧道
+	go func() {
+		defer cancel()
+		r := quicvarint.NewReader(str)
+		for {
+			_, cr, err := http3.ParseCapsule(r)
+			if err != nil {
+				return
+			}
+			if _, err := io.Copy(io.Discard, cr); err != nil {
+				return
+			}
+		}
+	}()
+
+	// 上游的回包，会话空闲超时后关闭
+	go func() {
+		defer cancel()
+		buf := make([]byte, 65536)
+		for {
+			session.SetReadDeadline(time.Now().Add(t.ConnectUdpIdleTimeout))
+			n, err := session.Read(buf[1:])
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() && session.idle() < t.ConnectUdpIdleTimeout {
+					continue
+				}
+				return
+			}
+			session.active()
+			// 超过客户端最大datagram长度的包直接丢弃
+			str.SendDatagram(buf[:n+1])
+		}
+	}()
+
+	<-ctx.Done()
+}
+
+// resolveConnectUdpTarget 请求的是域名时先按域名规则检查，解析后逐个检查地址，
+// 内部地址只能由IP或CIDR规则显式允许，返回的地址直接用于连接，避免再次解析被重新绑定
+func resolveConnectUdpTarget(ctx context.Context, rules []*utils.TargetRule, host string, port uint16) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		addr = addr.Unmap()
+		if utils.AllowAddr(rules, addr, port, false) {
+			return netip.AddrPortFrom(addr, port), nil
+		}
+		return netip.AddrPort{}, ErrTargetNotAllowed
+	}
+
+	domainAllowed := false
+	for _, rule := range rules {
+		if rule.MatchDomain(host, port) {
+			domainAllowed = true
+			break
+		}
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		if domainAllowed {
+			return netip.AddrPort{}, err
+		}
+		return netip.AddrPort{}, ErrTargetNotAllowed
+	}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if utils.AllowAddr(rules, addr, port, domainAllowed) {
+			return netip.AddrPortFrom(addr, port), nil
+		}
+	}
+	return netip.AddrPort{}, ErrTargetNotAllowed
+}
@@ -0,0 +1,243 @@
+package logic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abxuz/go-vhostd/internal/model"
+)
+
+// streamResponse 模拟http2请求流的响应，写入的数据通过管道交给测试读取
+type streamResponse struct {
+	header http.Header
+	status chan int
+	w      *io.PipeWriter
+}
+
+func (r *streamResponse) Header() http.Header         { return r.header }
+func (r *streamResponse) WriteHeader(code int)        { r.status <- code }
+func (r *streamResponse) Write(b []byte) (int, error) { return r.w.Write(b) }
+func (r *streamResponse) Flush()                      {}
+
+func wsFrame(opcode byte, payload []byte, masked bool) []byte {
+	frame := []byte{0x80 | opcode, 0}
+	if len(payload) < 126 {
+		frame[1] = byte(len(payload))
+	} else {
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	frame[1] |= 0x80
+	frame = append(frame, 0, 0, 0, 0)
+	return append(frame, payload...)
+}
+
+// wsUpstream HTTP/1.1的websocket上游，/echo原样返回收到的数据，
+// /record把收到的数据发送到received，/big升级后发送一个大帧，/reject拒绝升级
+func wsUpstream(t *testing.T, received chan<- []byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" || r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-WebSocket-Key") == "" {
+			w.Header().Set("X-Upstream", "rejected")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+			"Sec-WebSocket-Accept: accept\r\nX-Upstream: upgraded\r\n\r\n")
+		rw.Flush()
+
+		switch r.URL.Path {
+		case "/echo":
+			io.Copy(conn, rw)
+		case "/record":
+			data, _ := io.ReadAll(rw)
+			received <- data
+		case "/big":
+			conn.Write(wsFrame(0x2, bytes.Repeat([]byte{'a'}, 2000), false))
+			io.Copy(io.Discard, rw)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+type wsSession struct {
+	resp   *streamResponse
+	client *io.PipeWriter
+	out    *bufio.Reader
+	done   chan struct{}
+}
+
+// serveWebSocketTest 用extended CONNECT请求调用serveWebSocket，在后台运行直到handler返回
+func serveWebSocketTest(t *testing.T, server *httptest.Server, path string, ws *model.WebSocketCfg) *wsSession {
+	t.Helper()
+	mapping := &Mapping{}
+	mapping.Path = "/"
+	if ws != nil {
+		mapping.WebSocketIdleTimeout, _ = ws.GetIdleTimeout()
+		mapping.WebSocketMaxFrameSize = ws.MaxFrameSize
+	}
+	mappings := map[string][]*Mapping{"127.0.0.1": {mapping}}
+
+	body, client := io.Pipe()
+	req, err := http.NewRequest(http.MethodConnect, server.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(":protocol", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	out, w := io.Pipe()
+	s := &wsSession{
+		resp:   &streamResponse{header: make(http.Header), status: make(chan int, 1), w: w},
+		client: client,
+		out:    bufio.NewReader(out),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		defer w.Close()
+		(&lProxy{}).serveWebSocket(new(sync.RWMutex), mappings, http.DefaultTransport, s.resp, req)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		out.Close()
+		<-s.done
+	})
+	return s
+}
+
+func (s *wsSession) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("serveWebSocket did not return")
+	}
+}
+
+func TestServeWebSocket(t *testing.T) {
+	server := wsUpstream(t, nil)
+	s := serveWebSocketTest(t, server, "/echo", nil)
+	if status := <-s.resp.status; status != http.StatusOK {
+		t.Fatalf("status = %v, want %v", status, http.StatusOK)
+	}
+	if got := s.resp.header.Get("X-Upstream"); got != "upgraded" {
+		t.Errorf("X-Upstream = %q, want upgraded", got)
+	}
+	for _, k := range []string{"Connection", "Upgrade", "Sec-Websocket-Accept"} {
+		if _, ok := s.resp.header[k]; ok {
+			t.Errorf("hop-by-hop header %v forwarded to the client", k)
+		}
+	}
+
+	// 两个方向按帧转发
+	for _, payload := range [][]byte{[]byte("hello"), bytes.Repeat([]byte{'a'}, 1000)} {
+		frame := wsFrame(0x1, payload, true)
+		if _, err := s.client.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(frame))
+		if _, err := io.ReadFull(s.out, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, frame) {
+			t.Errorf("echoed frame %x, want %x", got, frame)
+		}
+	}
+
+	// 客户端关闭请求流后结束
+	s.client.Close()
+	s.wait(t)
+}
+
+func TestServeWebSocketRejected(t *testing.T) {
+	server := wsUpstream(t, nil)
+	s := serveWebSocketTest(t, server, "/reject", nil)
+	if status := <-s.resp.status; status != http.StatusForbidden {
+		t.Errorf("status = %v, want %v", status, http.StatusForbidden)
+	}
+	if got := s.resp.header.Get("X-Upstream"); got != "rejected" {
+		t.Errorf("X-Upstream = %q, want rejected", got)
+	}
+	io.Copy(io.Discard, s.out)
+	s.wait(t)
+}
+
+func TestServeWebSocketMaxFrameSize(t *testing.T) {
+	received := make(chan []byte, 1)
+	server := wsUpstream(t, received)
+
+	// 客户端发送的帧超过限制时向上游发送1009关闭帧
+	s := serveWebSocketTest(t, server, "/record", &model.WebSocketCfg{MaxFrameSize: 1024})
+	<-s.resp.status
+	small := wsFrame(0x1, []byte("hello"), true)
+	s.client.Write(small)
+	// 超过限制的帧只读取帧头，剩下的数据不会被读取
+	go s.client.Write(wsFrame(0x2, bytes.Repeat([]byte{'a'}, 2000), true))
+	s.wait(t)
+	select {
+	case data := <-received:
+		if len(data) != len(small)+8 || !bytes.Equal(data[:len(small)], small) {
+			t.Fatalf("upstream received %x, want the small frame followed by a close frame", data)
+		}
+		closeFrame := data[len(small):]
+		mask := closeFrame[2:6]
+		code := binary.BigEndian.Uint16([]byte{closeFrame[6] ^ mask[0], closeFrame[7] ^ mask[1]})
+		if closeFrame[0] != 0x88 || closeFrame[1] != 0x82 || code != 1009 {
+			t.Errorf("upstream received close frame %x, want masked close 1009", closeFrame)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream did not receive anything")
+	}
+
+	// 上游发送的帧超过限制时向客户端发送1009关闭帧
+	s = serveWebSocketTest(t, server, "/big", &model.WebSocketCfg{MaxFrameSize: 1024})
+	<-s.resp.status
+	got, err := io.ReadAll(s.out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x88, 0x02, 0x03, 0xf1}; !bytes.Equal(got, want) {
+		t.Errorf("client received %x, want close frame %x", got, want)
+	}
+	s.wait(t)
+}
+
+func TestServeWebSocketIdleTimeout(t *testing.T) {
+	server := wsUpstream(t, nil)
+	s := serveWebSocketTest(t, server, "/echo", &model.WebSocketCfg{IdleTimeout: "300ms"})
+	<-s.resp.status
+
+	// 有数据时不会超时
+	frame := wsFrame(0x1, []byte("ping"), true)
+	for range 4 {
+		time.Sleep(150 * time.Millisecond)
+		s.client.Write(frame)
+		if _, err := io.ReadFull(s.out, make([]byte, len(frame))); err != nil {
+			t.Fatalf("connection closed while active: %v", err)
+		}
+	}
+
+	start := time.Now()
+	io.Copy(io.Discard, s.out)
+	s.wait(t)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("closed %v after idle, want about 300ms", d)
+	}
+}
@@ -0,0 +1,131 @@
+package logic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abxuz/go-vhostd/internal/model"
+	"github.com/abxuz/go-vhostd/internal/service"
+)
+
+type lNotify struct {
+	lock       sync.RWMutex
+	cfg        *model.NotifyCfg
+	httpClient *http.Client
+}
+
+func init() {
+	service.RegisterNotifyService(&lNotify{})
+}
+
+func (l *lNotify) Init() {
+	l.httpClient = &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		Timeout:   10 * time.Second,
+	}
+}
+
+func (l *lNotify) Reload(cfg model.Cfg) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cfg = cfg.Notify
+}
+
+func (l *lNotify) Send(n *model.Notification) {
+	l.lock.RLock()
+	cfg := l.cfg
+	l.lock.RUnlock()
+
+	log.Printf("[notify] %v: %v", n.Event, n.Message)
+	go func() {
+		if err := l.send(cfg, n); err != nil {
+			log.Printf("[notify] unable to send %v notification: %v", n.Event, err)
+		}
+	}()
+}
+
+func (l *lNotify) Test(n *model.Notification) error {
+	l.lock.RLock()
+	cfg := l.cfg
+	l.lock.RUnlock()
+
+	log.Printf("[notify] %v: %v", n.Event, n.Message)
+	return l.send(cfg, n)
+}
+
+// send 发送到所有webhook和邮箱，返回所有失败的原因
+func (l *lNotify) send(cfg *model.NotifyCfg, n *model.Notification) error {
+	if cfg == nil {
+		return nil
+	}
+
+	errs := make([]error, 0)
+	for _, webhook := range cfg.Webhook {
+		if err := l.sendWebhook(webhook, n); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %v: %w", webhook, err))
+		}
+	}
+	if cfg.Smtp != nil {
+		if err := l.sendMail(cfg.Smtp, n); err != nil {
+			errs = append(errs, fmt.Errorf("smtp %v: %w", cfg.Smtp.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *lNotify) sendWebhook(webhook string, n *model.Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	resp, err := l.httpClient.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// sendMail 服务器支持时net/smtp会自动使用STARTTLS
+func (l *lNotify) sendMail(cfg *model.SmtpCfg, n *model.Notification) error {
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		password, err := cfg.GetPassword()
+		if err != nil {
+			return err
+		}
+		host, _, _ := net.SplitHostPort(cfg.Addr)
+		auth = smtp.PlainAuth("", cfg.Username, password, host)
+	}
+
+	msg := &strings.Builder{}
+	fmt.Fprintf(msg, "From: %v\r\n", cfg.From)
+	fmt.Fprintf(msg, "To: %v\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(msg, "Subject: [vhostd] %v\r\n", n.Message)
+	fmt.Fprintf(msg, "Date: %v\r\n", n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(msg, "\r\n")
+	fmt.Fprintf(msg, "%v\r\n\r\n", n.Message)
+	fmt.Fprintf(msg, "event: %v\r\n", n.Event)
+	if n.CertInfo != nil {
+		fmt.Fprintf(msg, "cert: %v\r\n", n.Cert)
+		fmt.Fprintf(msg, "domain: %v\r\n", strings.Join(n.Domain, ", "))
+		fmt.Fprintf(msg, "not after: %v\r\n", n.NotAfter.Local().Format(time.DateTime))
+		fmt.Fprintf(msg, "days remaining: %v\r\n", n.DaysRemaining)
+	}
+	return smtp.SendMail(cfg.Addr, auth, cfg.From, cfg.To, []byte(msg.String()))
+}
@@ -0,0 +1,261 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/abxuz/go-vhostd/internal/model"
+	"github.com/abxuz/go-vhostd/utils"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspCheckInterval 检查OCSP响应是否需要更新的间隔，实际查询时间由响应的有效期决定
+	ocspCheckInterval = 30 * time.Second
+	// ocspMaxRetryInterval 查询失败后最长的重试间隔，Must-Staple证书使用更短的间隔
+	ocspMaxRetryInterval           = time.Hour
+	ocspMaxRetryIntervalMustStaple = 5 * time.Minute
+)
+
+// ocspState 一张证书的OCSP查询状态，更新时整体替换，不会原地修改
+type ocspState struct {
+	// leaf 状态对应的证书，证书更换后重新查询
+	leaf       []byte
+	mustStaple bool
+
+	// resp 最近一次成功获取的响应，raw为原始内容
+	resp      *ocsp.Response
+	raw       []byte
+	source    string
+	responder string
+
+	err         error
+	failures    int
+	updatedAt   time.Time
+	nextRefresh time.Time
+}
+
+// staple 返回可以发送给客户端的响应，只发送有效期内的good响应
+func (s *ocspState) staple(now time.Time) []byte {
+	if s.resp == nil || s.resp.Status != ocsp.Good {
+		return nil
+	}
+	if !s.resp.NextUpdate.IsZero() && now.After(s.resp.NextUpdate) {
+		return nil
+	}
+	return s.raw
+}
+
+func (s *ocspState) status(now time.Time) *model.OCSPStatus {
+	status := &model.OCSPStatus{
+		Status:     "pending",
+		Source:     s.source,
+		Responder:  s.responder,
+		Stapled:    s.staple(now) != nil,
+		MustStaple: s.mustStaple,
+	}
+	if s.resp != nil {
+		switch s.resp.Status {
+		case ocsp.Good:
+			status.Status = "good"
+		case ocsp.Revoked:
+			status.Status = "revoked"
+			status.RevokedAt = s.resp.RevokedAt.Local().Format(time.DateTime)
+		default:
+			status.Status = "unknown"
+		}
+		status.ThisUpdate = s.resp.ThisUpdate.Local().Format(time.DateTime)
+		if !s.resp.NextUpdate.IsZero() {
+			status.NextUpdate = s.resp.NextUpdate.Local().Format(time.DateTime)
+		}
+	} else if s.err != nil {
+		status.Status = "error"
+	}
+	if s.err != nil {
+		status.Error = s.err.Error()
+	}
+	if !s.updatedAt.IsZero() {
+		status.UpdatedAt = s.updatedAt.Local().Format(time.DateTime)
+	}
+	if !s.nextRefresh.IsZero() {
+		status.NextRefresh = s.nextRefresh.Local().Format(time.DateTime)
+	}
+	return status
+}
+
+// jitter 在d的基础上随机增减最多ratio比例的时间，避免所有证书同时查询
+func jitter(d time.Duration, ratio float64) time.Duration {
+	delta := time.Duration(float64(d) * ratio)
+	if delta <= 0 {
+		return d
+	}
+	return d - delta + rand.N(2*delta)
+}
+
+// ocspRefreshTime 在响应有效期过半时更新，没有NextUpdate时每小时更新
+func ocspRefreshTime(resp *ocsp.Response, now time.Time) time.Time {
+	if resp.NextUpdate.IsZero() {
+		return now.Add(jitter(time.Hour, 0.1))
+	}
+
+	window := resp.NextUpdate.Sub(resp.ThisUpdate)
+	refresh := resp.ThisUpdate.Add(jitter(window/2, 0.1))
+	if refresh.Before(now) {
+		return now.Add(jitter(time.Minute, 0.5))
+	}
+	return refresh
+}
+
+// ocspRetryTime 查询失败后按指数退避重试
+func ocspRetryTime(failures int, mustStaple bool, now time.Time) time.Time {
+	maxInterval := ocspMaxRetryInterval
+	if mustStaple {
+		maxInterval = ocspMaxRetryIntervalMustStaple
+	}
+	interval := min(time.Minute<<min(failures-1, 10), maxInterval)
+	return now.Add(jitter(interval, 0.2))
+}
+
+func ocspCacheFile(dir string, leaf *x509.Certificate) string {
+	sum := sha256.Sum256(leaf.Raw)
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".ocsp")
+}
+
+// loadOCSPCache 读取保存在磁盘上的响应，过期或者与证书不匹配时忽略
+func loadOCSPCache(dir string, leaf, issuer *x509.Certificate, now time.Time) (*ocsp.Response, []byte) {
+	if dir == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(ocspCacheFile(dir, leaf))
+	if err != nil {
+		return nil, nil
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil || (!resp.NextUpdate.IsZero() && now.After(resp.NextUpdate)) {
+		return nil, nil
+	}
+	return resp, raw
+}
+
+func saveOCSPCache(dir string, leaf *x509.Certificate, raw []byte) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp := ocspCacheFile(dir, leaf) + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ocspCacheFile(dir, leaf))
+}
+
+// issuerOf 证书链中的第二张证书是签发者，证书链不完整时无法查询OCSP
+func issuerOf(entry *certEntry) (*x509.Certificate, error) {
+	if len(entry.cert.Certificate) < 2 {
+		return nil, errors.New("issuer certificate not found, certificate chain is incomplete")
+	}
+	return x509.ParseCertificate(entry.cert.Certificate[1])
+}
+
+// timerStaple 定时更新OCSP响应
+func (l *lCert) timerStaple() {
+	l.staple()
+	timer := time.NewTicker(ocspCheckInterval)
+	for range timer.C {
+		l.staple()
+	}
+}
+
+// staple 为有OCSP地址的证书查询OCSP响应，结果写入证书的副本后替换证书库中的证书
+func (l *lCert) staple() {
+	l.stapleLock.Lock()
+	defer l.stapleLock.Unlock()
+
+	l.lock.RLock()
+	entries := make(map[string]*certEntry)
+	states := make(map[string]*ocspState)
+	for name, entry := range l.entries {
+		if entry.cert == nil || entry.cert.Leaf == nil || len(entry.cert.Leaf.OCSPServer) == 0 {
+			continue
+		}
+		entries[name] = entry
+		states[name] = l.ocsp[name]
+	}
+	cacheDir := l.ocspCacheDir
+	l.lock.RUnlock()
+
+	for name, entry := range entries {
+		now := time.Now()
+		leaf := entry.cert.Leaf
+		issuer, issuerErr := issuerOf(entry)
+
+		state := states[name]
+		if state == nil || !bytes.Equal(state.leaf, leaf.Raw) {
+			state = &ocspState{leaf: leaf.Raw, mustStaple: utils.MustStaple(leaf)}
+			if issuerErr == nil {
+				if resp, raw := loadOCSPCache(cacheDir, leaf, issuer, now); resp != nil {
+					state.resp, state.raw, state.source = resp, raw, "cache"
+					state.updatedAt = now
+					state.nextRefresh = ocspRefreshTime(resp, now)
+				}
+			}
+		}
+
+		if !now.Before(state.nextRefresh) {
+			next := *state
+			next.updatedAt = now
+
+			var (
+				resp      *ocsp.Response
+				responder string
+				err       = issuerErr
+			)
+			if err == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				resp, responder, err = utils.FetchOCSP(ctx, l.httpClient, leaf, issuer)
+				cancel()
+			}
+
+			if err == nil {
+				next.resp, next.raw, next.source, next.responder = resp, resp.Raw, "responder", responder
+				next.err, next.failures = nil, 0
+				next.nextRefresh = ocspRefreshTime(resp, now)
+				if resp.Status == ocsp.Good {
+					if err := saveOCSPCache(cacheDir, leaf, resp.Raw); err != nil {
+						next.err = err
+					}
+				}
+			} else {
+				// 失败时继续使用之前还在有效期内的响应
+				next.err = err
+				next.failures++
+				next.nextRefresh = ocspRetryTime(next.failures, next.mustStaple, now)
+			}
+			state = &next
+		}
+
+		staple := state.staple(now)
+		l.lock.Lock()
+		if l.entries[name] == entry {
+			l.ocsp[name] = state
+			if !bytes.Equal(entry.cert.OCSPStaple, staple) {
+				cert := *entry.cert
+				cert.OCSPStaple = staple
+				stapled := *entry
+				stapled.cert = &cert
+				l.entries[name] = &stapled
+			}
+		}
+		l.lock.Unlock()
+	}
+}
@@ -0,0 +1,298 @@
+package logic
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abxuz/go-vhostd/utils"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOcspRefreshTime(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		resp       *ocsp.Response
+		start, end time.Time
+	}{
+		// 有效期过半时更新
+		{"half window", &ocsp.Response{ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(7 * time.Hour)},
+			now.Add(-time.Hour + 216*time.Minute), now.Add(-time.Hour + 264*time.Minute)},
+		{"no next update", &ocsp.Response{ThisUpdate: now.Add(-time.Hour)},
+			now.Add(54 * time.Minute), now.Add(66 * time.Minute)},
+		// 已经过半时尽快更新
+		{"past half window", &ocsp.Response{ThisUpdate: now.Add(-10 * time.Hour), NextUpdate: now.Add(time.Hour)},
+			now.Add(30 * time.Second), now.Add(90 * time.Second)},
+	}
+	for _, tt := range tests {
+		for range 100 {
+			got := ocspRefreshTime(tt.resp, now)
+			if got.Before(tt.start) || got.After(tt.end) {
+				t.Errorf("%v: ocspRefreshTime = %v, want between %v and %v", tt.name, got, tt.start, tt.end)
+				break
+			}
+		}
+	}
+}
+
+func TestOcspRetryTime(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		failures   int
+		mustStaple bool
+		interval   time.Duration
+	}{
+		{1, false, time.Minute},
+		{2, false, 2 * time.Minute},
+		{4, false, 8 * time.Minute},
+		{7, false, time.Hour},
+		{100, false, time.Hour},
+		{1, true, time.Minute},
+		{3, true, 4 * time.Minute},
+		{4, true, 5 * time.Minute},
+		{100, true, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		start := now.Add(tt.interval * 8 / 10)
+		end := now.Add(tt.interval * 12 / 10)
+		for range 100 {
+			got := ocspRetryTime(tt.failures, tt.mustStaple, now)
+			if got.Before(start) || got.After(end) {
+				t.Errorf("ocspRetryTime(%v, %v) = %v, want %v±20%%", tt.failures, tt.mustStaple, got.Sub(now), tt.interval)
+				break
+			}
+		}
+	}
+}
+
+type testOCSP struct {
+	ca      *tls.Certificate
+	leaf    *x509.Certificate
+	leafKey crypto.Signer
+	server  *httptest.Server
+	// status 响应的证书状态，为-1时返回500
+	status   atomic.Int64
+	requests atomic.Int64
+}
+
+// newTestOCSP 生成带OCSP地址的证书和对应的OCSP服务器
+func newTestOCSP(t *testing.T) *testOCSP {
+	t.Helper()
+	o := &testOCSP{}
+	o.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.requests.Add(1)
+		status := int(o.status.Load())
+		if status < 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(o.response(t, status, time.Now().Add(-time.Hour), time.Now().Add(7*time.Hour)))
+	}))
+	t.Cleanup(o.server.Close)
+
+	var err error
+	o.ca, err = utils.GenerateCA("test ca", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(100),
+		Subject:      pkix.Name{CommonName: "ocsp.test"},
+		DNSNames:     []string{"ocsp.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		OCSPServer:   []string{o.server.URL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, o.ca.Leaf, key.Public(), o.ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.leafKey = key
+	return o
+}
+
+func (o *testOCSP) response(t *testing.T, status int, thisUpdate, nextUpdate time.Time) []byte {
+	t.Helper()
+	template := ocsp.Response{
+		Status:       status,
+		SerialNumber: o.leaf.SerialNumber,
+		ThisUpdate:   thisUpdate,
+		NextUpdate:   nextUpdate,
+	}
+	if status == ocsp.Revoked {
+		template.RevokedAt = thisUpdate
+	}
+	raw, err := ocsp.CreateResponse(o.ca.Leaf, o.ca.Leaf, template, o.ca.PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func (o *testOCSP) entry() *certEntry {
+	return &certEntry{cert: &tls.Certificate{
+		Certificate: [][]byte{o.leaf.Raw, o.ca.Leaf.Raw},
+		PrivateKey:  o.leafKey,
+		Leaf:        o.leaf,
+	}}
+}
+
+func TestOcspCache(t *testing.T) {
+	o := newTestOCSP(t)
+	dir := t.TempDir()
+	now := time.Now()
+
+	raw := o.response(t, ocsp.Good, now.Add(-time.Hour), now.Add(time.Hour))
+	if err := saveOCSPCache(dir, o.leaf, raw); err != nil {
+		t.Fatal(err)
+	}
+	resp, got := loadOCSPCache(dir, o.leaf, o.ca.Leaf, now)
+	if resp == nil || string(got) != string(raw) {
+		t.Fatalf("loadOCSPCache did not return the saved response")
+	}
+	if resp.Status != ocsp.Good || resp.SerialNumber.Cmp(o.leaf.SerialNumber) != 0 {
+		t.Errorf("loaded response status %v serial %v, want good %v", resp.Status, resp.SerialNumber, o.leaf.SerialNumber)
+	}
+
+	// 过期的响应被忽略
+	if resp, _ := loadOCSPCache(dir, o.leaf, o.ca.Leaf, now.Add(2*time.Hour)); resp != nil {
+		t.Errorf("loadOCSPCache returned an expired response")
+	}
+
+	// 其他证书没有缓存，签发者不匹配时忽略
+	other := newTestOCSP(t)
+	if resp, _ := loadOCSPCache(dir, other.leaf, other.ca.Leaf, now); resp != nil {
+		t.Errorf("loadOCSPCache returned a response for another certificate")
+	}
+	if resp, _ := loadOCSPCache(dir, o.leaf, other.ca.Leaf, now); resp != nil {
+		t.Errorf("loadOCSPCache returned a response signed by another issuer")
+	}
+
+	// 内容损坏时忽略
+	if err := os.WriteFile(ocspCacheFile(dir, o.leaf), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := loadOCSPCache(dir, o.leaf, o.ca.Leaf, now); resp != nil {
+		t.Errorf("loadOCSPCache returned a broken response")
+	}
+
+	// 没有缓存目录时不保存
+	if err := saveOCSPCache("", o.leaf, raw); err != nil {
+		t.Errorf("saveOCSPCache without dir: %v", err)
+	}
+	if resp, _ := loadOCSPCache("", o.leaf, o.ca.Leaf, now); resp != nil {
+		t.Errorf("loadOCSPCache without dir returned a response")
+	}
+}
+
+func newStapleCert(o *testOCSP, dir string) *lCert {
+	return &lCert{
+		entries:      map[string]*certEntry{"ocsp": o.entry()},
+		ocsp:         make(map[string]*ocspState),
+		httpClient:   http.DefaultClient,
+		ocspCacheDir: dir,
+	}
+}
+
+func TestCertStaple(t *testing.T) {
+	o := newTestOCSP(t)
+	o.status.Store(ocsp.Good)
+	dir := t.TempDir()
+
+	l := newStapleCert(o, dir)
+	l.staple()
+	cert := l.Get("ocsp")
+	if len(cert.OCSPStaple) == 0 {
+		t.Fatalf("no ocsp response stapled")
+	}
+	status := l.Status("ocsp").OCSP
+	if status.Status != "good" || status.Source != "responder" || status.Responder != o.server.URL || !status.Stapled {
+		t.Errorf("ocsp status = %+v, want good from responder", status)
+	}
+
+	// 还没到更新时间时不查询
+	l.staple()
+	if n := o.requests.Load(); n != 1 {
+		t.Errorf("%v ocsp requests before refresh time, want 1", n)
+	}
+	if l.Get("ocsp") != cert {
+		t.Errorf("cert replaced without ocsp change")
+	}
+
+	// 查询失败时继续使用之前的响应，按退避时间重试
+	o.status.Store(-1)
+	l.lock.Lock()
+	l.ocsp["ocsp"].nextRefresh = time.Time{}
+	l.lock.Unlock()
+	l.staple()
+	state := l.ocsp["ocsp"]
+	if state.err == nil || state.failures != 1 || state.nextRefresh.Before(time.Now().Add(40*time.Second)) {
+		t.Errorf("state after failure: err %v, failures %v, next refresh %v", state.err, state.failures, state.nextRefresh)
+	}
+	if len(l.Get("ocsp").OCSPStaple) == 0 {
+		t.Errorf("previous ocsp response not stapled after failure")
+	}
+
+	// 重启后从缓存加载，不需要查询
+	o.server.Close()
+	restarted := newStapleCert(o, dir)
+	restarted.staple()
+	status = restarted.Status("ocsp").OCSP
+	if status.Source != "cache" || !status.Stapled {
+		t.Errorf("ocsp status after restart = %+v, want stapled from cache", status)
+	}
+}
+
+func TestCertStapleRevoked(t *testing.T) {
+	o := newTestOCSP(t)
+	o.status.Store(ocsp.Revoked)
+	dir := t.TempDir()
+
+	l := newStapleCert(o, dir)
+	l.staple()
+	if len(l.Get("ocsp").OCSPStaple) != 0 {
+		t.Errorf("revoked ocsp response stapled")
+	}
+	if status := l.Status("ocsp").OCSP; status.Status != "revoked" || status.Stapled {
+		t.Errorf("ocsp status = %+v, want revoked and not stapled", status)
+	}
+	// 只缓存good响应
+	if _, err := os.Stat(ocspCacheFile(dir, o.leaf)); !os.IsNotExist(err) {
+		t.Errorf("revoked response cached: %v", err)
+	}
+}
+
+func TestCertStapleIncompleteChain(t *testing.T) {
+	o := newTestOCSP(t)
+	o.status.Store(ocsp.Good)
+
+	l := newStapleCert(o, "")
+	l.entries["ocsp"].cert.Certificate = l.entries["ocsp"].cert.Certificate[:1]
+	l.staple()
+	if n := o.requests.Load(); n != 0 {
+		t.Errorf("%v ocsp requests without issuer, want 0", n)
+	}
+	if status := l.Status("ocsp").OCSP; status.Status != "error" || status.Error == "" {
+		t.Errorf("ocsp status = %+v, want issuer not found error", status)
+	}
+}
@@ -2,20 +2,26 @@ package logic
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/abxuz/b-tools/bmap"
 	"github.com/abxuz/b-tools/bset"
 	"github.com/abxuz/b-tools/bstate"
 	"github.com/abxuz/go-vhostd/assets"
@@ -24,83 +30,282 @@ import (
 	"github.com/abxuz/go-vhostd/utils"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
-	"golang.org/x/crypto/ocsp"
-	"golang.org/x/sync/errgroup"
 )
 
 var (
 	ErrVhostNotFound = errors.New("vhost not found")
 	ErrCertNotFound  = errors.New("cert not found")
 
-	HttpTransport = &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   5 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			MinVersion:         tls.VersionTLS10,
-			CipherSuites: []uint16{
-				tls.TLS_RSA_WITH_RC4_128_SHA,
-				tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
-				tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
-				tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
-				tls.TLS_AES_128_GCM_SHA256,
-				tls.TLS_AES_256_GCM_SHA384,
-				tls.TLS_CHACHA20_POLY1305_SHA256,
-			},
-		},
+	ErrMisdirectedRequest = errors.New("misdirected request")
+	ErrTooEarly           = errors.New("too early")
+	ErrConnectUdpRequired = errors.New("connect-udp required")
+
+	clientCertHeaders = []string{
+		"X-Client-Verify",
+		"X-Client-Subject",
+		"X-Client-San",
+		"X-Client-Fingerprint",
 	}
-	Http3Transport = &http3.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		EnableDatagrams: true,
+
+	forwardedHeaders = []string{
+		"Forwarded",
+		"X-Forwarded-For",
+		"X-Forwarded-Host",
+		"X-Forwarded-Port",
+		"X-Forwarded-Proto",
+		"X-Real-IP",
 	}
+
+	// DefaultUpstreamTransport 没有配置upstream_tls的mapping使用，按系统根证书校验上游
+	DefaultUpstreamTransport = newUpstreamTransport(&tls.Config{})
 )
 
 type Mapping struct {
 	model.MappingCfg
-	Target           *url.URL
-	AddHeader        http.Header
-	BasicAuthEncoded *bset.SetString
+	Target               *url.URL
+	AddHeader            http.Header
+	BasicAuthEncoded     *bset.SetString
+	ProxyProtocolVersion int
+	// ClientAuth vhost开启了客户端证书校验，要求sni与host一致
+	ClientAuth bool
+	// EarlyData vhost接受0-RTT早期数据中的幂等请求
+	EarlyData bool
+	// Transport 按upstream_tls创建的上游Transport，为空时使用DefaultUpstreamTransport
+	Transport *utils.UpstreamTransport
+	// ConnectUdpAllow connect_udp允许访问的目标
+	ConnectUdpAllow       []*utils.TargetRule
+	ConnectUdpIdleTimeout time.Duration
+	// WebSocketIdleTimeout extended CONNECT转发websocket的空闲超时，为0时不限制
+	WebSocketIdleTimeout  time.Duration
+	WebSocketMaxFrameSize int64
+}
+
+func newUpstreamTransport(tlsConfig *tls.Config) *utils.UpstreamTransport {
+	return &utils.UpstreamTransport{
+		Http: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ForceAttemptHTTP2:     true,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       tlsConfig,
+		},
+		Http3: &http3.Transport{
+			TLSClientConfig: tlsConfig,
+			EnableDatagrams: true,
+		},
+		// 每个请求单独建立连接，保证PROXY protocol头部不会在不同客户端之间复用
+		ProxyProto: &http.Transport{
+			DialContext: utils.ProxyProtoDialContext((&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext),
+			DisableKeepAlives:     true,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       tlsConfig,
+		},
+	}
+}
+
+// newUpstreamTLSConfig 根据upstream_tls生成连接上游时的TLS配置
+func newUpstreamTLSConfig(cfg *model.UpstreamTLSCfg) *tls.Config {
+	c := &tls.Config{ServerName: cfg.ServerName}
+	switch cfg.Verify {
+	case "insecure":
+		c.InsecureSkipVerify = true
+	case "ca":
+		c.RootCAs, _ = cfg.GetCAPool()
+	}
+
+	c.MinVersion, _ = utils.ParseTLSVersion(cfg.MinVersion)
+	c.MaxVersion, _ = utils.ParseTLSVersion(cfg.MaxVersion)
+	// 显式允许TLS1.2以下版本时，说明上游是老旧服务，一并放开老旧的加密套件
+	if c.MinVersion != 0 && c.MinVersion < tls.VersionTLS12 {
+		c.CipherSuites = utils.LegacyCipherSuites
+	}
+
+	if cfg.Cert != "" {
+		name := cfg.Cert
+		c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := service.Cert.Get(name); cert != nil {
+				return cert, nil
+			}
+			// 不出示证书，由上游决定是否拒绝
+			return &tls.Certificate{}, nil
+		}
+	}
+	return c
+}
+
+type httpServer struct {
+	*http.Server
+	listen *model.ListenCfg
+
+	// plaintext 处理https端口上识别出来的明文http连接
+	plaintext *http.Server
+}
+
+func (s *httpServer) Close() error {
+	if s.plaintext != nil {
+		s.plaintext.Close()
+	}
+	return s.Server.Close()
+}
+
+// http3Server 使用自己创建的quic.Transport，http3.Server关闭时不会关闭Transport和udp连接，需要一起关闭
+type http3Server struct {
+	*http3.Server
+	transport *quic.Transport
+	listen    *model.Http3ListenCfg
+	allow0RTT bool
+}
+
+func (s *http3Server) Close() error {
+	err := s.Server.Close()
+	s.transport.Close()
+	s.transport.Conn.Close()
+	return err
+}
+
+// vhostTLSConfig 开启了session ticket密钥轮换时，在握手时按需更换密钥
+type vhostTLSConfig struct {
+	*tls.Config
+
+	ticketRotation time.Duration
+	ticketLock     sync.Mutex
+	ticketKeys     [][32]byte
+	ticketRotated  time.Time
+}
+
+func (c *vhostTLSConfig) rotateTicketKeys() {
+	if c.ticketRotation <= 0 {
+		return
+	}
+
+	c.ticketLock.Lock()
+	defer c.ticketLock.Unlock()
+	if !c.ticketRotated.IsZero() && time.Since(c.ticketRotated) < c.ticketRotation {
+		return
+	}
+
+	var key [32]byte
+	rand.Read(key[:])
+	// 保留上一个密钥，轮换前签发的ticket在一个周期内仍然可以恢复会话
+	c.ticketKeys = append([][32]byte{key}, c.ticketKeys...)
+	if len(c.ticketKeys) > 2 {
+		c.ticketKeys = c.ticketKeys[:2]
+	}
+	c.Config.SetSessionTicketKeys(c.ticketKeys)
+	c.ticketRotated = time.Now()
+}
+
+func (c *vhostTLSConfig) inheritTicketKeys(old *vhostTLSConfig) {
+	if old == nil || c.ticketRotation <= 0 {
+		return
+	}
+
+	old.ticketLock.Lock()
+	defer old.ticketLock.Unlock()
+	if len(old.ticketKeys) == 0 {
+		return
+	}
+	c.ticketKeys = slices.Clone(old.ticketKeys)
+	c.ticketRotated = old.ticketRotated
+	c.Config.SetSessionTicketKeys(c.ticketKeys)
+}
+
+// vhostCertificates 证书选择需要的数据，由Proxy.UpdateCerts更新，
+// 只记录证书名称，握手时再从证书库中取出当前使用的证书
+type vhostCertificates struct {
+	domains     map[string][]string
+	names       []string
+	defaultCert string
+	unknownSni  string
+	// fallback 没有配置default_cert时代替默认证书，为第一个vhost的证书
+	fallback []string
+}
+
+func newVhostCertificates() *vhostCertificates {
+	return &vhostCertificates{domains: make(map[string][]string)}
+}
+
+func (c *vhostCertificates) update(cfg model.DefaultCertCfg, names []string) {
+	clear(c.domains)
+	c.names = names
+	c.defaultCert = cfg.DefaultCert
+	c.unknownSni, _ = cfg.GetUnknownSni()
+	c.fallback = nil
+}
+
+// resolveCertNames 把internal替换为内置CA为该域名签发的证书名称
+func resolveCertNames(domain string, names []string) []string {
+	resolved := make([]string, 0, len(names))
+	for _, name := range names {
+		if name == model.InternalCert {
+			name = model.InternalCertName(domain)
+		}
+		resolved = append(resolved, name)
+	}
+	return resolved
+}
+
+func lookupCertificates(names []string) []*tls.Certificate {
+	list := make([]*tls.Certificate, 0, len(names))
+	for _, name := range names {
+		if cert := service.Cert.Get(name); cert != nil {
+			list = append(list, cert)
+		}
+	}
+	return list
+}
+
+// matchSAN 找出SAN包含该域名的所有证书，按配置中的顺序返回
+func (c *vhostCertificates) matchSAN(serverName string) []*tls.Certificate {
+	list := make([]*tls.Certificate, 0)
+	for _, cert := range lookupCertificates(c.names) {
+		if cert.Leaf != nil && cert.Leaf.VerifyHostname(serverName) == nil {
+			list = append(list, cert)
+		}
+	}
+	return list
 }
 
 type GetCertificateFunc = func(chi *tls.ClientHelloInfo) (*tls.Certificate, error)
+type GetConfigForClientFunc = func(chi *tls.ClientHelloInfo) (*tls.Config, error)
 
 type lProxy struct {
 	state *bstate.State[model.Cfg]
 
+	trustedProxyLock sync.RWMutex
+	trustedProxy     []netip.Prefix
+
+	passthroughLock sync.RWMutex
+	passthrough     *streamRoute
+
 	getHttpsCertificate GetCertificateFunc
 	getHttp3Certificate GetCertificateFunc
+	// selfSignedCert unknown_sni为self_signed时使用，首次用到时生成
+	selfSignedCert func() (*tls.Certificate, error)
+
+	getHttpsConfigForClient GetConfigForClientFunc
+	getHttp3ConfigForClient GetConfigForClientFunc
 
 	httpHandler  http.Handler
 	httpsHandler http.Handler
 	http3Handler http.Handler
 
-	httpServers  map[string]*http.Server
-	httpsServers map[string]*http.Server
-	http3Servers map[string]*http3.Server
+	httpServers  map[string]*httpServer
+	httpsServers map[string]*httpServer
+	http3Servers map[string]*http3Server
+
+	// altSvc 同时配置了http3 vhost的https vhost返回的Alt-Svc，只包含绑定成功的http3端口
+	altSvcLock    sync.RWMutex
+	altSvc        string
+	altSvcDomains *bset.Set[string]
 }
 
 func init() {
@@ -109,11 +314,27 @@ func init() {
 
 func (l *lProxy) Init() {
 	l.state = bstate.NewState[model.Cfg]()
+	l.selfSignedCert = sync.OnceValues(func() (*tls.Certificate, error) {
+		return utils.GenerateSelfSignedCert("vhostd default certificate")
+	})
+
+	l.state.Watch("Proxy.UpdateTrustedProxy", func(_, cfg model.Cfg) {
+		trustedProxy, _ := cfg.GetTrustedProxy()
+		l.trustedProxyLock.Lock()
+		l.trustedProxy = trustedProxy
+		l.trustedProxyLock.Unlock()
+	})
+
+	l.passthrough = &streamRoute{}
+	l.state.Watch("Proxy.UpdatePassthrough", func(_, cfg model.Cfg) {
+		l.passthroughLock.Lock()
+		l.passthrough = &streamRoute{sni: cfg.Https.Passthrough}
+		l.passthroughLock.Unlock()
+	})
 
 	var (
-		certs           = make(map[string]*tls.Certificate)
-		httpsCerts      = make(map[string]*tls.Certificate)
-		http3Certs      = make(map[string]*tls.Certificate)
+		httpsCerts      = newVhostCertificates()
+		http3Certs      = newVhostCertificates()
 		certsUpdateLock = new(sync.RWMutex)
 	)
 
@@ -121,28 +342,66 @@ func (l *lProxy) Init() {
 		certsUpdateLock.Lock()
 		defer certsUpdateLock.Unlock()
 
-		clear(certs)
-		clear(httpsCerts)
-		clear(http3Certs)
-
+		names := make([]string, 0, len(cfg.Cert))
 		for _, c := range cfg.Cert {
-			cert, _ := c.Certificate()
-			certs[c.Name] = cert
-			certs[""] = cert
+			names = append(names, c.Name)
 		}
-		for _, v := range cfg.Https.Vhost {
-			httpsCerts[v.Domain] = certs[v.Cert]
-			httpsCerts[""] = certs[v.Cert]
+
+		httpsCerts.update(cfg.Https.DefaultCertCfg, names)
+		for i, v := range cfg.Https.Vhost {
+			httpsCerts.domains[v.Domain] = resolveCertNames(v.Domain, v.GetCerts())
+			if i == 0 {
+				httpsCerts.fallback = httpsCerts.domains[v.Domain]
+			}
 		}
-		for _, v := range cfg.Http3.Vhost {
-			http3Certs[v.Domain] = certs[v.Cert]
-			http3Certs[""] = certs[v.Cert]
+		http3Certs.update(cfg.Http3.DefaultCertCfg, names)
+		for i, v := range cfg.Http3.Vhost {
+			http3Certs.domains[v.Domain] = resolveCertNames(v.Domain, v.GetCerts())
+			if i == 0 {
+				http3Certs.fallback = http3Certs.domains[v.Domain]
+			}
 		}
 	})
 
 	l.getHttpsCertificate = l.newGetCertificateFunc(certsUpdateLock, httpsCerts)
 	l.getHttp3Certificate = l.newGetCertificateFunc(certsUpdateLock, http3Certs)
-	go l.timerUpdateOCSP(certsUpdateLock, certs)
+
+	var (
+		httpsTLSConfigs      = make(map[string]*vhostTLSConfig)
+		http3TLSConfigs      = make(map[string]*vhostTLSConfig)
+		tlsConfigsUpdateLock = new(sync.RWMutex)
+	)
+
+	l.state.Watch("Proxy.UpdateTLSConfig", func(_, cfg model.Cfg) {
+		tlsConfigsUpdateLock.Lock()
+		defer tlsConfigsUpdateLock.Unlock()
+
+		oldHttpsTLSConfigs := maps.Clone(httpsTLSConfigs)
+		oldHttp3TLSConfigs := maps.Clone(http3TLSConfigs)
+		clear(httpsTLSConfigs)
+		clear(http3TLSConfigs)
+
+		// 空字符串对应没有匹配到vhost时使用的全局配置
+		httpsTLSConfigs[""] = l.newVhostTLSConfig(l.getHttpsCertificate, cfg.Https.TLS, nil)
+		for _, v := range cfg.Https.Vhost {
+			httpsTLSConfigs[v.Domain] = l.newVhostTLSConfig(l.getHttpsCertificate, cfg.Https.TLS.Merge(v.TLS), v.ClientAuth)
+		}
+		http3TLSConfigs[""] = l.newVhostTLSConfig(l.getHttp3Certificate, cfg.Http3.TLS, nil)
+		for _, v := range cfg.Http3.Vhost {
+			http3TLSConfigs[v.Domain] = l.newVhostTLSConfig(l.getHttp3Certificate, cfg.Http3.TLS.Merge(v.TLS), v.ClientAuth)
+		}
+
+		// 沿用之前的ticket密钥，避免每次修改配置都让已有的会话失效
+		for domain, c := range httpsTLSConfigs {
+			c.inheritTicketKeys(oldHttpsTLSConfigs[domain])
+		}
+		for domain, c := range http3TLSConfigs {
+			c.inheritTicketKeys(oldHttp3TLSConfigs[domain])
+		}
+	})
+
+	l.getHttpsConfigForClient = l.newGetConfigForClientFunc(tlsConfigsUpdateLock, httpsTLSConfigs)
+	l.getHttp3ConfigForClient = l.newGetConfigForClientFunc(tlsConfigsUpdateLock, http3TLSConfigs)
 
 	var (
 		httpLock   = new(sync.RWMutex)
@@ -153,7 +412,23 @@ func (l *lProxy) Init() {
 		http3Vhost = make(map[string][]*Mapping)
 	)
 
+	upstreamTransports := make(map[model.UpstreamTLSCfg]*utils.UpstreamTransport)
 	l.state.Watch("Proxy.UpdateVhost", func(_, cfg model.Cfg) {
+		// 相同upstream_tls的mapping共用Transport，ca等配置可能有变化，每次都重新创建
+		oldTransports := upstreamTransports
+		upstreamTransports = make(map[model.UpstreamTLSCfg]*utils.UpstreamTransport)
+		getTransport := func(m *model.MappingCfg) *utils.UpstreamTransport {
+			if m.UpstreamTLS == nil {
+				return nil
+			}
+			t, ok := upstreamTransports[*m.UpstreamTLS]
+			if !ok {
+				t = newUpstreamTransport(newUpstreamTLSConfig(m.UpstreamTLS))
+				upstreamTransports[*m.UpstreamTLS] = t
+			}
+			return t
+		}
+
 		httpLock.Lock()
 		clear(httpVhost)
 		for _, vhost := range cfg.Http.Vhost {
@@ -164,6 +439,8 @@ func (l *lProxy) Init() {
 				mapping.Target, _ = m.GetTarget()
 				mapping.AddHeader, _ = m.GetAddHeader()
 				mapping.BasicAuthEncoded, _ = m.GetBasicAuthEncoded()
+				mapping.ProxyProtocolVersion, _ = m.GetProxyProtocolVersion()
+				mapping.Transport = getTransport(m)
 				mappings = append(mappings, mapping)
 			}
 			httpVhost[vhost.Domain] = mappings
@@ -180,6 +457,13 @@ func (l *lProxy) Init() {
 				mapping.Target, _ = m.GetTarget()
 				mapping.AddHeader, _ = m.GetAddHeader()
 				mapping.BasicAuthEncoded, _ = m.GetBasicAuthEncoded()
+				mapping.ProxyProtocolVersion, _ = m.GetProxyProtocolVersion()
+				mapping.Transport = getTransport(m)
+				mapping.ClientAuth = l.clientAuthEnabled(vhost.ClientAuth)
+				if m.WebSocket != nil {
+					mapping.WebSocketIdleTimeout, _ = m.WebSocket.GetIdleTimeout()
+					mapping.WebSocketMaxFrameSize = m.WebSocket.MaxFrameSize
+				}
 				mappings = append(mappings, mapping)
 			}
 			httpsVhost[vhost.Domain] = mappings
@@ -196,21 +480,37 @@ func (l *lProxy) Init() {
 				mapping.Target, _ = m.GetTarget()
 				mapping.AddHeader, _ = m.GetAddHeader()
 				mapping.BasicAuthEncoded, _ = m.GetBasicAuthEncoded()
+				mapping.ProxyProtocolVersion, _ = m.GetProxyProtocolVersion()
+				mapping.Transport = getTransport(m)
+				mapping.ClientAuth = l.clientAuthEnabled(vhost.ClientAuth)
+				mapping.EarlyData = vhost.EarlyData
+				if m.ConnectUdp != nil {
+					mapping.ConnectUdpAllow, _ = m.ConnectUdp.GetAllow()
+					mapping.ConnectUdpIdleTimeout, _ = m.ConnectUdp.GetIdleTimeout()
+				}
+				if m.WebSocket != nil {
+					mapping.WebSocketIdleTimeout, _ = m.WebSocket.GetIdleTimeout()
+					mapping.WebSocketMaxFrameSize = m.WebSocket.MaxFrameSize
+				}
 				mappings = append(mappings, mapping)
 			}
 			http3Vhost[vhost.Domain] = mappings
 		}
 		http3Lock.Unlock()
 
+		for _, t := range oldTransports {
+			t.CloseIdleConnections()
+		}
 	})
 
 	l.httpHandler = l.newReverseProxy(httpLock, httpVhost)
-	l.httpsHandler = l.newReverseProxy(httpsLock, httpsVhost)
+	l.httpsHandler = l.newAltSvcHandler(l.newReverseProxy(httpsLock, httpsVhost))
 	l.http3Handler = l.newReverseProxy(http3Lock, http3Vhost)
 
-	l.httpServers = make(map[string]*http.Server)
-	l.httpsServers = make(map[string]*http.Server)
-	l.http3Servers = make(map[string]*http3.Server)
+	l.httpServers = make(map[string]*httpServer)
+	l.httpsServers = make(map[string]*httpServer)
+	l.http3Servers = make(map[string]*http3Server)
+	l.altSvcDomains = bset.New[string]()
 }
 
 func (l *lProxy) Reload(cfg model.Cfg) {
@@ -221,76 +521,279 @@ func (l *lProxy) Reload(cfg model.Cfg) {
 }
 
 func (l *lProxy) reloadHttpServer(cfg *model.HttpCfg) {
-	listen := bset.New(cfg.Listen...)
+	listen := bmap.NewMapFromSlice(cfg.Listen, func(c *model.ListenCfg) string { return c.Addr })
 	for k, server := range l.httpServers {
-		if listen.Has(k) {
-			listen.Remove(k)
+		if c, ok := listen[k]; ok && c.Equal(server.listen) {
+			delete(listen, k)
 			continue
 		}
 		server.Close()
 		delete(l.httpServers, k)
 	}
 
-	listen.Range(func(k string) bool {
-		server := &http.Server{
-			Addr:     k,
-			Handler:  l.httpHandler,
-			ErrorLog: log.New(io.Discard, "", log.LstdFlags),
+	for k, c := range listen {
+		server := &httpServer{
+			Server: &http.Server{
+				Addr:        k,
+				Handler:     l.httpHandler,
+				ErrorLog:    log.New(io.Discard, "", log.LstdFlags),
+				ConnContext: utils.WithProxyProtoConn,
+			},
+			listen: c,
 		}
-		go server.ListenAndServe()
+		go func() {
+			ln, err := newListener(c)
+			if err != nil {
+				return
+			}
+			server.Serve(ln)
+		}()
 		l.httpServers[k] = server
-		return true
-	})
+	}
 }
 
 func (l *lProxy) reloadHttpsServer(cfg *model.HttpsCfg) {
-	listen := bset.New(cfg.Listen...)
+	listen := bmap.NewMapFromSlice(cfg.Listen, func(c *model.ListenCfg) string { return c.Addr })
 	for k, server := range l.httpsServers {
-		if listen.Has(k) {
-			listen.Remove(k)
+		if c, ok := listen[k]; ok && c.Equal(server.listen) {
+			delete(listen, k)
 			continue
 		}
 		server.Close()
 		delete(l.httpsServers, k)
 	}
 
-	listen.Range(func(k string) bool {
-		server := &http.Server{
-			Addr:      k,
-			Handler:   l.httpsHandler,
-			ErrorLog:  log.New(io.Discard, "", log.LstdFlags),
-			TLSConfig: &tls.Config{GetCertificate: l.getHttpsCertificate},
+	for k, c := range listen {
+		server := &httpServer{
+			Server: &http.Server{
+				Addr:     k,
+				Handler:  l.httpsHandler,
+				ErrorLog: log.New(io.Discard, "", log.LstdFlags),
+				TLSConfig: &tls.Config{
+					GetCertificate:     l.getHttpsCertificate,
+					GetConfigForClient: l.getHttpsConfigForClient,
+				},
+				ConnContext: utils.WithProxyProtoConn,
+			},
+			listen: c,
 		}
-		go server.ListenAndServeTLS("", "")
+		if c.Plaintext != "" {
+			server.plaintext = &http.Server{
+				Addr:        k,
+				Handler:     l.plaintextHandler(c.Plaintext),
+				ErrorLog:    log.New(io.Discard, "", log.LstdFlags),
+				ConnContext: utils.WithProxyProtoConn,
+			}
+		}
+		go func() {
+			ln, err := newListener(c)
+			if err != nil {
+				return
+			}
+
+			var plaintext *utils.ConnListener
+			if server.plaintext != nil {
+				plaintext = utils.NewConnListener(ln.Addr())
+				go server.plaintext.Serve(plaintext)
+			}
+
+			dispatch := func(conn net.Conn) net.Conn {
+				return l.dispatchHttps(conn, plaintext)
+			}
+			server.ServeTLS(utils.NewDispatchListener(ln, dispatch), "", "")
+		}()
 		l.httpsServers[k] = server
-		return true
+	}
+}
+
+// dispatchHttps 明文http连接交给plaintext，匹配passthrough规则的连接直接转发给后端，
+// 其余的交给https server处理
+func (l *lProxy) dispatchHttps(conn net.Conn, plaintext *utils.ConnListener) net.Conn {
+	if plaintext != nil {
+		first := make([]byte, 1)
+		conn.SetReadDeadline(time.Now().Add(streamHandshakeTimeout))
+		_, err := io.ReadFull(conn, first)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil
+		}
+
+		// TLS连接的第一个字节一定是handshake类型的record
+		conn = utils.NewPrefixConn(conn, first)
+		if first[0] != 0x16 {
+			plaintext.Push(conn)
+			return nil
+		}
+	}
+
+	l.passthroughLock.RLock()
+	route := l.passthrough
+	l.passthroughLock.RUnlock()
+	if len(route.sni) == 0 {
+		return conn
+	}
+
+	conn.SetReadDeadline(time.Now().Add(streamHandshakeTimeout))
+	hello, peeked, _ := utils.PeekClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+	conn = utils.NewPrefixConn(conn, peeked)
+	if hello == nil {
+		return conn
+	}
+
+	target := route.match(hello.ServerName)
+	if target == "" {
+		return conn
+	}
+
+	upstream, err := StreamDialer.Dial("tcp", target)
+	if err != nil {
+		conn.Close()
+		return nil
+	}
+	utils.Pipe(conn, upstream)
+	return nil
+}
+
+func (l *lProxy) plaintextHandler(mode string) http.Handler {
+	if mode == "http" {
+		return l.httpHandler
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		u := *req.URL
+		u.Scheme = "https"
+		u.Host = req.Host
+		http.Redirect(resp, req, u.String(), http.StatusMovedPermanently)
 	})
 }
+
+func newListener(cfg *model.ListenCfg) (net.Listener, error) {
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ProxyProtocol == nil {
+		return ln, nil
+	}
+
+	allow, _ := cfg.ProxyProtocol.GetAllow()
+	return &utils.ProxyProtoListener{
+		Listener: ln,
+		Allow:    allow,
+	}, nil
+}
+
 func (l *lProxy) reloadHttp3Server(cfg *model.Http3Cfg) {
-	listen := bset.New(cfg.Listen...)
+	listen := bmap.NewMapFromSlice(cfg.Listen, func(c *model.Http3ListenCfg) string { return c.Addr })
+	allow0RTT := cfg.EarlyDataEnabled()
 	for k, server := range l.http3Servers {
-		if listen.Has(k) {
-			listen.Remove(k)
+		if c, ok := listen[k]; ok && c.Equal(server.listen) && server.allow0RTT == allow0RTT {
+			delete(listen, k)
 			continue
 		}
 		server.Close()
 		delete(l.http3Servers, k)
 	}
 
-	listen.Range(func(k string) bool {
-		server := &http3.Server{
-			Addr:            k,
-			Handler:         l.http3Handler,
-			TLSConfig:       &tls.Config{GetCertificate: l.getHttp3Certificate},
-			EnableDatagrams: true,
-			QUICConfig: &quic.Config{
+	for k, c := range listen {
+		conn, err := net.ListenPacket("udp", k)
+		if err != nil {
+			// 绑定失败的端口不通告Alt-Svc，下次重新加载配置时重试
+			continue
+		}
+
+		transport := &quic.Transport{Conn: conn}
+		if retry, _ := c.GetRetry(); retry == "always" {
+			transport.VerifySourceAddress = func(net.Addr) bool { return true }
+		}
+		tlsConfig := http3.ConfigureTLSConfig(&tls.Config{
+			GetCertificate:     l.getHttp3Certificate,
+			GetConfigForClient: l.getHttp3ConfigForClient,
+		})
+		ln, err := transport.ListenEarly(tlsConfig, newQUICConfig(c, allow0RTT))
+		if err != nil {
+			transport.Close()
+			conn.Close()
+			continue
+		}
+
+		server := &http3Server{
+			Server: &http3.Server{
+				Addr:            k,
+				Handler:         l.http3Handler,
 				EnableDatagrams: true,
-				Allow0RTT:       true,
+				ConnContext:     utils.WithQUICConn,
 			},
+			transport: transport,
+			listen:    c,
+			allow0RTT: allow0RTT,
 		}
-		go server.ListenAndServe()
+		go server.ServeListener(ln)
 		l.http3Servers[k] = server
-		return true
+	}
+
+	l.updateAltSvc(cfg)
+}
+
+// newQUICConfig 监听地址没有配置的参数保持为0，由quic-go使用默认值
+func newQUICConfig(c *model.Http3ListenCfg, allow0RTT bool) *quic.Config {
+	idle, _ := c.GetMaxIdleTimeout()
+	keepAlive, _ := c.GetKeepAlivePeriod()
+	return &quic.Config{
+		MaxIdleTimeout:                 idle,
+		KeepAlivePeriod:                keepAlive,
+		MaxIncomingStreams:             c.MaxIncomingStreams,
+		InitialStreamReceiveWindow:     c.InitialStreamWindow,
+		MaxStreamReceiveWindow:         c.MaxStreamWindow,
+		InitialConnectionReceiveWindow: c.InitialConnectionWindow,
+		MaxConnectionReceiveWindow:     c.MaxConnectionWindow,
+		DisablePathMTUDiscovery:        c.DisablePathMTUDiscovery,
+		EnableDatagrams:                true,
+		Allow0RTT:                      allow0RTT,
+	}
+}
+
+// updateAltSvc 按绑定成功的http3端口生成Alt-Svc，多个地址使用同一端口时只通告一次
+func (l *lProxy) updateAltSvc(cfg *model.Http3Cfg) {
+	ports := make([]int, 0)
+	for _, server := range l.http3Servers {
+		addr, ok := server.transport.Conn.LocalAddr().(*net.UDPAddr)
+		if ok && !slices.Contains(ports, addr.Port) {
+			ports = append(ports, addr.Port)
+		}
+	}
+	slices.Sort(ports)
+
+	values := make([]string, 0, len(ports))
+	maxAge := cfg.GetAltSvcMaxAge()
+	if maxAge > 0 {
+		for _, port := range ports {
+			values = append(values, fmt.Sprintf(`h3=":%v"; ma=%v`, port, maxAge))
+		}
+	}
+
+	domains := bset.New[string]()
+	for _, v := range cfg.Vhost {
+		domains.Set(v.Domain)
+	}
+
+	l.altSvcLock.Lock()
+	l.altSvc = strings.Join(values, ", ")
+	l.altSvcDomains = domains
+	l.altSvcLock.Unlock()
+}
+
+// newAltSvcHandler 为同时配置了http3 vhost的域名添加Alt-Svc，上游返回的Alt-Svc会一起发送
+func (l *lProxy) newAltSvcHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		l.altSvcLock.RLock()
+		altSvc, ok := l.altSvc, l.altSvcDomains.Has(l.hostname(req))
+		l.altSvcLock.RUnlock()
+		if ok && altSvc != "" {
+			resp.Header().Set("Alt-Svc", altSvc)
+		}
+		next.ServeHTTP(resp, req)
 	})
 }
 
@@ -300,187 +803,150 @@ func (l *lProxy) errorHandler(resp http.ResponseWriter, req *http.Request, err e
 		resp.Write(assets.HtmlContentForbidden)
 		return
 	}
+	if err == ErrMisdirectedRequest {
+		resp.WriteHeader(http.StatusMisdirectedRequest)
+		return
+	}
+	if err == ErrTooEarly {
+		resp.WriteHeader(http.StatusTooEarly)
+		return
+	}
+	if err == ErrConnectUdpRequired {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	resp.WriteHeader(http.StatusBadGateway)
 }
 
-func (l *lProxy) newGetCertificateFunc(lock *sync.RWMutex, certs map[string]*tls.Certificate) GetCertificateFunc {
-	return func(sni *tls.ClientHelloInfo) (*tls.Certificate, error) {
+// newGetCertificateFunc 依次按vhost域名、证书SAN查找证书，都没有时按unknown_sni处理，
+// 找到多张证书时选择第一张客户端支持其签名算法和加密套件的证书
+func (l *lProxy) newGetCertificateFunc(lock *sync.RWMutex, certs *vhostCertificates) GetCertificateFunc {
+	return func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		lock.RLock()
-		cert, ok := certs[sni.ServerName]
+		var list []*tls.Certificate
+		if names, ok := certs.domains[chi.ServerName]; ok {
+			list = lookupCertificates(names)
+		} else if chi.ServerName != "" {
+			list = certs.matchSAN(chi.ServerName)
+		}
+		defaultCert, unknownSni := service.Cert.Get(certs.defaultCert), certs.unknownSni
+		var fallback []string
+		if certs.defaultCert == "" {
+			fallback = certs.fallback
+		}
 		lock.RUnlock()
-		if !ok {
-			return nil, ErrCertNotFound
+
+		if len(list) > 0 {
+			return l.selectCertificate(chi, list), nil
 		}
-		return cert, nil
+
+		switch unknownSni {
+		case "default":
+			if defaultCert != nil {
+				return defaultCert, nil
+			}
+			if list := lookupCertificates(fallback); len(list) > 0 {
+				return l.selectCertificate(chi, list), nil
+			}
+		case "self_signed":
+			return l.selfSignedCert()
+		}
+		return nil, ErrCertNotFound
 	}
 }
 
-func (l *lProxy) timerUpdateOCSP(lock *sync.RWMutex, certs map[string]*tls.Certificate) {
-	httpClient := http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   3 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
-		Timeout: 3 * time.Second,
+func (l *lProxy) selectCertificate(chi *tls.ClientHelloInfo, list []*tls.Certificate) *tls.Certificate {
+	for _, cert := range list {
+		if cert != nil && chi.SupportsCertificate(cert) == nil {
+			return cert
+		}
 	}
+	// 都不支持时交给握手流程报错，客户端能看到明确的失败原因
+	return list[0]
+}
 
-	type OCSPRequest struct {
-		leaf   *x509.Certificate
-		issuer *x509.Certificate
+func (l *lProxy) newGetConfigForClientFunc(lock *sync.RWMutex, configs map[string]*vhostTLSConfig) GetConfigForClientFunc {
+	return func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+		lock.RLock()
+		config, ok := configs[chi.ServerName]
+		if !ok {
+			config = configs[""]
+		}
+		lock.RUnlock()
+		if config == nil {
+			return nil, nil
+		}
+		config.rotateTicketKeys()
+		return config.Config, nil
 	}
+}
 
-	timer := time.NewTicker(time.Minute)
-	for range timer.C {
-
-		requests := make(map[string]OCSPRequest)
-
-		func() {
-			lock.RLock()
-			defer lock.RUnlock()
-
-			for key, cert := range certs {
-				if len(cert.Certificate) < 2 {
-					continue
-				}
-
-				if len(cert.Leaf.OCSPServer) == 0 {
-					continue
-				}
-
-				issuer, _ := x509.ParseCertificate(cert.Certificate[1])
-				if cert.OCSPStaple == nil {
-					requests[key] = OCSPRequest{
-						leaf:   cert.Leaf,
-						issuer: issuer,
-					}
-					continue
-				}
+func (l *lProxy) clientAuthEnabled(cfg *model.ClientAuthCfg) bool {
+	if cfg == nil {
+		return false
+	}
+	mode, _ := cfg.GetClientAuthType()
+	return mode != tls.NoClientCert
+}
 
-				resp, err := ocsp.ParseResponse(cert.OCSPStaple, issuer)
-				if err != nil || resp.Status != ocsp.Good {
-					requests[key] = OCSPRequest{
-						leaf:   cert.Leaf,
-						issuer: issuer,
-					}
-					continue
-				}
+// newVhostTLSConfig 按TLS策略和客户端证书配置生成vhost专用的tls配置
+func (l *lProxy) newVhostTLSConfig(getCertificate GetCertificateFunc, policy *model.TLSCfg, clientAuth *model.ClientAuthCfg) *vhostTLSConfig {
+	if policy == nil {
+		policy = &model.TLSCfg{}
+	}
 
-				if time.Until(resp.NextUpdate) < 10*time.Minute {
-					requests[key] = OCSPRequest{
-						leaf:   cert.Leaf,
-						issuer: issuer,
-					}
-				}
-			}
-		}()
+	config := &tls.Config{
+		GetCertificate: getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	config.MinVersion, config.MaxVersion, _ = policy.GetVersion()
+	config.CipherSuites, _ = policy.GetCipherSuites()
+	config.CurvePreferences, _ = policy.GetCurves()
+	if len(policy.ALPN) > 0 {
+		config.NextProtos = policy.ALPN
+	}
+	config.SessionTicketsDisabled = !policy.SessionTicketEnabled()
 
-		if len(requests) == 0 {
-			continue
-		}
-		responses := make(map[string]*ocsp.Response)
-
-		func() {
-			eg := &errgroup.Group{}
-			eg.SetLimit(10)
-			responsesLock := new(sync.Mutex)
-			for key, request := range requests {
-				eg.Go(func() error {
-					der, err := ocsp.CreateRequest(request.leaf, request.issuer, nil)
-					if err != nil {
-						return err
-					}
-
-					uri := request.leaf.OCSPServer[0] + "/" + base64.StdEncoding.EncodeToString(der)
-					httpRequest, err := http.NewRequest(http.MethodGet, uri, nil)
-					if err != nil {
-						return err
-					}
-					httpRequest.Header.Add("Content-Language", "application/ocsp-request")
-					httpRequest.Header.Add("Accept", "application/ocsp-response")
-					httpResponse, err := httpClient.Do(httpRequest)
-					if err != nil {
-						return err
-					}
-					defer httpResponse.Body.Close()
-					der, err = io.ReadAll(httpResponse.Body)
-					if err != nil {
-						return err
-					}
-
-					response, err := ocsp.ParseResponse(der, request.issuer)
-					if err != nil {
-						return err
-					}
-
-					if response.Status == ocsp.Good {
-						responsesLock.Lock()
-						responses[key] = response
-						responsesLock.Unlock()
-					}
-					return nil
-				})
+	if l.clientAuthEnabled(clientAuth) {
+		config.ClientAuth, _ = clientAuth.GetClientAuthType()
+		config.ClientCAs, _ = clientAuth.GetCAPool()
+		crls, _ := clientAuth.GetCRL()
+		if len(crls) > 0 {
+			config.VerifyConnection = func(cs tls.ConnectionState) error {
+				return utils.CheckRevocation(cs.VerifiedChains, crls)
 			}
-
-			eg.Wait()
-		}()
-
-		if len(responses) == 0 {
-			continue
 		}
+	}
 
-		func() {
-			lock.Lock()
-			defer lock.Unlock()
-
-			for key, response := range responses {
-				cert, ok := certs[key]
-				if !ok {
-					continue
-				}
-				cert.OCSPStaple = response.Raw
-			}
-		}()
+	c := &vhostTLSConfig{Config: config}
+	if !config.SessionTicketsDisabled {
+		c.ticketRotation, _ = policy.GetSessionTicketRotation()
 	}
+	return c
 }
 
 func (l *lProxy) newReverseProxy(lock *sync.RWMutex, mappings map[string][]*Mapping) http.Handler {
 	director := func(req *http.Request) (*http.Response, http.Header, error) {
-		lock.RLock()
-		mapping, ok := mappings[l.hostname(req)]
-		lock.RUnlock()
-		if !ok {
-			return nil, nil, ErrVhostNotFound
+		t, err := l.matchMapping(lock, mappings, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		// connect_udp的mapping没有上游，只接受connect-udp请求
+		if t.ConnectUdp != nil {
+			return nil, nil, ErrConnectUdpRequired
 		}
+		l.setClientCertHeader(req)
 
-		var t *Mapping
-		for _, m := range mapping {
-			if strings.HasPrefix(req.URL.Path, m.Path) {
-				t = m
-				break
+		// RFC 8470 早期数据可能被重放，只转发开启了0-RTT的vhost中的幂等请求
+		if utils.IsEarlyData(req) {
+			if !t.EarlyData || !utils.IsIdempotent(req.Method) {
+				return nil, nil, ErrTooEarly
 			}
-		}
-		if t == nil {
-			return nil, nil, ErrVhostNotFound
+			req.Header.Set("Early-Data", "1")
 		}
 
 		if t.BasicAuthEncoded.Size() > 0 {
-			ok := func() bool {
-				auth := req.Header.Get("Authorization")
-				if len(auth) < 7 {
-					return false
-				}
-				return t.BasicAuthEncoded.Has(auth[6:])
-			}()
-
-			if !ok {
+			if !t.checkBasicAuth(req.Header.Get("Authorization")) {
 				header := make(http.Header)
 				header.Set("WWW-Authenticate", "Basic realm=Authorization Required")
 				resp := &http.Response{
@@ -530,11 +996,17 @@ func (l *lProxy) newReverseProxy(lock *sync.RWMutex, mappings map[string][]*Mapp
 			req.URL.Path = t.Target.Path + req.URL.Path[len(t.Path):]
 		}
 
-		if t.ProxyHeader {
-			req.Header.Set("X-Forwarded-Proto", l.scheme(req))
-		} else {
+		if t.Transport != nil {
+			*req = *req.WithContext(utils.WithUpstreamTransport(req.Context(), t.Transport))
+		}
+		if t.ProxyProtocolVersion != 0 {
+			header := l.upstreamProxyProtoHeader(req, t.ProxyProtocolVersion)
+			*req = *req.WithContext(utils.WithUpstreamProxyProto(req.Context(), header))
+		}
+
+		l.setForwardedHeader(req, t.ProxyHeader)
+		if !t.ProxyHeader {
 			req.Host = req.URL.Host
-			req.Header.Del("X-Forwarded-For")
 			if t.BasicAuthEncoded.Size() > 0 {
 				req.Header.Del("Authorization")
 			}
@@ -542,16 +1014,100 @@ func (l *lProxy) newReverseProxy(lock *sync.RWMutex, mappings map[string][]*Mapp
 		return nil, t.AddHeader, nil
 	}
 
-	return &httputil.ReverseProxy{
-		Director: func(*http.Request) {},
-		Transport: &utils.ReverseProxyTransport{
-			Director:       director,
-			HttpTransport:  HttpTransport,
-			Http3Transport: Http3Transport,
+	transport := &utils.ReverseProxyTransport{
+		Director:  director,
+		Transport: DefaultUpstreamTransport,
+	}
+	proxy := &httputil.ReverseProxy{
+		// 转发相关的头部由director根据可信代理列表统一处理，
+		// 这里先原样带上客户端传来的值
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			for _, k := range forwardedHeaders {
+				if v, ok := pr.In.Header[k]; ok {
+					pr.Out.Header[k] = v
+				}
+			}
 		},
+		Transport:    transport,
 		ErrorLog:     log.New(io.Discard, "", log.LstdFlags),
 		ErrorHandler: l.errorHandler,
 	}
+
+	// extended CONNECT请求没有办法通过ReverseProxy转发，单独处理
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch utils.ExtendedConnectProtocol(req) {
+		case "websocket":
+			l.serveWebSocket(lock, mappings, transport, resp, req)
+		case "connect-udp":
+			l.serveConnectUdp(lock, mappings, resp, req)
+		default:
+			proxy.ServeHTTP(resp, req)
+		}
+	})
+}
+
+// matchMapping 按host和path前缀查找mapping
+func (l *lProxy) matchMapping(lock *sync.RWMutex, mappings map[string][]*Mapping, req *http.Request) (*Mapping, error) {
+	lock.RLock()
+	mapping, ok := mappings[l.hostname(req)]
+	lock.RUnlock()
+	if !ok {
+		return nil, ErrVhostNotFound
+	}
+
+	var t *Mapping
+	for _, m := range mapping {
+		if strings.HasPrefix(req.URL.Path, m.Path) {
+			t = m
+			break
+		}
+	}
+	if t == nil {
+		return nil, ErrVhostNotFound
+	}
+
+	// 客户端证书是按sni校验的，host与sni不一致时不能信任校验结果
+	if t.ClientAuth && (req.TLS == nil || !strings.EqualFold(req.TLS.ServerName, l.hostname(req))) {
+		return nil, ErrMisdirectedRequest
+	}
+	return t, nil
+}
+
+// checkBasicAuth 校验Authorization或Proxy-Authorization头部中的Basic认证信息
+func (m *Mapping) checkBasicAuth(auth string) bool {
+	if len(auth) < 7 || !strings.EqualFold(auth[:6], "Basic ") {
+		return false
+	}
+	return m.BasicAuthEncoded.Has(auth[6:])
+}
+
+// setClientCertHeader 把校验通过的客户端证书信息转发给上游，客户端自带的同名头部一律删除
+func (l *lProxy) setClientCertHeader(req *http.Request) {
+	for _, k := range clientCertHeaders {
+		req.Header.Del(k)
+	}
+
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		req.Header.Set("X-Client-Verify", "NONE")
+		return
+	}
+
+	leaf := req.TLS.VerifiedChains[0][0]
+	san := make([]string, 0)
+	san = append(san, leaf.DNSNames...)
+	san = append(san, leaf.EmailAddresses...)
+	for _, ip := range leaf.IPAddresses {
+		san = append(san, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		san = append(san, uri.String())
+	}
+	fingerprint := sha256.Sum256(leaf.Raw)
+
+	req.Header.Set("X-Client-Verify", "SUCCESS")
+	req.Header.Set("X-Client-Subject", leaf.Subject.String())
+	req.Header.Set("X-Client-San", strings.Join(san, ", "))
+	req.Header.Set("X-Client-Fingerprint", hex.EncodeToString(fingerprint[:]))
 }
 
 func (l *lProxy) hostname(req *http.Request) string {
@@ -570,14 +1126,154 @@ func (l *lProxy) hostname(req *http.Request) string {
 	return host
 }
 
-func (l *lProxy) scheme(req *http.Request) string {
-	scheme := strings.ToLower(req.Header.Get("X-Forwarded-Proto"))
-	switch scheme {
-	case "http", "https":
-		return scheme
+func (l *lProxy) isTrustedProxy(addr netip.Addr) bool {
+	l.trustedProxyLock.RLock()
+	defer l.trustedProxyLock.RUnlock()
+	return utils.PrefixesContain(l.trustedProxy, addr)
+}
+
+// clientIP 从右往左跳过可信代理，第一个不可信的地址即为客户端地址
+func (l *lProxy) clientIP(req *http.Request) netip.Addr {
+	remote := utils.ParseAddr(req.RemoteAddr)
+	if !l.isTrustedProxy(remote) {
+		return remote
+	}
+
+	chain := utils.SplitHeaderList(req.Header.Values("X-Forwarded-For"))
+	if len(chain) == 0 {
+		chain = utils.ParseForwardedFor(req.Header.Values("Forwarded"))
+	}
+
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr := utils.ParseAddr(chain[i])
+		if !addr.IsValid() {
+			break
+		}
+		client = addr
+		if !l.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return client
+}
+
+// upstreamProxyProtoHeader 源地址使用客户端地址，目的地址使用客户端连接的本地地址
+func (l *lProxy) upstreamProxyProtoHeader(req *http.Request, version int) *utils.ProxyProtoHeader {
+	var (
+		remote = utils.ParseAddrPort(req.RemoteAddr)
+		client = l.clientIP(req)
+		port   uint16
+	)
+	if client == remote.Addr() {
+		port = remote.Port()
+	}
+
+	header := &utils.ProxyProtoHeader{
+		Version: version,
+		Command: utils.ProxyProtoCommandProxy,
+		Source:  net.TCPAddrFromAddrPort(netip.AddrPortFrom(client, port)),
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		header.Destination = addr
+	}
+	return header
+}
+
+func (l *lProxy) setForwardedHeader(req *http.Request, proxyHeader bool) {
+	var (
+		remote  = utils.ParseAddr(req.RemoteAddr)
+		trusted = l.isTrustedProxy(remote)
+		client  = l.clientIP(req)
+		scheme  = l.scheme(req, trusted)
+		host    = l.forwardedHost(req, trusted)
+		port    = l.forwardedPort(req, trusted)
+	)
+
+	xff := make([]string, 0)
+	if trusted {
+		xff = append(xff, utils.SplitHeaderList(req.Header.Values("X-Forwarded-For"))...)
+	}
+	if remote.IsValid() {
+		xff = append(xff, remote.String())
+	}
+
+	forwarded := make([]string, 0)
+	if trusted {
+		forwarded = append(forwarded, utils.SplitHeaderList(req.Header.Values("Forwarded"))...)
+	}
+	forwarded = append(forwarded, fmt.Sprintf("for=%v;host=%v;proto=%v",
+		utils.FormatForwardedNode(remote),
+		utils.FormatForwardedValue(host),
+		scheme,
+	))
+
+	if !trusted {
+		for _, k := range forwardedHeaders {
+			req.Header.Del(k)
+		}
+	}
+
+	if len(xff) > 0 {
+		req.Header.Set("X-Forwarded-For", strings.Join(xff, ", "))
+	}
+
+	if !proxyHeader {
+		return
+	}
+
+	req.Header.Set("X-Forwarded-Proto", scheme)
+	req.Header.Set("X-Forwarded-Host", host)
+	if port != "" {
+		req.Header.Set("X-Forwarded-Port", port)
+	}
+	if client.IsValid() {
+		req.Header.Set("X-Real-IP", client.String())
+	}
+	req.Header.Set("Forwarded", strings.Join(forwarded, ", "))
+}
+
+func (l *lProxy) scheme(req *http.Request, trusted bool) string {
+	if header := utils.ProxyProtoHeaderFromContext(req.Context()); header != nil {
+		if ssl, ok := header.SSL(); ok && ssl.Client&utils.ProxyProtoSSLClientSSL != 0 {
+			return "https"
+		}
+	}
+	if trusted {
+		scheme := strings.ToLower(req.Header.Get("X-Forwarded-Proto"))
+		switch scheme {
+		case "http", "https":
+			return scheme
+		}
 	}
 	if req.TLS == nil {
 		return "http"
 	}
 	return "https"
 }
+
+func (l *lProxy) forwardedHost(req *http.Request, trusted bool) string {
+	if trusted {
+		if host := req.Header.Get("X-Forwarded-Host"); host != "" {
+			return host
+		}
+	}
+	return req.Host
+}
+
+func (l *lProxy) forwardedPort(req *http.Request, trusted bool) string {
+	if trusted {
+		if port := req.Header.Get("X-Forwarded-Port"); port != "" {
+			return port
+		}
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if _, port, err := net.SplitHostPort(req.Host); err == nil {
+		return port
+	}
+	return ""
+}
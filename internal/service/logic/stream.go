@@ -0,0 +1,351 @@
+package logic
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abxuz/go-vhostd/internal/model"
+	"github.com/abxuz/go-vhostd/internal/service"
+	"github.com/abxuz/go-vhostd/utils"
+)
+
+const streamHandshakeTimeout = 10 * time.Second
+
+var StreamDialer = &net.Dialer{
+	Timeout:   5 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+type streamRoute struct {
+	target string
+	sni    []*model.StreamSniCfg
+	// cert 用于卸载TLS的证书名称，握手时从证书库中取，证书文件更新后立即生效
+	cert string
+
+	// udpTarget udp转发目标，加载配置时解析一次，避免在读取循环中查询DNS
+	udpTarget   *net.UDPAddr
+	idleTimeout time.Duration
+	bufferSize  int
+	maxSessions int
+}
+
+// match 优先精确匹配，其次通配符匹配，都没有匹配到时使用默认目标
+func (r *streamRoute) match(serverName string) string {
+	if serverName == "" {
+		return r.target
+	}
+	for _, sni := range r.sni {
+		if sni.Domain == serverName {
+			return sni.Target
+		}
+	}
+	for _, sni := range r.sni {
+		if utils.MatchDomain(sni.Domain, serverName) {
+			return sni.Target
+		}
+	}
+	return r.target
+}
+
+type streamServer struct {
+	net.Listener
+	listen *model.ListenCfg
+}
+
+type udpStreamServer struct {
+	*net.UDPConn
+	listen *model.ListenCfg
+
+	sessionsLock sync.Mutex
+	sessions     map[string]*udpStreamSession
+}
+
+func (s *udpStreamServer) Close() error {
+	s.sessionsLock.Lock()
+	for _, session := range s.sessions {
+		session.Close()
+	}
+	clear(s.sessions)
+	s.sessionsLock.Unlock()
+	return s.UDPConn.Close()
+}
+
+// udpStreamSession 每个客户端地址对应一个到上游的连接
+type udpStreamSession struct {
+	*net.UDPConn
+	lastActive atomic.Int64
+}
+
+func (s *udpStreamSession) active() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpStreamSession) idle() time.Duration {
+	return time.Since(time.Unix(0, s.lastActive.Load()))
+}
+
+type lStream struct {
+	routesLock sync.RWMutex
+	routes     map[string]*streamRoute
+	udpRoutes  map[string]*streamRoute
+
+	servers    map[string]*streamServer
+	udpServers map[string]*udpStreamServer
+}
+
+func init() {
+	service.RegisterStreamService(&lStream{})
+}
+
+func (l *lStream) Init() {
+	l.routes = make(map[string]*streamRoute)
+	l.udpRoutes = make(map[string]*streamRoute)
+	l.servers = make(map[string]*streamServer)
+	l.udpServers = make(map[string]*udpStreamServer)
+}
+
+func (l *lStream) Reload(cfg model.Cfg) {
+	var (
+		routes    = make(map[string]*streamRoute)
+		udpRoutes = make(map[string]*streamRoute)
+		listen    = make(map[string]*model.ListenCfg)
+		udpListen = make(map[string]*model.ListenCfg)
+	)
+	for _, stream := range cfg.Stream {
+		route := &streamRoute{
+			target:      stream.Target,
+			sni:         stream.Sni,
+			cert:        stream.Cert,
+			bufferSize:  stream.GetBufferSize(),
+			maxSessions: stream.GetMaxSessions(),
+		}
+		route.idleTimeout, _ = stream.GetIdleTimeout()
+		if stream.GetNetwork() == "udp" {
+			addr, err := net.ResolveUDPAddr("udp", stream.Target)
+			if err != nil {
+				log.Printf("[stream] unable to resolve udp target %v of stream %v: %v", stream.Target, stream.Name, err)
+			}
+			route.udpTarget = addr
+		}
+
+		for _, c := range stream.Listen {
+			if stream.GetNetwork() == "udp" {
+				udpRoutes[c.Addr] = route
+				udpListen[c.Addr] = c
+			} else {
+				routes[c.Addr] = route
+				listen[c.Addr] = c
+			}
+		}
+	}
+
+	l.routesLock.Lock()
+	l.routes = routes
+	l.udpRoutes = udpRoutes
+	l.routesLock.Unlock()
+
+	l.reloadTcpServer(listen)
+	l.reloadUdpServer(udpListen)
+}
+
+func (l *lStream) reloadTcpServer(listen map[string]*model.ListenCfg) {
+	for k, server := range l.servers {
+		if c, ok := listen[k]; ok && c.Equal(server.listen) {
+			delete(listen, k)
+			continue
+		}
+		server.Close()
+		delete(l.servers, k)
+	}
+
+	for k, c := range listen {
+		ln, err := newListener(c)
+		if err != nil {
+			continue
+		}
+		server := &streamServer{
+			Listener: ln,
+			listen:   c,
+		}
+		go l.serve(k, server)
+		l.servers[k] = server
+	}
+}
+
+func (l *lStream) reloadUdpServer(listen map[string]*model.ListenCfg) {
+	for k, server := range l.udpServers {
+		if c, ok := listen[k]; ok && c.Equal(server.listen) {
+			delete(listen, k)
+			continue
+		}
+		server.Close()
+		delete(l.udpServers, k)
+	}
+
+	for k, c := range listen {
+		addr, err := net.ResolveUDPAddr("udp", c.Addr)
+		if err != nil {
+			continue
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			continue
+		}
+		server := &udpStreamServer{
+			UDPConn:  conn,
+			listen:   c,
+			sessions: make(map[string]*udpStreamSession),
+		}
+		go l.serveUdp(k, server)
+		l.udpServers[k] = server
+	}
+}
+
+func (l *lStream) serve(addr string, server *streamServer) {
+	for {
+		conn, err := server.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		go l.handle(addr, conn)
+	}
+}
+
+func (l *lStream) handle(addr string, conn net.Conn) {
+	l.routesLock.RLock()
+	route, ok := l.routes[addr]
+	l.routesLock.RUnlock()
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	var serverName string
+	if route.cert != "" {
+		tlsConn := tls.Server(conn, &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				cert := service.Cert.Get(route.cert)
+				if cert == nil {
+					return nil, ErrCertNotFound
+				}
+				return cert, nil
+			},
+		})
+		tlsConn.SetDeadline(time.Now().Add(streamHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			tlsConn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		serverName = tlsConn.ConnectionState().ServerName
+		conn = tlsConn
+	} else if len(route.sni) > 0 {
+		conn.SetReadDeadline(time.Now().Add(streamHandshakeTimeout))
+		hello, peeked, _ := utils.PeekClientHello(conn)
+		conn.SetReadDeadline(time.Time{})
+		if hello != nil {
+			serverName = hello.ServerName
+		}
+		conn = utils.NewPrefixConn(conn, peeked)
+	}
+
+	target := route.match(serverName)
+	if target == "" {
+		conn.Close()
+		return
+	}
+
+	upstream, err := StreamDialer.Dial("tcp", target)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	utils.Pipe(conn, upstream)
+}
+
+func (l *lStream) serveUdp(addr string, server *udpStreamServer) {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := server.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		l.routesLock.RLock()
+		route, ok := l.udpRoutes[addr]
+		l.routesLock.RUnlock()
+		if !ok || route.udpTarget == nil || n > route.bufferSize {
+			continue
+		}
+
+		key := client.String()
+		server.sessionsLock.Lock()
+		session, ok := server.sessions[key]
+		if !ok {
+			// 会话数达到上限时丢弃新客户端的报文，避免伪造的源地址耗尽资源
+			if len(server.sessions) >= route.maxSessions {
+				server.sessionsLock.Unlock()
+				continue
+			}
+			session, err = l.newUdpSession(route)
+			if err != nil {
+				server.sessionsLock.Unlock()
+				continue
+			}
+			server.sessions[key] = session
+			go l.serveUdpSession(server, key, client, session, route)
+		}
+		server.sessionsLock.Unlock()
+
+		session.active()
+		session.Write(buf[:n])
+	}
+}
+
+func (l *lStream) newUdpSession(route *streamRoute) (*udpStreamSession, error) {
+	conn, err := net.DialUDP("udp", nil, route.udpTarget)
+	if err != nil {
+		return nil, err
+	}
+	session := &udpStreamSession{UDPConn: conn}
+	session.active()
+	return session, nil
+}
+
+// serveUdpSession 把上游的回包转发给客户端，会话空闲超时后关闭
+func (l *lStream) serveUdpSession(server *udpStreamServer, key string, client *net.UDPAddr, session *udpStreamSession, route *streamRoute) {
+	defer func() {
+		session.Close()
+		server.sessionsLock.Lock()
+		if server.sessions[key] == session {
+			delete(server.sessions, key)
+		}
+		server.sessionsLock.Unlock()
+	}()
+
+	buf := make([]byte, route.bufferSize)
+	for {
+		session.SetReadDeadline(time.Now().Add(route.idleTimeout))
+		n, err := session.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && session.idle() < route.idleTimeout {
+				continue
+			}
+			return
+		}
+		session.active()
+		if _, err := server.WriteToUDP(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package logic
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abxuz/go-vhostd/internal/model"
+)
+
+// freeTcpAddr 返回一个当前空闲的本地tcp地址
+func freeTcpAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// tcpBackend 把收到的第一个TLS记录头连同自己的名称发送到got
+func tcpBackend(t *testing.T, name string, got chan<- string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			header := make([]byte, 5)
+			_, err = io.ReadFull(conn, header)
+			conn.Close()
+			if err != nil {
+				got <- name + ": " + err.Error()
+				continue
+			}
+			got <- name + ": " + string(rune(header[0]))
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// freeUdpAddr 返回一个当前空闲的本地udp地址
+func freeUdpAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+// udpEcho 原样返回收到的报文
+func udpEcho(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// udpSourceEcho 回复上游看到的源地址，用来区分不同的会话
+func udpSourceEcho(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			_, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP([]byte(addr.String()), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func udpRoundTrip(t *testing.T, conn net.Conn, msg string, timeout time.Duration) (string, error) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	return string(buf[:n]), err
+}
+
+func TestStreamRouteMatch(t *testing.T) {
+	route := &streamRoute{
+		target: "default:443",
+		sni: []*model.StreamSniCfg{
+			{Domain: "*.example.com", Target: "wildcard:443"},
+			{Domain: "www.example.com", Target: "www:443"},
+		},
+	}
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"", "default:443"},
+		{"www.example.com", "www:443"},
+		{"api.example.com", "wildcard:443"},
+		{"a.b.example.com", "default:443"},
+		{"example.com", "default:443"},
+		{"example.org", "default:443"},
+	}
+	for _, tt := range tests {
+		if got := route.match(tt.serverName); got != tt.want {
+			t.Errorf("match(%q) = %v, want %v", tt.serverName, got, tt.want)
+		}
+	}
+
+	route.target = ""
+	if got := route.match("example.org"); got != "" {
+		t.Errorf("match without default target = %v, want empty", got)
+	}
+}
+
+func TestTcpStreamSniRouting(t *testing.T) {
+	got := make(chan string, 1)
+	listen := freeTcpAddr(t)
+	l := &lStream{}
+	l.Init()
+	l.Reload(model.Cfg{Stream: []*model.StreamCfg{{
+		Name:   "tcp",
+		Listen: []*model.ListenCfg{{Addr: listen}},
+		Target: tcpBackend(t, "default", got),
+		Sni: []*model.StreamSniCfg{
+			{Domain: "www.example.com", Target: tcpBackend(t, "www", got)},
+			{Domain: "*.example.com", Target: tcpBackend(t, "wildcard", got)},
+		},
+	}}})
+	defer l.Reload(model.Cfg{})
+
+	// 预读的ClientHello原样转发给按sni选出的上游
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"www.example.com", "www: \x16"},
+		{"api.example.com", "wildcard: \x16"},
+		{"example.org", "default: \x16"},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go tls.Client(conn, &tls.Config{ServerName: tt.serverName}).Handshake()
+
+		select {
+		case result := <-got:
+			if result != tt.want {
+				t.Errorf("sni %v routed to %q, want %q", tt.serverName, result, tt.want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("sni %v not routed", tt.serverName)
+		}
+		conn.Close()
+	}
+
+	// 不是TLS的连接使用默认目标
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	select {
+	case result := <-got:
+		if result != "default: G" {
+			t.Errorf("plain connection routed to %q, want %q", result, "default: G")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("plain connection not routed")
+	}
+}
+
+func TestUdpStreamSessions(t *testing.T) {
+	listen := freeUdpAddr(t)
+	l := &lStream{}
+	l.Init()
+	l.Reload(model.Cfg{Stream: []*model.StreamCfg{{
+		Name:        "udp",
+		Network:     "udp",
+		Listen:      []*model.ListenCfg{{Addr: listen}},
+		Target:      udpEcho(t),
+		IdleTimeout: "300ms",
+		MaxSessions: 1,
+	}}})
+	defer l.Reload(model.Cfg{})
+
+	client1, err := net.Dial("udp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+	client2, err := net.Dial("udp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	if got, err := udpRoundTrip(t, client1, "a", time.Second); err != nil || got != "a" {
+		t.Fatalf("client1 got %q, %v, want a", got, err)
+	}
+
+	// 达到会话数上限后新客户端的报文被丢弃
+	if got, err := udpRoundTrip(t, client2, "b", 100*time.Millisecond); err == nil {
+		t.Errorf("client2 got %q beyond max_sessions, want dropped", got)
+	}
+
+	// 会话空闲超时后释放，新客户端可以建立会话
+	time.Sleep(600 * time.Millisecond)
+	if got, err := udpRoundTrip(t, client2, "c", time.Second); err != nil || got != "c" {
+		t.Errorf("client2 got %q, %v after session expired, want c", got, err)
+	}
+}
+
+func TestUdpStreamUnresolvedTarget(t *testing.T) {
+	listen := freeUdpAddr(t)
+	l := &lStream{}
+	l.Init()
+	l.Reload(model.Cfg{Stream: []*model.StreamCfg{{
+		Name:    "udp",
+		Network: "udp",
+		Listen:  []*model.ListenCfg{{Addr: listen}},
+		Target:  "host.invalid:53",
+	}}})
+	defer l.Reload(model.Cfg{})
+
+	l.routesLock.RLock()
+	route := l.udpRoutes[listen]
+	l.routesLock.RUnlock()
+	if route == nil || route.udpTarget != nil {
+		t.Fatalf("route = %+v, want route without resolved target", route)
+	}
+
+	client, err := net.Dial("udp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if got, err := udpRoundTrip(t, client, "a", 100*time.Millisecond); err == nil {
+		t.Errorf("got %q for unresolved target, want dropped", got)
+	}
+	server := l.udpServers[listen]
+	server.sessionsLock.Lock()
+	defer server.sessionsLock.Unlock()
+	if len(server.sessions) != 0 {
+		t.Errorf("%v sessions for unresolved target, want 0", len(server.sessions))
+	}
+}
+
+func TestUdpStreamSessionKeepAlive(t *testing.T) {
+	listen := freeUdpAddr(t)
+	l := &lStream{}
+	l.Init()
+	l.Reload(model.Cfg{Stream: []*model.StreamCfg{{
+		Name:        "udp",
+		Network:     "udp",
+		Listen:      []*model.ListenCfg{{Addr: listen}},
+		Target:      udpSourceEcho(t),
+		IdleTimeout: "300ms",
+		BufferSize:  16,
+	}}})
+
+	client, err := net.Dial("udp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	first, err := udpRoundTrip(t, client, "a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 客户端持续发送时会话一直保持，上游看到的源地址不变
+	for range 6 {
+		time.Sleep(100 * time.Millisecond)
+		if got, err := udpRoundTrip(t, client, "a", time.Second); err != nil || got != first {
+			t.Fatalf("got %q, %v while session active, want %q", got, err, first)
+		}
+	}
+
+	// 超过buffer_size的报文被丢弃
+	if got, err := udpRoundTrip(t, client, string(make([]byte, 17)), 100*time.Millisecond); err == nil {
+		t.Errorf("got %q for oversized packet, want dropped", got)
+	}
+
+	// 空闲超时后会话被删除，之后的报文使用新的会话
+	time.Sleep(600 * time.Millisecond)
+	server := l.udpServers[listen]
+	server.sessionsLock.Lock()
+	sessions := len(server.sessions)
+	server.sessionsLock.Unlock()
+	if sessions != 0 {
+		t.Errorf("%v sessions after idle timeout, want 0", sessions)
+	}
+	if got, err := udpRoundTrip(t, client, "a", time.Second); err != nil || got == first {
+		t.Errorf("got %q, %v after idle timeout, want a new session", got, err)
+	}
+
+	// 删除配置时关闭所有会话
+	l.Reload(model.Cfg{})
+	server.sessionsLock.Lock()
+	sessions = len(server.sessions)
+	server.sessionsLock.Unlock()
+	if sessions != 0 {
+		t.Errorf("%v sessions after stream removed, want 0", sessions)
+	}
+	if got, err := udpRoundTrip(t, client, "a", 100*time.Millisecond); err == nil {
+		t.Errorf("got %q after stream removed, want no response", got)
+	}
+}
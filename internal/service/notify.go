@@ -0,0 +1,19 @@
+package service
+
+import "github.com/abxuz/go-vhostd/internal/model"
+
+type NotifyService interface {
+	Init()
+	Reload(cfg model.Cfg)
+
+	// Send 在后台发送通知，失败时输出到日志
+	Send(n *model.Notification)
+	// Test 立即发送通知并返回错误，用于检查通知配置
+	Test(n *model.Notification) error
+}
+
+var Notify NotifyService
+
+func RegisterNotifyService(s NotifyService) {
+	Notify = s
+}
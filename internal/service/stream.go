@@ -0,0 +1,14 @@
+package service
+
+import "github.com/abxuz/go-vhostd/internal/model"
+
+type StreamService interface {
+	Init()
+	Reload(cfg model.Cfg)
+}
+
+var Stream StreamService
+
+func RegisterStreamService(s StreamService) {
+	Stream = s
+}
@@ -0,0 +1,23 @@
+// Package xconnect 开启net/http中http2服务端的RFC 8441 extended CONNECT支持。
+//
+// net/http只在初始化时读取GODEBUG中的http2xconnect=1，没有其他开关。
+// 包按导入路径排序后依次初始化，本包只依赖os和strings，
+// 会排在net/http之前初始化，在internal/cmd中以匿名方式导入。
+package xconnect
+
+import (
+	"os"
+	"strings"
+)
+
+func init() {
+	godebug := os.Getenv("GODEBUG")
+	// 用户显式设置了http2xconnect时以用户的设置为准
+	if strings.Contains(godebug, "http2xconnect=") {
+		return
+	}
+	if godebug != "" {
+		godebug += ","
+	}
+	os.Setenv("GODEBUG", godebug+"http2xconnect=1")
+}
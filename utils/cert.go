@@ -1,45 +1,488 @@
 package utils
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"time"
 )
 
-func ParseCert(data []byte) (*tls.Certificate, error) {
+// ParseCert 解析PEM或PKCS#12格式的证书和私钥，私钥可以是加密的，
+// 证书链会按签发关系重新排序，有私钥时检查私钥与证书是否匹配
+func ParseCert(data []byte, password string) (*tls.Certificate, error) {
 	var (
-		cert  = &tls.Certificate{}
+		certs []*x509.Certificate
+		key   crypto.PrivateKey
+		err   error
+	)
+	switch {
+	case bytes.Contains(data, []byte("-----BEGIN")):
+		certs, key, err = decodePEMCertKey(data, password)
+	case len(data) > 0 && data[0] == 0x30:
+		// PKCS#12是DER编码的ASN.1 SEQUENCE
+		certs, key, err = DecodePKCS12(data, password)
+	default:
+		return nil, errors.New("no PEM certificate or PKCS#12 data found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{PrivateKey: key}
+	if len(certs) == 0 {
+		return cert, nil
+	}
+
+	certs, err = sortChain(certs, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	cert.Leaf = certs[0]
+
+	if key != nil {
+		if err := CheckKeyPair(cert.Leaf, key); err != nil {
+			return nil, err
+		}
+	}
+	return cert, nil
+}
+
+func decodePEMCertKey(data []byte, password string) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	var (
+		certs = make([]*x509.Certificate, 0)
+		key   crypto.PrivateKey
 		block *pem.Block
 	)
 
+	setKey := func(k crypto.PrivateKey, err error) error {
+		if err != nil {
+			return fmt.Errorf("malform private key: %w", err)
+		}
+		if key != nil {
+			return errors.New("more than one private key found")
+		}
+		key = k
+		return nil
+	}
+
 	for {
 		block, data = pem.Decode(data)
 		if block == nil {
 			break
 		}
 
+		der := block.Bytes
+		//nolint:staticcheck // 兼容openssl传统格式的加密私钥
+		if x509.IsEncryptedPEMBlock(block) {
+			if password == "" {
+				return nil, nil, errors.New("password required for encrypted private key")
+			}
+			var err error
+			//nolint:staticcheck
+			der, err = x509.DecryptPEMBlock(block, []byte(password))
+			if err != nil {
+				return nil, nil, ErrIncorrectPassword
+			}
+		}
+
+		var err error
 		switch block.Type {
 		case "CERTIFICATE":
-			cert.Certificate = append(cert.Certificate, block.Bytes)
-		case "PRIVATE KEY":
-			pk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			cert, err := x509.ParseCertificate(der)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
-			cert.PrivateKey = pk
-		case "RSA PRIVATE KEY":
-			pk, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-			if err != nil {
-				return nil, err
+			certs = append(certs, cert)
+		case "PRIVATE KEY":
+			err = setKey(x509.ParsePKCS8PrivateKey(der))
+		case "ENCRYPTED PRIVATE KEY":
+			if password == "" {
+				return nil, nil, errors.New("password required for encrypted private key")
+			}
+			der, err = DecryptPKCS8(der, password)
+			if err == nil {
+				err = setKey(x509.ParsePKCS8PrivateKey(der))
 			}
-			cert.PrivateKey = pk
+		case "RSA PRIVATE KEY":
+			err = setKey(x509.ParsePKCS1PrivateKey(der))
 		case "EC PRIVATE KEY":
-			pk, err := x509.ParseECPrivateKey(block.Bytes)
-			if err != nil {
-				return nil, err
+			err = setKey(x509.ParseECPrivateKey(der))
+		case "EC PARAMETERS":
+			// openssl ecparam -genkey 生成的文件中会带上曲线参数，不需要处理
+		default:
+			return nil, nil, fmt.Errorf("unsupported pem block type %v", block.Type)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return certs, key, nil
+}
+
+// sortChain 证书链按叶子证书、中间证书的顺序排列，与链无关的证书放到最后
+func sortChain(certs []*x509.Certificate, key crypto.PrivateKey) ([]*x509.Certificate, error) {
+	leaf := -1
+	if key != nil {
+		for i, c := range certs {
+			if CheckKeyPair(c, key) == nil {
+				leaf = i
+				break
 			}
-			cert.PrivateKey = pk
+		}
+		if leaf == -1 {
+			if len(certs) == 1 {
+				return nil, CheckKeyPair(certs[0], key)
+			}
+			return nil, errors.New("private key does not match any certificate")
+		}
+	} else {
+		// 没有私钥时，不是其他证书签发者的那张就是叶子证书
+		for i, c := range certs {
+			issuer := false
+			for j, o := range certs {
+				if i != j && bytes.Equal(o.RawIssuer, c.RawSubject) && o.CheckSignatureFrom(c) == nil {
+					issuer = true
+					break
+				}
+			}
+			if !issuer {
+				leaf = i
+				break
+			}
+		}
+		if leaf == -1 {
+			leaf = 0
 		}
 	}
-	return cert, nil
+
+	rest := slices.Delete(slices.Clone(certs), leaf, leaf+1)
+	sorted := []*x509.Certificate{certs[leaf]}
+	for {
+		current := sorted[len(sorted)-1]
+		if bytes.Equal(current.RawIssuer, current.RawSubject) {
+			break
+		}
+		i := slices.IndexFunc(rest, func(c *x509.Certificate) bool {
+			return bytes.Equal(current.RawIssuer, c.RawSubject) && current.CheckSignatureFrom(c) == nil
+		})
+		if i == -1 {
+			break
+		}
+		sorted = append(sorted, rest[i])
+		rest = slices.Delete(rest, i, i+1)
+	}
+	return append(sorted, rest...), nil
+}
+
+// EncodeCertKey 把证书链和私钥编码为PEM格式，私钥统一使用PKCS#8
+func EncodeCertKey(cert *tls.Certificate) (chain []byte, key []byte, err error) {
+	for _, der := range cert.Certificate {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if cert.PrivateKey == nil {
+		return chain, nil, nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	key = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return chain, key, nil
+}
+
+func ParseCRL(data []byte) ([]*x509.RevocationList, error) {
+	var (
+		crls  = make([]*x509.RevocationList, 0)
+		block *pem.Block
+	)
+
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// CheckRevocation 使用签发者对应的CRL检查证书链中的证书是否已被吊销
+func CheckRevocation(chains [][]*x509.Certificate, crls []*x509.RevocationList) error {
+	for _, chain := range chains {
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+			for _, crl := range crls {
+				if crl.CheckSignatureFrom(issuer) != nil {
+					continue
+				}
+				if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+					return fmt.Errorf("crl issued by %v is expired", crl.Issuer)
+				}
+				for _, entry := range crl.RevokedCertificateEntries {
+					if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+						return errors.New("certificate " + cert.Subject.String() + " is revoked")
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// GenerateSelfSignedCert 生成一张临时使用的自签名证书
+func GenerateSelfSignedCert(commonName string, dnsNames ...string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              dnsNames,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// GenerateCA 生成自签名的根证书，只能用于签发证书
+func GenerateCA(commonName string, validity time.Duration) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// IssueCert 用CA签发服务器证书，names可以是域名或者IP，第一个作为CommonName，
+// 有效期不会超过CA证书的有效期
+func IssueCert(ca *tls.Certificate, validity time.Duration, names ...string) (*tls.Certificate, error) {
+	if ca.Leaf == nil || !ca.Leaf.IsCA {
+		return nil, errors.New("not a ca certificate")
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no name to issue certificate for")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if template.NotAfter.After(ca.Leaf.NotAfter) {
+		template.NotAfter = ca.Leaf.NotAfter
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, key.Public(), ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// GenerateKey 按类型生成私钥，可选ec256/ec384/rsa2048/rsa3072/rsa4096/ed25519，默认ec256
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "", "ec256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ec384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "rsa2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa3072":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "rsa4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key type %v", keyType)
+}
+
+// CreateCSR 生成PEM格式的证书签名请求，names可以是域名或者IP
+func CreateCSR(key crypto.Signer, subject pkix.Name, names []string) ([]byte, error) {
+	template := &x509.CertificateRequest{Subject: subject}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+func ParseCSR(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("malform certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return csr, csr.CheckSignature()
+}
+
+// CheckKeyPair 检查私钥与证书中的公钥是否匹配
+func CheckKeyPair(leaf *x509.Certificate, key crypto.PrivateKey) error {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported private key type")
+	}
+
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(signer.Public()) {
+		return fmt.Errorf("private key (%v) does not match certificate %v (%v)",
+			keyAlgorithm(signer.Public()), leaf.Subject, leaf.PublicKeyAlgorithm)
+	}
+	return nil
+}
+
+func keyAlgorithm(pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return "ECDSA"
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return "unknown"
+}
+
+// SplitCertKey 把PEM内容拆分为证书链和私钥两部分
+func SplitCertKey(data []byte) (chain []byte, key []byte) {
+	var block *pem.Block
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			key = append(key, pem.EncodeToMemory(block)...)
+		} else {
+			chain = append(chain, pem.EncodeToMemory(block)...)
+		}
+	}
+	return chain, key
 }
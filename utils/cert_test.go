@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"crypto/x509"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestIssueCert(t *testing.T) {
+	ca, err := GenerateCA("test ca", 365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Leaf.IsCA || ca.Leaf.KeyUsage&x509.KeyUsageCertSign == 0 {
+		t.Fatalf("GenerateCA returned a certificate that can not sign")
+	}
+
+	cert, err := IssueCert(ca, 90*24*time.Hour, "www.example.test", "192.0.2.1", "::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := cert.Leaf
+	if leaf.Subject.CommonName != "www.example.test" {
+		t.Errorf("CommonName = %v, want www.example.test", leaf.Subject.CommonName)
+	}
+	if !slices.Equal(leaf.DNSNames, []string{"www.example.test"}) {
+		t.Errorf("DNSNames = %v, want [www.example.test]", leaf.DNSNames)
+	}
+	if len(leaf.IPAddresses) != 2 || !leaf.IPAddresses[0].Equal(net.ParseIP("192.0.2.1")) || !leaf.IPAddresses[1].Equal(net.ParseIP("::1")) {
+		t.Errorf("IPAddresses = %v, want [192.0.2.1 ::1]", leaf.IPAddresses)
+	}
+	if leaf.IsCA {
+		t.Errorf("issued certificate is a ca")
+	}
+	if len(cert.Certificate) != 2 || string(cert.Certificate[1]) != string(ca.Leaf.Raw) {
+		t.Errorf("chain does not end with the ca certificate")
+	}
+	if err := CheckKeyPair(leaf, cert.PrivateKey); err != nil {
+		t.Errorf("CheckKeyPair: %v", err)
+	}
+
+	// 签发的证书可以用CA校验
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	for _, name := range []string{"www.example.test", "192.0.2.1", "::1"} {
+		_, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+		if err != nil {
+			t.Errorf("Verify(%v): %v", name, err)
+		}
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "other.example.test", Roots: roots}); err == nil {
+		t.Errorf("Verify(other.example.test) should fail")
+	}
+}
+
+func TestIssueCertValidity(t *testing.T) {
+	ca, err := GenerateCA("test ca", 10*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 有效期不超过CA证书
+	cert, err := IssueCert(ca, 90*24*time.Hour, "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Leaf.NotAfter.Equal(ca.Leaf.NotAfter) {
+		t.Errorf("NotAfter = %v, want the ca NotAfter %v", cert.Leaf.NotAfter, ca.Leaf.NotAfter)
+	}
+
+	cert, err = IssueCert(ca, 24*time.Hour, "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(cert.Leaf.NotAfter); d > 24*time.Hour || d < 23*time.Hour {
+		t.Errorf("NotAfter = %v, want about 24h later", cert.Leaf.NotAfter)
+	}
+}
+
+func TestIssueCertInvalid(t *testing.T) {
+	leaf, err := GenerateSelfSignedCert("not a ca", "not.a.ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IssueCert(leaf, time.Hour, "example.test"); err == nil {
+		t.Errorf("IssueCert with a non-ca certificate should fail")
+	}
+
+	ca, err := GenerateCA("test ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IssueCert(ca, time.Hour); err == nil {
+		t.Errorf("IssueCert without names should fail")
+	}
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxChainDepth 通过AIA补全证书链时最多下载的中间证书数量
+const maxChainDepth = 5
+
+// SystemRoots 系统信任的根证书，加载失败时返回空的证书池
+var SystemRoots = sync.OnceValue(func() *x509.CertPool {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		return x509.NewCertPool()
+	}
+	return roots
+})
+
+func parseChain(cert *tls.Certificate) ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, 0, len(cert.Certificate))
+	for _, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	return certs, nil
+}
+
+func isSelfSigned(c *x509.Certificate) bool {
+	// 不用CheckSignatureFrom，自签名的叶子证书不是CA证书
+	return bytes.Equal(c.RawIssuer, c.RawSubject) &&
+		c.CheckSignature(c.SignatureAlgorithm, c.RawTBSCertificate, c.Signature) == nil
+}
+
+// chainAnchored 证书链的最后一张是根证书，或者由系统信任的根证书签发
+func chainAnchored(certs []*x509.Certificate, roots *x509.CertPool) bool {
+	last := certs[len(certs)-1]
+	if isSelfSigned(last) {
+		return true
+	}
+	_, err := last.Verify(x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: last.NotBefore.Add(time.Second),
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
+
+// IncompleteChain 证书链缺少中间证书时返回true
+func IncompleteChain(cert *tls.Certificate, roots *x509.CertPool) bool {
+	certs, err := parseChain(cert)
+	if err != nil || len(certs) == 0 {
+		return false
+	}
+	return !chainAnchored(certs, roots)
+}
+
+// ChainOrdered 检查PEM内容中证书的顺序与整理后的证书链是否一致
+func ChainOrdered(data []byte, cert *tls.Certificate) bool {
+	var (
+		block *pem.Block
+		i     int
+	)
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if i >= len(cert.Certificate) || !bytes.Equal(block.Bytes, cert.Certificate[i]) {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// ChainWarnings 检查证书链中过期的证书、缺少的中间证书和不受信任的根证书
+func ChainWarnings(cert *tls.Certificate, roots *x509.CertPool) []string {
+	warnings := make([]string, 0)
+	certs, err := parseChain(cert)
+	if err != nil || len(certs) == 0 {
+		return warnings
+	}
+
+	now := time.Now()
+	for _, c := range certs {
+		if now.After(c.NotAfter) {
+			warnings = append(warnings, fmt.Sprintf("certificate %v expired at %v",
+				c.Subject, c.NotAfter.Local().Format(time.DateTime)))
+		} else if now.Before(c.NotBefore) {
+			warnings = append(warnings, fmt.Sprintf("certificate %v is not valid until %v",
+				c.Subject, c.NotBefore.Local().Format(time.DateTime)))
+		}
+	}
+
+	last := certs[len(certs)-1]
+	switch {
+	case isSelfSigned(last):
+		// 自签名证书或者私有CA签发的证书
+		_, err := last.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: last.NotBefore.Add(time.Second)})
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("certificate %v is self-signed and not trusted by system", last.Subject))
+		}
+	case chainAnchored(certs, roots):
+	case len(last.IssuingCertificateURL) > 0:
+		warnings = append(warnings, fmt.Sprintf("missing intermediate certificate %v, will be fetched from %v",
+			last.Issuer, last.IssuingCertificateURL[0]))
+	default:
+		warnings = append(warnings, fmt.Sprintf("missing intermediate certificate %v", last.Issuer))
+	}
+	return warnings
+}
+
+// CompleteChain 通过AIA中的签发者地址下载缺少的中间证书，返回补全后的证书和下载地址
+func CompleteChain(ctx context.Context, client *http.Client, cert *tls.Certificate, roots *x509.CertPool) (*tls.Certificate, []string, error) {
+	certs, err := parseChain(cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(certs) == 0 {
+		return nil, nil, errors.New("no certificate found")
+	}
+
+	completed := *cert
+	completed.Certificate = append([][]byte{}, cert.Certificate...)
+	urls := make([]string, 0)
+	for i := 0; !chainAnchored(certs, roots); i++ {
+		last := certs[len(certs)-1]
+		if i >= maxChainDepth {
+			return nil, urls, errors.New("certificate chain is too long")
+		}
+		if len(last.IssuingCertificateURL) == 0 {
+			return nil, urls, fmt.Errorf("no issuer url found in certificate %v", last.Subject)
+		}
+
+		url := last.IssuingCertificateURL[0]
+		issuer, err := fetchIssuer(ctx, client, url)
+		if err != nil {
+			return nil, urls, fmt.Errorf("unable to fetch issuer from %v: %w", url, err)
+		}
+		if err := last.CheckSignatureFrom(issuer); err != nil {
+			return nil, urls, fmt.Errorf("certificate fetched from %v is not the issuer: %w", url, err)
+		}
+
+		urls = append(urls, url)
+		if isSelfSigned(issuer) {
+			// 根证书不需要发送给客户端
+			break
+		}
+		certs = append(certs, issuer)
+		completed.Certificate = append(completed.Certificate, issuer.Raw)
+	}
+	return &completed, urls, nil
+}
+
+// fetchIssuer 下载签发者证书，支持DER和PEM格式
+func fetchIssuer(ctx context.Context, client *http.Client, url string) (*x509.Certificate, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil && block.Type == "CERTIFICATE" {
+		data = block.Bytes
+	}
+	return x509.ParseCertificate(data)
+}
@@ -0,0 +1,272 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testPKI struct {
+	root, inter, leaf *x509.Certificate
+	interKey, leafKey *ecdsa.PrivateKey
+	server            *httptest.Server
+}
+
+// newTestPKI 生成根证书、中间证书和叶子证书，叶子证书的AIA指向DER格式的中间证书，
+// 中间证书的AIA指向PEM格式的根证书
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	pki := &testPKI{}
+	mux := http.NewServeMux()
+	pki.server = httptest.NewServer(mux)
+	t.Cleanup(pki.server.Close)
+
+	newCert := func(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+
+	now := time.Now()
+	root, rootKey := newCert(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	inter, interKey := newCert(&x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Test Intermediate"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IssuingCertificateURL: []string{pki.server.URL + "/root.pem"},
+	}, root, rootKey)
+	leaf, leafKey := newCert(&x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		Subject:               pkix.Name{CommonName: "leaf.test"},
+		DNSNames:              []string{"leaf.test"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IssuingCertificateURL: []string{pki.server.URL + "/inter.der"},
+	}, inter, interKey)
+
+	mux.HandleFunc("/inter.der", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(inter.Raw)
+	})
+	mux.HandleFunc("/root.pem", func(w http.ResponseWriter, r *http.Request) {
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+	})
+	pki.root, pki.inter, pki.leaf = root, inter, leaf
+	pki.interKey, pki.leafKey = interKey, leafKey
+	return pki
+}
+
+// issue 用中间证书签发一张指定AIA地址的叶子证书
+func (p *testPKI) issue(t *testing.T, urls ...string) *x509.Certificate {
+	t.Helper()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(4),
+		Subject:               pkix.Name{CommonName: "other.test"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		IssuingCertificateURL: urls,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.inter, p.leafKey.Public(), p.interKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func (p *testPKI) cert(certs ...*x509.Certificate) *tls.Certificate {
+	cert := &tls.Certificate{PrivateKey: p.leafKey, Leaf: certs[0]}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert
+}
+
+func (p *testPKI) roots() *x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AddCert(p.root)
+	return roots
+}
+
+func TestIncompleteChain(t *testing.T) {
+	pki := newTestPKI(t)
+	tests := []struct {
+		name  string
+		cert  *tls.Certificate
+		roots *x509.CertPool
+		want  bool
+	}{
+		{"leaf only", pki.cert(pki.leaf), pki.roots(), true},
+		{"leaf and intermediate", pki.cert(pki.leaf, pki.inter), pki.roots(), false},
+		{"leaf and intermediate untrusted", pki.cert(pki.leaf, pki.inter), x509.NewCertPool(), true},
+		{"full chain", pki.cert(pki.leaf, pki.inter, pki.root), x509.NewCertPool(), false},
+		{"self-signed", pki.cert(pki.root), x509.NewCertPool(), false},
+	}
+	for _, tt := range tests {
+		if got := IncompleteChain(tt.cert, tt.roots); got != tt.want {
+			t.Errorf("%v: IncompleteChain = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompleteChain(t *testing.T) {
+	pki := newTestPKI(t)
+	ctx := context.Background()
+
+	// 根证书受信任时只下载中间证书
+	cert, urls, err := CompleteChain(ctx, http.DefaultClient, pki.cert(pki.leaf), pki.roots())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 2 || !slices.Equal(cert.Certificate[1], pki.inter.Raw) {
+		t.Errorf("completed chain has %v certificates, want leaf and intermediate", len(cert.Certificate))
+	}
+	if !slices.Equal(urls, []string{pki.server.URL + "/inter.der"}) {
+		t.Errorf("urls = %v, want only the intermediate url", urls)
+	}
+
+	// 根证书不受信任时继续下载到根证书为止，根证书不加入证书链
+	cert, urls, err = CompleteChain(ctx, http.DefaultClient, pki.cert(pki.leaf), x509.NewCertPool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Errorf("completed chain has %v certificates, want leaf and intermediate", len(cert.Certificate))
+	}
+	if !slices.Equal(urls, []string{pki.server.URL + "/inter.der", pki.server.URL + "/root.pem"}) {
+		t.Errorf("urls = %v, want the intermediate and root urls", urls)
+	}
+
+	// 证书链完整时不下载
+	cert, urls, err = CompleteChain(ctx, http.DefaultClient, pki.cert(pki.leaf, pki.inter), pki.roots())
+	if err != nil || len(urls) != 0 || len(cert.Certificate) != 2 {
+		t.Errorf("CompleteChain of a complete chain = %v certificates, %v, %v", len(cert.Certificate), urls, err)
+	}
+}
+
+func TestCompleteChainError(t *testing.T) {
+	pki := newTestPKI(t)
+	other := newTestPKI(t)
+	ctx := context.Background()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/other.der", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(other.inter.Raw)
+	})
+	mux.HandleFunc("/garbage", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not a certificate"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	closed := httptest.NewServer(mux)
+	closed.Close()
+
+	tests := []struct {
+		name string
+		urls []string
+		want string
+	}{
+		{"no issuer url", nil, "no issuer url found"},
+		{"wrong issuer", []string{server.URL + "/other.der"}, "is not the issuer"},
+		{"not found", []string{server.URL + "/missing"}, "404"},
+		{"not a certificate", []string{server.URL + "/garbage"}, "unable to fetch issuer"},
+		{"unreachable", []string{closed.URL + "/inter.der"}, "unable to fetch issuer"},
+	}
+	for _, tt := range tests {
+		_, _, err := CompleteChain(ctx, http.DefaultClient, pki.cert(pki.issue(t, tt.urls...)), pki.roots())
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: CompleteChain err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestChainWarnings(t *testing.T) {
+	pki := newTestPKI(t)
+	tests := []struct {
+		name  string
+		cert  *tls.Certificate
+		roots *x509.CertPool
+		want  string
+	}{
+		{"complete", pki.cert(pki.leaf, pki.inter), pki.roots(), ""},
+		{"missing intermediate", pki.cert(pki.leaf), pki.roots(), "missing intermediate certificate CN=Test Intermediate, will be fetched from " + pki.server.URL + "/inter.der"},
+		{"untrusted root", pki.cert(pki.leaf, pki.inter, pki.root), x509.NewCertPool(), "certificate CN=Test Root is self-signed and not trusted by system"},
+		{"trusted root", pki.cert(pki.leaf, pki.inter, pki.root), pki.roots(), ""},
+	}
+	for _, tt := range tests {
+		got := ChainWarnings(tt.cert, tt.roots)
+		if tt.want == "" && len(got) != 0 || tt.want != "" && !slices.Contains(got, tt.want) {
+			t.Errorf("%v: ChainWarnings = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// 没有AIA时只提示缺少的证书
+	got := ChainWarnings(pki.cert(pki.issue(t)), pki.roots())
+	if want := "missing intermediate certificate CN=Test Intermediate"; !slices.Contains(got, want) {
+		t.Errorf("ChainWarnings = %q, want %q", got, want)
+	}
+}
+
+func TestChainOrdered(t *testing.T) {
+	pki := newTestPKI(t)
+	encode := func(certs ...*x509.Certificate) []byte {
+		data := make([]byte, 0)
+		for _, c := range certs {
+			data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+		}
+		return data
+	}
+	cert := pki.cert(pki.leaf, pki.inter)
+	if !ChainOrdered(encode(pki.leaf, pki.inter), cert) {
+		t.Errorf("ChainOrdered of the same order = false, want true")
+	}
+	if ChainOrdered(encode(pki.inter, pki.leaf), cert) {
+		t.Errorf("ChainOrdered of the reversed order = true, want false")
+	}
+	if ChainOrdered(encode(pki.leaf, pki.inter, pki.root), cert) {
+		t.Errorf("ChainOrdered with an extra certificate = true, want false")
+	}
+}
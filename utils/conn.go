@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+)
+
+// PrefixConn 先读出已经预读的数据，再从连接中读取
+type PrefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func NewPrefixConn(conn net.Conn, prefix []byte) *PrefixConn {
+	return &PrefixConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(prefix), conn),
+	}
+}
+
+func (c *PrefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *PrefixConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Pipe 双向转发数据，任意一个方向结束后关闭写端，两个方向都结束后关闭连接
+func Pipe(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		closeWrite(a)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		closeWrite(b)
+	}()
+	wg.Wait()
+}
+
+func closeWrite(conn net.Conn) {
+	for {
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+			return
+		}
+		c, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			conn.Close()
+			return
+		}
+		conn = c.NetConn()
+	}
+}
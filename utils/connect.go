@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ExtendedConnectProtocol 返回RFC 8441/9220 extended CONNECT请求的:protocol，不是extended CONNECT时返回空
+func ExtendedConnectProtocol(req *http.Request) string {
+	if req.Method != http.MethodConnect {
+		return ""
+	}
+	// http2把:protocol放在header中
+	if protocol := req.Header.Get(":protocol"); protocol != "" {
+		return protocol
+	}
+	// http3把:protocol放在Proto中
+	if req.ProtoMajor == 3 && !strings.HasPrefix(req.Proto, "HTTP/") {
+		return req.Proto
+	}
+	return ""
+}
+
+// ParseConnectUdpTarget 解析RFC 9298 URI模板中的{target_host}/{target_port}/部分，
+// ipv6地址中的冒号需要百分号编码
+func ParseConnectUdpTarget(path string) (string, uint16, error) {
+	items := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(items) != 2 {
+		return "", 0, errors.New("malform connect-udp path, should be {target_host}/{target_port}/")
+	}
+
+	host, err := url.PathUnescape(items[0])
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(items[1], 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, errors.New("malform connect-udp target port")
+	}
+	if host == "" {
+		return "", 0, errors.New("malform connect-udp target host")
+	}
+	return host, uint16(port), nil
+}
+
+// NewWebSocketKey 生成转发给HTTP/1.1上游的Sec-WebSocket-Key，extended CONNECT请求中没有这个头部
+func NewWebSocketKey() string {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// FlushWriter 每次写入后立即发送给客户端，用于在http2/http3的请求流上转发隧道数据
+type FlushWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func NewFlushWriter(resp http.ResponseWriter) *FlushWriter {
+	return &FlushWriter{w: resp, rc: http.NewResponseController(resp)}
+}
+
+func (w *FlushWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, w.rc.Flush()
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// SplitHeaderList 把多个逗号分隔的头部值拆分成列表
+func SplitHeaderList(values []string) []string {
+	list := make([]string, 0)
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// ParseForwardedFor 从RFC 7239的Forwarded头部中按顺序取出所有for参数
+func ParseForwardedFor(values []string) []string {
+	list := make([]string, 0)
+	for _, element := range SplitHeaderList(values) {
+		for _, pair := range strings.Split(element, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(k, "for") {
+				continue
+			}
+			list = append(list, strings.Trim(v, `"`))
+		}
+	}
+	return list
+}
+
+// FormatForwardedNode 按RFC 7239格式化节点，ipv6地址需要加方括号和引号
+func FormatForwardedNode(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return "unknown"
+	}
+	if addr.Is6() {
+		return `"[` + addr.String() + `]"`
+	}
+	return addr.String()
+}
+
+// FormatForwardedValue 按RFC 7239格式化参数值，包含特殊字符时需要加引号
+func FormatForwardedValue(v string) string {
+	if strings.ContainsAny(v, `:[]";, `) {
+		return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+	return v
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestSplitHeaderList(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []string
+	}{
+		{nil, []string{}},
+		{[]string{""}, []string{}},
+		{[]string{"a"}, []string{"a"}},
+		{[]string{"a, b", "c"}, []string{"a", "b", "c"}},
+		{[]string{" a ,, b ,"}, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		if got := SplitHeaderList(tt.values); !slices.Equal(got, tt.want) {
+			t.Errorf("SplitHeaderList(%q) = %q, want %q", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestParseForwardedFor(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []string
+	}{
+		{nil, []string{}},
+		{[]string{"for=192.0.2.60"}, []string{"192.0.2.60"}},
+		{[]string{"For=192.0.2.60;proto=http;by=203.0.113.43"}, []string{"192.0.2.60"}},
+		{[]string{`for="[2001:db8::1]:4711"`}, []string{"[2001:db8::1]:4711"}},
+		{[]string{"for=192.0.2.43, for=198.51.100.17", "for=unknown"}, []string{"192.0.2.43", "198.51.100.17", "unknown"}},
+		{[]string{"proto=https;host=example.com"}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := ParseForwardedFor(tt.values); !slices.Equal(got, tt.want) {
+			t.Errorf("ParseForwardedFor(%q) = %q, want %q", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestFormatForwardedNode(t *testing.T) {
+	tests := []struct {
+		addr netip.Addr
+		want string
+	}{
+		{netip.Addr{}, "unknown"},
+		{netip.MustParseAddr("192.0.2.60"), "192.0.2.60"},
+		{netip.MustParseAddr("2001:db8::1"), `"[2001:db8::1]"`},
+	}
+	for _, tt := range tests {
+		if got := FormatForwardedNode(tt.addr); got != tt.want {
+			t.Errorf("FormatForwardedNode(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestFormatForwardedValue(t *testing.T) {
+	tests := []struct {
+		v    string
+		want string
+	}{
+		{"https", "https"},
+		{"example.com", "example.com"},
+		{"example.com:8443", `"example.com:8443"`},
+		{`a"b`, `"a\"b"`},
+		{"a b", `"a b"`},
+	}
+	for _, tt := range tests {
+		if got := FormatForwardedValue(tt.v); got != tt.want {
+			t.Errorf("FormatForwardedValue(%q) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestParseForwardedForRoundTrip(t *testing.T) {
+	for _, s := range []string{"192.0.2.60", "2001:db8::1"} {
+		addr := netip.MustParseAddr(s)
+		got := ParseForwardedFor([]string{"for=" + FormatForwardedNode(addr)})
+		want := FormatForwardedNode(addr)
+		if addr.Is6() {
+			want = "[" + s + "]"
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("round trip of %v = %q, want %q", s, got, want)
+		}
+	}
+}
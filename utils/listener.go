@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DispatchFunc 返回交给Accept调用者的连接，返回nil表示连接已经被处理
+type DispatchFunc = func(conn net.Conn) net.Conn
+
+// DispatchListener 在独立的协程中对新连接调用Dispatch，
+// 预读数据等耗时的操作不会阻塞其他连接的Accept
+type DispatchListener struct {
+	net.Listener
+	Dispatch DispatchFunc
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	// err 底层listener出错时的错误，在closeOnce中关闭done之前设置
+	err error
+}
+
+func NewDispatchListener(ln net.Listener, dispatch DispatchFunc) *DispatchListener {
+	l := &DispatchListener{
+		Listener: ln,
+		Dispatch: dispatch,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+func (l *DispatchListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.close(err)
+			return
+		}
+
+		go func() {
+			conn := l.Dispatch(conn)
+			if conn == nil {
+				return
+			}
+			select {
+			case l.conns <- conn:
+			case <-l.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (l *DispatchListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *DispatchListener) Close() error {
+	return l.close(nil)
+}
+
+// close 只有第一次关闭时记录原因，外部调用Close之后底层Accept返回的错误不再记录
+func (l *DispatchListener) close(reason error) error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		l.err = reason
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// ConnListener 把从其他地方得到的连接以net.Listener的形式交给server处理
+type ConnListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewConnListener(addr net.Addr) *ConnListener {
+	return &ConnListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Push 把连接交给Accept的调用者，listener已关闭时关闭连接并返回false
+func (l *ConnListener) Push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		conn.Close()
+		return false
+	}
+}
+
+func (l *ConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *ConnListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *ConnListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// errListener Accept在关闭前阻塞，之后返回指定的错误
+type errListener struct {
+	net.Listener
+	err    error
+	closed chan struct{}
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	<-l.closed
+	return nil, l.err
+}
+
+func (l *errListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func TestDispatchListenerClose(t *testing.T) {
+	// 外部关闭时返回net.ErrClosed，底层Accept返回的错误不影响结果
+	ln := &errListener{err: errors.New("accept failed"), closed: make(chan struct{})}
+	l := NewDispatchListener(ln, func(conn net.Conn) net.Conn { return conn })
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Accept after Close err = %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept did not return after Close")
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close err = %v, want %v", err, net.ErrClosed)
+	}
+	if err := l.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("second Close err = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestDispatchListenerAcceptError(t *testing.T) {
+	// 底层listener出错时Accept返回该错误
+	acceptErr := errors.New("accept failed")
+	ln := &errListener{err: acceptErr, closed: make(chan struct{})}
+	close(ln.closed)
+	l := NewDispatchListener(ln, func(conn net.Conn) net.Conn { return conn })
+
+	if _, err := l.Accept(); err != acceptErr {
+		t.Errorf("Accept err = %v, want %v", err, acceptErr)
+	}
+}
+
+func TestDispatchListenerDispatch(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 被Dispatch处理掉的连接不会交给Accept
+	handled := make(chan net.Conn, 1)
+	l := NewDispatchListener(ln, func(conn net.Conn) net.Conn {
+		buf := make([]byte, 1)
+		conn.Read(buf)
+		if buf[0] == 'h' {
+			handled <- conn
+			return nil
+		}
+		return NewPrefixConn(conn, buf)
+	})
+	defer l.Close()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c1.Write([]byte("h"))
+
+	c2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.Write([]byte("a"))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil || buf[0] != 'a' {
+		t.Errorf("Accept got %q, %v, want the connection that sent a", buf, err)
+	}
+
+	select {
+	case conn := <-handled:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Errorf("Dispatch did not handle the connection that sent h")
+	}
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// oidTLSFeature RFC 7633中的TLS Feature扩展，包含status_request时为Must-Staple证书
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// MustStaple 证书是否要求服务器必须提供OCSP Stapling
+func MustStaple(leaf *x509.Certificate) bool {
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(oidTLSFeature) {
+			continue
+		}
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			return false
+		}
+		for _, feature := range features {
+			// status_request
+			if feature == 5 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FetchOCSP 依次向证书中的每个OCSP地址查询，请求不超过255字节时先使用GET，失败后使用POST，
+// 返回校验过的响应和响应的地址
+func FetchOCSP(ctx context.Context, client *http.Client, leaf, issuer *x509.Certificate) (*ocsp.Response, string, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, "", errors.New("no ocsp server found in certificate")
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	errs := make([]error, 0)
+	for _, server := range leaf.OCSPServer {
+		der, err := queryOCSP(ctx, client, server, req)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", server, err))
+			continue
+		}
+
+		resp, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", server, err))
+			continue
+		}
+		return resp, server, nil
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+func queryOCSP(ctx context.Context, client *http.Client, server string, req []byte) ([]byte, error) {
+	// RFC 5019 GET请求需要对base64内容再做URL编码
+	encoded := url.QueryEscape(base64.StdEncoding.EncodeToString(req))
+	if len(encoded) <= 255 {
+		der, err := doOCSP(ctx, client, http.MethodGet, strings.TrimSuffix(server, "/")+"/"+encoded, http.NoBody)
+		if err == nil {
+			return der, nil
+		}
+	}
+	return doOCSP(ctx, client, http.MethodPost, server, bytes.NewReader(req))
+}
+
+func doOCSP(ctx context.Context, client *http.Client, method, uri string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/ocsp-request")
+	}
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
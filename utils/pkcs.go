@@ -0,0 +1,473 @@
+package utils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+var (
+	ErrIncorrectPassword = errors.New("incorrect password")
+	errUnsupportedPBE    = errors.New("unsupported encryption algorithm")
+
+	oidPBES2              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHmacWithSHA1       = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHmacWithSHA256     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHmacWithSHA384     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHmacWithSHA512     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC         = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidPBEWithSHAAnd3DES  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1               = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256             = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384             = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512             = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidDataContent        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKey   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509CertificateBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// DecryptPKCS8 解密ENCRYPTED PRIVATE KEY，返回未加密的PKCS#8数据
+func DecryptPKCS8(der []byte, password string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("malform encrypted private key: %w", err)
+	}
+	return pbeDecrypt(info.Algorithm, info.EncryptedData, password)
+}
+
+// pbeDecrypt 支持PBES2(PBKDF2+AES/3DES)和PKCS#12中常见的pbeWithSHAAnd3-KeyTripleDES-CBC
+func pbeDecrypt(algorithm pkix.AlgorithmIdentifier, data []byte, password string) ([]byte, error) {
+	var (
+		block cipher.Block
+		iv    []byte
+		err   error
+	)
+
+	switch {
+	case algorithm.Algorithm.Equal(oidPBES2):
+		block, iv, err = pbes2Cipher(algorithm.Parameters.FullBytes, password)
+	case algorithm.Algorithm.Equal(oidPBEWithSHAAnd3DES):
+		var params pbeParams
+		if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		bmp, err := bmpPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		key := pkcs12KDF(sha1.New, bmp, params.Salt, params.Iterations, 1, 24)
+		iv = pkcs12KDF(sha1.New, bmp, params.Salt, params.Iterations, 2, 8)
+		block, err = des.NewTripleDESCipher(key)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w %v", errUnsupportedPBE, algorithm.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 || len(iv) != block.BlockSize() {
+		return nil, errors.New("malform encrypted data")
+	}
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data)
+
+	// 密码错误时解密出来的填充基本不可能正确
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > block.BlockSize() || padding > len(plaintext) {
+		return nil, ErrIncorrectPassword
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, ErrIncorrectPassword
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+func pbes2Cipher(params []byte, password string) (cipher.Block, []byte, error) {
+	var p pbes2Params
+	if _, err := asn1.Unmarshal(params, &p); err != nil {
+		return nil, nil, err
+	}
+	if !p.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, fmt.Errorf("%w %v", errUnsupportedPBE, p.KeyDerivationFunc.Algorithm)
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(p.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, nil, err
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(p.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		keyLength int
+		newCipher func(key []byte) (cipher.Block, error)
+	)
+	switch scheme := p.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLength, newCipher = 16, aes.NewCipher
+	case scheme.Equal(oidAES192CBC):
+		keyLength, newCipher = 24, aes.NewCipher
+	case scheme.Equal(oidAES256CBC):
+		keyLength, newCipher = 32, aes.NewCipher
+	case scheme.Equal(oidDESEDE3CBC):
+		keyLength, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, nil, fmt.Errorf("%w %v", errUnsupportedPBE, scheme)
+	}
+
+	var (
+		key []byte
+		err error
+	)
+	switch prf := kdf.PRF.Algorithm; {
+	case len(prf) == 0 || prf.Equal(oidHmacWithSHA1):
+		key, err = pbkdf2.Key(sha1.New, password, kdf.Salt, kdf.IterationCount, keyLength)
+	case prf.Equal(oidHmacWithSHA256):
+		key, err = pbkdf2.Key(sha256.New, password, kdf.Salt, kdf.IterationCount, keyLength)
+	case prf.Equal(oidHmacWithSHA384):
+		key, err = pbkdf2.Key(sha512.New384, password, kdf.Salt, kdf.IterationCount, keyLength)
+	case prf.Equal(oidHmacWithSHA512):
+		key, err = pbkdf2.Key(sha512.New, password, kdf.Salt, kdf.IterationCount, keyLength)
+	default:
+		return nil, nil, fmt.Errorf("%w %v", errUnsupportedPBE, prf)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return block, iv, nil
+}
+
+// bmpPassword PKCS#12中的密码使用以0结尾的UTF-16BE编码
+func bmpPassword(password string) ([]byte, error) {
+	bmp := make([]byte, 0, len(password)*2+2)
+	for _, r := range password {
+		if r > 0xffff || utf16.IsSurrogate(r) {
+			return nil, errors.New("unsupported character in password")
+		}
+		bmp = append(bmp, byte(r>>8), byte(r))
+	}
+	return append(bmp, 0, 0), nil
+}
+
+// pkcs12KDF RFC 7292附录B中的密钥派生算法
+func pkcs12KDF(h func() hash.Hash, password, salt []byte, iterations int, id byte, size int) []byte {
+	var (
+		u = h().Size()
+		v = h().BlockSize()
+	)
+
+	fill := func(data []byte) []byte {
+		if len(data) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(data)+v-1)/v))
+		for i := range out {
+			out[i] = data[i%len(data)]
+		}
+		return out
+	}
+
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+
+	out := make([]byte, 0, size+u)
+	for len(out) < size {
+		a := h()
+		a.Write(d)
+		a.Write(i)
+		sum := a.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			a.Reset()
+			a.Write(sum)
+			sum = a.Sum(nil)
+		}
+		out = append(out, sum...)
+
+		b := fill(sum)
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				carry += int(i[j+k]) + int(b[k])
+				i[j+k] = byte(carry)
+				carry >>= 8
+			}
+		}
+	}
+	return out[:size]
+}
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue `asn1:"tag:0,explicit"`
+	Attributes asn1.RawValue `asn1:"optional"`
+}
+
+type certBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// DecodePKCS12 解析PKCS#12/PFX，返回其中所有的证书和私钥
+func DecodePKCS12(data []byte, password string) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	certs, key, err := decodePKCS12(data, password)
+	if errors.Is(err, errUnsupportedPBE) {
+		// 老的PFX中证书通常使用RC2加密，交给x/crypto/pkcs12处理
+		return decodeLegacyPKCS12(data, password)
+	}
+	return certs, key, err
+}
+
+func decodePKCS12(data []byte, password string) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	var pfx pfxPdu
+	if _, err := asn1.Unmarshal(data, &pfx); err != nil {
+		return nil, nil, fmt.Errorf("malform pkcs12: %w", err)
+	}
+	if pfx.Version != 3 || !pfx.AuthSafe.ContentType.Equal(oidDataContent) {
+		return nil, nil, errors.New("malform pkcs12, unsupported version or content type")
+	}
+
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return nil, nil, fmt.Errorf("malform pkcs12: %w", err)
+	}
+
+	if len(pfx.MacData.Mac.Algorithm.Algorithm) > 0 {
+		if err := verifyPKCS12Mac(&pfx.MacData, authSafe, password); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var contents []contentInfo
+	if _, err := asn1.Unmarshal(authSafe, &contents); err != nil {
+		return nil, nil, fmt.Errorf("malform pkcs12: %w", err)
+	}
+
+	var (
+		certs = make([]*x509.Certificate, 0)
+		key   crypto.PrivateKey
+	)
+	for _, ci := range contents {
+		var safeContents []byte
+		switch {
+		case ci.ContentType.Equal(oidDataContent):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &safeContents); err != nil {
+				return nil, nil, fmt.Errorf("malform pkcs12: %w", err)
+			}
+		case ci.ContentType.Equal(oidEncryptedData):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, nil, fmt.Errorf("malform pkcs12: %w", err)
+			}
+			var err error
+			safeContents, err = pbeDecrypt(ed.EncryptedContentInfo.ContentEncryptionAlgorithm, ed.EncryptedContentInfo.EncryptedContent, password)
+			if err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("unsupported pkcs12 content type %v", ci.ContentType)
+		}
+
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(safeContents, &bags); err != nil {
+			return nil, nil, fmt.Errorf("malform pkcs12: %w", err)
+		}
+
+		for _, bag := range bags {
+			var (
+				der []byte
+				err error
+			)
+			switch {
+			case bag.Id.Equal(oidCertBag):
+				var cb certBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return nil, nil, fmt.Errorf("malform pkcs12 cert bag: %w", err)
+				}
+				if !cb.Id.Equal(oidX509CertificateBag) {
+					continue
+				}
+				cert, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return nil, nil, err
+				}
+				certs = append(certs, cert)
+				continue
+			case bag.Id.Equal(oidKeyBag):
+				der = bag.Value.Bytes
+			case bag.Id.Equal(oidPKCS8ShroudedKey):
+				der, err = DecryptPKCS8(bag.Value.Bytes, password)
+				if err != nil {
+					return nil, nil, err
+				}
+			default:
+				continue
+			}
+
+			if key != nil {
+				return nil, nil, errors.New("more than one private key found in pkcs12")
+			}
+			key, err = x509.ParsePKCS8PrivateKey(der)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return certs, key, nil
+}
+
+func verifyPKCS12Mac(md *macData, data []byte, password string) error {
+	var h func() hash.Hash
+	switch alg := md.Mac.Algorithm.Algorithm; {
+	case alg.Equal(oidSHA1):
+		h = sha1.New
+	case alg.Equal(oidSHA256):
+		h = sha256.New
+	case alg.Equal(oidSHA384):
+		h = sha512.New384
+	case alg.Equal(oidSHA512):
+		h = sha512.New
+	default:
+		return fmt.Errorf("%w %v", errUnsupportedPBE, alg)
+	}
+
+	bmp, err := bmpPassword(password)
+	if err != nil {
+		return err
+	}
+	key := pkcs12KDF(h, bmp, md.MacSalt, md.Iterations, 3, h().Size())
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), md.Mac.Digest) {
+		return ErrIncorrectPassword
+	}
+	return nil
+}
+
+func decodeLegacyPKCS12(data []byte, password string) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+			return nil, nil, ErrIncorrectPassword
+		}
+		return nil, nil, fmt.Errorf("malform pkcs12: %w", err)
+	}
+
+	var (
+		certs = make([]*x509.Certificate, 0)
+		key   crypto.PrivateKey
+	)
+	for _, block := range blocks {
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs = append(certs, cert)
+			continue
+		}
+
+		if key != nil {
+			return nil, nil, errors.New("more than one private key found in pkcs12")
+		}
+		// x/crypto/pkcs12输出的私钥是PKCS#1或SEC1格式
+		if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+			key = k
+		} else if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+			key = k
+		} else {
+			return nil, nil, errors.New("unsupported private key in pkcs12")
+		}
+	}
+	return certs, key, nil
+}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testdata/pkcs中的文件由testdata/pkcs/gen.sh用openssl 3生成
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "pkcs", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func keyType(key any) string {
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		return "ecdsa"
+	case *rsa.PrivateKey:
+		return "rsa"
+	case ed25519.PrivateKey:
+		return "ed25519"
+	}
+	return "unknown"
+}
+
+func TestParseCertPKCS12(t *testing.T) {
+	tests := []struct {
+		file     string
+		password string
+		cn       string
+		chain    int
+		key      string
+	}{
+		{"modern.p12", "secret", "leaf.test", 2, "ecdsa"},
+		{"legacy.p12", "secret", "leaf.test", 2, "ecdsa"},
+		{"empty.p12", "", "leaf.test", 2, "ecdsa"},
+		{"unicode.p12", "пароль密码", "leaf.test", 2, "ecdsa"},
+		{"aes128.p12", "secret", "leaf.test", 2, "ecdsa"},
+		{"des3.p12", "secret", "leaf.test", 2, "ecdsa"},
+		{"sha512.p12", "secret", "leaf.test", 2, "ecdsa"},
+		{"rsa.p12", "secret", "rsa.test", 2, "rsa"},
+		{"ed25519.p12", "secret", "ed25519.test", 1, "ed25519"},
+	}
+	for _, tt := range tests {
+		cert, err := ParseCert(readTestdata(t, tt.file), tt.password)
+		if err != nil {
+			t.Errorf("%v: ParseCert: %v", tt.file, err)
+			continue
+		}
+		if cert.Leaf.Subject.CommonName != tt.cn {
+			t.Errorf("%v: leaf %v, want %v", tt.file, cert.Leaf.Subject.CommonName, tt.cn)
+		}
+		if len(cert.Certificate) != tt.chain {
+			t.Errorf("%v: chain length %v, want %v", tt.file, len(cert.Certificate), tt.chain)
+		}
+		if got := keyType(cert.PrivateKey); got != tt.key {
+			t.Errorf("%v: key type %v, want %v", tt.file, got, tt.key)
+		}
+	}
+}
+
+func TestParseCertChainOrder(t *testing.T) {
+	join := func(files ...string) []byte {
+		data := make([]byte, 0)
+		for _, file := range files {
+			data = append(data, readTestdata(t, file)...)
+		}
+		return data
+	}
+
+	tests := []struct {
+		files []string
+		want  []string
+	}{
+		// 按私钥找到叶子证书，中间证书跟在后面，无关的证书放到最后
+		{[]string{"ca.crt", "ed25519.crt", "leaf.crt", "leaf.key"}, []string{"leaf.test", "Test CA", "ed25519.test"}},
+		{[]string{"ca.crt", "leaf.crt", "rsa.crt", "rsa.key"}, []string{"rsa.test", "Test CA", "leaf.test"}},
+		// 没有私钥时不是其他证书签发者的那张是叶子证书
+		{[]string{"ca.crt", "leaf.crt"}, []string{"leaf.test", "Test CA"}},
+		{[]string{"leaf.crt", "ca.crt"}, []string{"leaf.test", "Test CA"}},
+	}
+	for _, tt := range tests {
+		cert, err := ParseCert(join(tt.files...), "")
+		if err != nil {
+			t.Errorf("%v: ParseCert: %v", tt.files, err)
+			continue
+		}
+		got := make([]string, 0)
+		for _, der := range cert.Certificate {
+			c, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, c.Subject.CommonName)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%v: chain %v, want %v", tt.files, got, tt.want)
+		}
+		if cert.Leaf.Subject.CommonName != tt.want[0] {
+			t.Errorf("%v: leaf %v, want %v", tt.files, cert.Leaf.Subject.CommonName, tt.want[0])
+		}
+	}
+
+	// 私钥与证书不匹配
+	for _, files := range [][]string{
+		{"ca.crt", "leaf.crt", "rsa.key"},
+		{"leaf.crt", "rsa.key"},
+	} {
+		if _, err := ParseCert(join(files...), ""); err == nil {
+			t.Errorf("%v: ParseCert with mismatched key should fail", files)
+		}
+	}
+}
+
+func TestDecodePKCS12IncorrectPassword(t *testing.T) {
+	tests := []struct {
+		file     string
+		password string
+	}{
+		{"modern.p12", "wrong"},
+		{"modern.p12", ""},
+		{"legacy.p12", "wrong"},
+		{"empty.p12", "secret"},
+		{"unicode.p12", "пароль"},
+		{"aes128.p12", "wrong"},
+		{"des3.p12", "wrong"},
+		{"sha512.p12", "wrong"},
+		{"ed25519.p12", "wrong"},
+	}
+	for _, tt := range tests {
+		_, _, err := DecodePKCS12(readTestdata(t, tt.file), tt.password)
+		if !errors.Is(err, ErrIncorrectPassword) {
+			t.Errorf("%v: DecodePKCS12 with password %q err = %v, want %v", tt.file, tt.password, err, ErrIncorrectPassword)
+		}
+	}
+}
+
+func TestParseCertEncryptedPKCS8(t *testing.T) {
+	leaf := readTestdata(t, "leaf.crt")
+	want, err := ParseCert(append(readTestdata(t, "leaf.key"), leaf...), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{
+		"leaf-aes256-sha512.key",
+		"leaf-aes128.key",
+		"leaf-des3.key",
+		"leaf-pbe-sha1-3des.key",
+	} {
+		data := append(readTestdata(t, file), leaf...)
+		cert, err := ParseCert(data, "secret")
+		if err != nil {
+			t.Errorf("%v: ParseCert: %v", file, err)
+			continue
+		}
+		if !cert.PrivateKey.(*ecdsa.PrivateKey).Equal(want.PrivateKey) {
+			t.Errorf("%v: decrypted key does not match leaf.key", file)
+		}
+
+		if _, err := ParseCert(data, "wrong"); err == nil {
+			t.Errorf("%v: ParseCert with wrong password should fail", file)
+		}
+		if _, err := ParseCert(data, ""); err == nil {
+			t.Errorf("%v: ParseCert without password should fail", file)
+		}
+	}
+}
+
+func TestPKCS12KDF(t *testing.T) {
+	// RFC 7292附录B的算法，期望值来自openssl的PKCS12_key_gen_uni
+	bmp, err := bmpPassword("smeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte{0x0a, 0x58, 0xcf, 0x64, 0x53, 0x0d, 0x82, 0x3f}
+	key := pkcs12KDF(sha1.New, bmp, salt, 1, 1, 24)
+	want := []byte{
+		0x8a, 0xaa, 0xe6, 0x29, 0x7b, 0x6c, 0xb0, 0x46, 0x42, 0xab, 0x5b, 0x07, 0x78, 0x51, 0x28, 0x4e,
+		0xb7, 0x12, 0x8f, 0x1a, 0x2a, 0x7f, 0xbc, 0xa3,
+	}
+	if string(key) != string(want) {
+		t.Errorf("pkcs12KDF = %x, want %x", key, want)
+	}
+}
+
+func TestParseCertUnknownFormat(t *testing.T) {
+	for _, data := range []string{"", "not a certificate", "MIIB...base64 without pem header"} {
+		_, err := ParseCert([]byte(data), "")
+		if err == nil || err.Error() != "no PEM certificate or PKCS#12 data found" {
+			t.Errorf("ParseCert(%q) err = %v, want no PEM certificate or PKCS#12 data found", data, err)
+		}
+	}
+
+	// 以SEQUENCE开头但不是PKCS#12时返回解析错误
+	if _, err := ParseCert([]byte{0x30, 0x03, 0x02, 0x01, 0x01}, ""); err == nil {
+		t.Errorf("ParseCert with malform DER should fail")
+	}
+}
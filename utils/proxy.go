@@ -1,13 +1,48 @@
 package utils
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+)
 
 type ReverseProxyDirector = func(req *http.Request) (resp *http.Response, header http.Header, err error)
 
+// UpstreamTransport 同一种上游TLS策略下使用的一组Transport
+type UpstreamTransport struct {
+	Http  http.RoundTripper
+	Http3 http.RoundTripper
+
+	// ProxyProto 用于需要向上游发送PROXY protocol头部的请求
+	ProxyProto http.RoundTripper
+}
+
+func (t *UpstreamTransport) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	for _, rt := range []http.RoundTripper{t.Http, t.Http3, t.ProxyProto} {
+		if c, ok := rt.(closeIdler); ok {
+			c.CloseIdleConnections()
+		}
+	}
+}
+
+type upstreamTransportKey struct{}
+
+// WithUpstreamTransport 指定请求使用的上游Transport
+func WithUpstreamTransport(ctx context.Context, t *UpstreamTransport) context.Context {
+	return context.WithValue(ctx, upstreamTransportKey{}, t)
+}
+
+func UpstreamTransportFromContext(ctx context.Context) *UpstreamTransport {
+	t, _ := ctx.Value(upstreamTransportKey{}).(*UpstreamTransport)
+	return t
+}
+
 type ReverseProxyTransport struct {
-	Director       ReverseProxyDirector
-	HttpTransport  http.RoundTripper
-	Http3Transport http.RoundTripper
+	Director ReverseProxyDirector
+	// Transport 请求上下文中没有指定上游Transport时使用
+	Transport *UpstreamTransport
 }
 
 func (t *ReverseProxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -17,11 +52,18 @@ func (t *ReverseProxyTransport) RoundTrip(req *http.Request) (*http.Response, er
 	}
 
 	if resp == nil {
+		transport := UpstreamTransportFromContext(req.Context())
+		if transport == nil {
+			transport = t.Transport
+		}
+
 		if req.URL.Scheme == "http3" {
 			req.URL.Scheme = "https"
-			resp, err = t.Http3Transport.RoundTrip(req)
+			resp, err = transport.Http3.RoundTrip(req)
+		} else if UpstreamProxyProtoFromContext(req.Context()) != nil {
+			resp, err = transport.ProxyProto.RoundTrip(req)
 		} else {
-			resp, err = t.HttpTransport.RoundTrip(req)
+			resp, err = transport.Http.RoundTrip(req)
 		}
 		if err != nil {
 			return resp, err
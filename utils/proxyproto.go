@@ -0,0 +1,529 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProxyProtoCommandLocal byte = 0x00
+	ProxyProtoCommandProxy byte = 0x01
+
+	ProxyProtoTLVTypeALPN      byte = 0x01
+	ProxyProtoTLVTypeAuthority byte = 0x02
+	ProxyProtoTLVTypeCRC32C    byte = 0x03
+	ProxyProtoTLVTypeNoop      byte = 0x04
+	ProxyProtoTLVTypeUniqueID  byte = 0x05
+	ProxyProtoTLVTypeSSL       byte = 0x20
+	ProxyProtoTLVTypeNetNS     byte = 0x30
+
+	ProxyProtoSSLSubTypeVersion byte = 0x21
+	ProxyProtoSSLSubTypeCN      byte = 0x22
+	ProxyProtoSSLSubTypeCipher  byte = 0x23
+	ProxyProtoSSLSubTypeSigAlg  byte = 0x24
+	ProxyProtoSSLSubTypeKeyAlg  byte = 0x25
+
+	ProxyProtoSSLClientSSL      byte = 0x01
+	ProxyProtoSSLClientCertConn byte = 0x02
+	ProxyProtoSSLClientCertSess byte = 0x04
+
+	DefaultProxyProtoHeaderTimeout = 5 * time.Second
+)
+
+var (
+	ErrProxyProtoNoHeader = errors.New("proxy protocol header not found")
+	ErrProxyProtoMalform  = errors.New("malform proxy protocol header")
+
+	proxyProtoV1Prefix  = []byte("PROXY ")
+	proxyProtoV2Sign    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	proxyProtoV1MaxSize = 107
+)
+
+type ProxyProtoTLV struct {
+	Type  byte
+	Value []byte
+}
+
+type ProxyProtoSSL struct {
+	Client  byte
+	Verify  uint32
+	Version string
+	CN      string
+	Cipher  string
+	SigAlg  string
+	KeyAlg  string
+}
+
+type ProxyProtoHeader struct {
+	Version     int
+	Command     byte
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []ProxyProtoTLV
+}
+
+// Format 按Version把头部编码成v1或v2格式，地址族不一致时统一转换成ipv6
+func (h *ProxyProtoHeader) Format() ([]byte, error) {
+	var src, dst netip.AddrPort
+	if h.Command == ProxyProtoCommandProxy && h.Source != nil && h.Destination != nil {
+		src = ParseAddrPort(h.Source.String())
+		dst = ParseAddrPort(h.Destination.String())
+	}
+
+	local := !src.IsValid() || !dst.IsValid()
+	if !local && src.Addr().Is4() != dst.Addr().Is4() {
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+
+	switch h.Version {
+	case 1:
+		if local {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP4"
+		if src.Addr().Is6() {
+			family = "TCP6"
+		}
+		return fmt.Appendf(nil, "PROXY %v %v %v %v %v\r\n",
+			family, src.Addr(), dst.Addr(), src.Port(), dst.Port()), nil
+	case 2:
+		buf := bytes.NewBuffer(nil)
+		buf.Write(proxyProtoV2Sign)
+		if local {
+			buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return buf.Bytes(), nil
+		}
+
+		family := byte(0x11)
+		if src.Addr().Is6() {
+			family = 0x21
+		}
+		buf.Write([]byte{0x21, family})
+
+		addrs := append(src.Addr().AsSlice(), dst.Addr().AsSlice()...)
+		addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+		addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+		for _, tlv := range h.TLVs {
+			addrs = append(addrs, tlv.Type)
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(len(tlv.Value)))
+			addrs = append(addrs, tlv.Value...)
+		}
+
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(addrs))))
+		buf.Write(addrs)
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported proxy protocol version %v", h.Version)
+}
+
+func (h *ProxyProtoHeader) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (h *ProxyProtoHeader) Authority() string {
+	v, _ := h.TLV(ProxyProtoTLVTypeAuthority)
+	return string(v)
+}
+
+func (h *ProxyProtoHeader) ALPN() string {
+	v, _ := h.TLV(ProxyProtoTLVTypeALPN)
+	return string(v)
+}
+
+func (h *ProxyProtoHeader) SSL() (*ProxyProtoSSL, bool) {
+	v, ok := h.TLV(ProxyProtoTLVTypeSSL)
+	if !ok || len(v) < 5 {
+		return nil, false
+	}
+
+	ssl := &ProxyProtoSSL{
+		Client: v[0],
+		Verify: binary.BigEndian.Uint32(v[1:5]),
+	}
+	tlvs, err := parseProxyProtoTLVs(v[5:])
+	if err != nil {
+		return nil, false
+	}
+	for _, tlv := range tlvs {
+		switch tlv.Type {
+		case ProxyProtoSSLSubTypeVersion:
+			ssl.Version = string(tlv.Value)
+		case ProxyProtoSSLSubTypeCN:
+			ssl.CN = string(tlv.Value)
+		case ProxyProtoSSLSubTypeCipher:
+			ssl.Cipher = string(tlv.Value)
+		case ProxyProtoSSLSubTypeSigAlg:
+			ssl.SigAlg = string(tlv.Value)
+		case ProxyProtoSSLSubTypeKeyAlg:
+			ssl.KeyAlg = string(tlv.Value)
+		}
+	}
+	return ssl, true
+}
+
+// ReadProxyProtoHeader 读取并解析v1或v2格式的PROXY protocol头部
+func ReadProxyProtoHeader(r *bufio.Reader) (*ProxyProtoHeader, error) {
+	sign, err := r.Peek(len(proxyProtoV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sign, proxyProtoV1Prefix) {
+		return readProxyProtoV1Header(r)
+	}
+
+	sign, err = r.Peek(len(proxyProtoV2Sign))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sign, proxyProtoV2Sign) {
+		return readProxyProtoV2Header(r)
+	}
+	return nil, ErrProxyProtoNoHeader
+}
+
+func readProxyProtoV1Header(r *bufio.Reader) (*ProxyProtoHeader, error) {
+	line := make([]byte, 0, proxyProtoV1MaxSize)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= proxyProtoV1MaxSize {
+			return nil, ErrProxyProtoMalform
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyProtoMalform
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &ProxyProtoHeader{Version: 1, Command: ProxyProtoCommandProxy}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		header.Command = ProxyProtoCommandLocal
+		return header, nil
+	}
+	if len(fields) != 6 {
+		return nil, ErrProxyProtoMalform
+	}
+
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, ErrProxyProtoMalform
+	}
+	dst, err := netip.ParseAddr(fields[3])
+	if err != nil {
+		return nil, ErrProxyProtoMalform
+	}
+	switch fields[1] {
+	case "TCP4":
+		if !src.Is4() || !dst.Is4() {
+			return nil, ErrProxyProtoMalform
+		}
+	case "TCP6":
+		if !src.Is6() || !dst.Is6() {
+			return nil, ErrProxyProtoMalform
+		}
+	default:
+		return nil, ErrProxyProtoMalform
+	}
+
+	srcPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrProxyProtoMalform
+	}
+	dstPort, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return nil, ErrProxyProtoMalform
+	}
+
+	header.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(srcPort)))
+	header.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, uint16(dstPort)))
+	return header, nil
+}
+
+func readProxyProtoV2Header(r *bufio.Reader) (*ProxyProtoHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	if fixed[12]>>4 != 0x02 {
+		return nil, ErrProxyProtoMalform
+	}
+
+	header := &ProxyProtoHeader{Version: 2, Command: fixed[12] & 0x0f}
+	if header.Command != ProxyProtoCommandLocal && header.Command != ProxyProtoCommandProxy {
+		return nil, ErrProxyProtoMalform
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	var addrLen int
+	family, proto := fixed[13]>>4, fixed[13]&0x0f
+	switch family {
+	case 0x01:
+		addrLen = 12
+	case 0x02:
+		addrLen = 36
+	case 0x03:
+		addrLen = 216
+	}
+	if len(payload) < addrLen {
+		return nil, ErrProxyProtoMalform
+	}
+
+	tlvs, err := parseProxyProtoTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	header.TLVs = tlvs
+
+	// LOCAL命令（如负载均衡的健康检查）以及未知协议族都使用连接本身的地址
+	if header.Command == ProxyProtoCommandLocal || (proto != 0x01 && proto != 0x02) {
+		return header, nil
+	}
+
+	switch family {
+	case 0x01:
+		src := netip.AddrFrom4([4]byte(payload[0:4]))
+		dst := netip.AddrFrom4([4]byte(payload[4:8]))
+		header.Source = proxyProtoAddr(proto, src, binary.BigEndian.Uint16(payload[8:10]))
+		header.Destination = proxyProtoAddr(proto, dst, binary.BigEndian.Uint16(payload[10:12]))
+	case 0x02:
+		src := netip.AddrFrom16([16]byte(payload[0:16]))
+		dst := netip.AddrFrom16([16]byte(payload[16:32]))
+		header.Source = proxyProtoAddr(proto, src, binary.BigEndian.Uint16(payload[32:34]))
+		header.Destination = proxyProtoAddr(proto, dst, binary.BigEndian.Uint16(payload[34:36]))
+	}
+	return header, nil
+}
+
+func proxyProtoAddr(proto byte, addr netip.Addr, port uint16) net.Addr {
+	if proto == 0x02 {
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, port))
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port))
+}
+
+func parseProxyProtoTLVs(data []byte) ([]ProxyProtoTLV, error) {
+	tlvs := make([]ProxyProtoTLV, 0)
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, ErrProxyProtoMalform
+		}
+		size := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+size {
+			return nil, ErrProxyProtoMalform
+		}
+		tlvs = append(tlvs, ProxyProtoTLV{
+			Type:  data[0],
+			Value: data[3 : 3+size],
+		})
+		data = data[3+size:]
+	}
+	return tlvs, nil
+}
+
+// ProxyProtoListener 对来自允许地址的连接解析PROXY protocol头部，
+// 其他来源的连接原样返回
+type ProxyProtoListener struct {
+	net.Listener
+	Allow         []netip.Prefix
+	HeaderTimeout time.Duration
+}
+
+func (l *ProxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// 允许列表为空时不信任任何来源，避免客户端伪造头部冒充其他地址
+	if !PrefixesContain(l.Allow, ParseAddr(conn.RemoteAddr().String())) {
+		return conn, nil
+	}
+
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultProxyProtoHeaderTimeout
+	}
+	return &ProxyProtoConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: timeout,
+	}, nil
+}
+
+// ProxyProtoConn 在第一次读取或者获取地址时才解析头部，避免阻塞Accept
+type ProxyProtoConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *ProxyProtoHeader
+	err    error
+
+	// readDeadline 调用方设置的读超时，解析完头部后恢复
+	deadlineLock sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *ProxyProtoConn) init() {
+	c.once.Do(func() {
+		c.deadlineLock.Lock()
+		deadline := c.readDeadline
+		c.deadlineLock.Unlock()
+
+		headerDeadline := time.Now().Add(c.timeout)
+		if !deadline.IsZero() && deadline.Before(headerDeadline) {
+			headerDeadline = deadline
+		}
+		c.Conn.SetReadDeadline(headerDeadline)
+		c.header, c.err = ReadProxyProtoHeader(c.reader)
+
+		c.deadlineLock.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.deadlineLock.Unlock()
+		if c.err != nil {
+			c.err = fmt.Errorf("read proxy protocol header from %v: %w", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *ProxyProtoConn) SetDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *ProxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *ProxyProtoConn) Header() (*ProxyProtoHeader, error) {
+	c.init()
+	return c.header, c.err
+}
+
+func (c *ProxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *ProxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *ProxyProtoConn) LocalAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NetConn 返回底层连接，Pipe需要通过它关闭写端
+func (c *ProxyProtoConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+type proxyProtoConnKey struct{}
+
+// WithProxyProtoConn 用于http.Server的ConnContext，把连接挂到context上以便后续取出头部
+func WithProxyProtoConn(ctx context.Context, conn net.Conn) context.Context {
+	for {
+		if c, ok := conn.(*ProxyProtoConn); ok {
+			return context.WithValue(ctx, proxyProtoConnKey{}, c)
+		}
+		c, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return ctx
+		}
+		conn = c.NetConn()
+	}
+}
+
+func ProxyProtoHeaderFromContext(ctx context.Context) *ProxyProtoHeader {
+	c, ok := ctx.Value(proxyProtoConnKey{}).(*ProxyProtoConn)
+	if !ok {
+		return nil
+	}
+	header, _ := c.Header()
+	return header
+}
+
+type upstreamProxyProtoKey struct{}
+
+// WithUpstreamProxyProto 设置向上游建立连接时需要发送的头部
+func WithUpstreamProxyProto(ctx context.Context, header *ProxyProtoHeader) context.Context {
+	return context.WithValue(ctx, upstreamProxyProtoKey{}, header)
+}
+
+func UpstreamProxyProtoFromContext(ctx context.Context) *ProxyProtoHeader {
+	header, _ := ctx.Value(upstreamProxyProtoKey{}).(*ProxyProtoHeader)
+	return header
+}
+
+type DialContextFunc = func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ProxyProtoDialContext 建立连接后先写入context中携带的头部，
+// 使用它的Transport不能复用连接，否则会把不同客户端的请求混在一起
+func ProxyProtoDialContext(dial DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		header := UpstreamProxyProtoFromContext(ctx)
+		if header == nil {
+			return nil, errors.New("proxy protocol header missing in context")
+		}
+
+		data, err := header.Format()
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(data); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,387 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.Network() + " " + addr.String()
+}
+
+func TestReadProxyProtoHeaderV1(t *testing.T) {
+	tests := []struct {
+		input   string
+		command byte
+		src     string
+		dst     string
+		err     error
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", ProxyProtoCommandProxy, "tcp 192.0.2.1:56324", "tcp 198.51.100.1:443", nil},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", ProxyProtoCommandProxy, "tcp [2001:db8::1]:56324", "tcp [2001:db8::2]:443", nil},
+		{"PROXY UNKNOWN\r\n", ProxyProtoCommandLocal, "", "", nil},
+		{"PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 443\r\n", ProxyProtoCommandLocal, "", "", nil},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n", 0, "", "", ErrProxyProtoMalform},
+		{"PROXY TCP6 192.0.2.1 198.51.100.1 56324 443\r\n", 0, "", "", ErrProxyProtoMalform},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", 0, "", "", ErrProxyProtoMalform},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", 0, "", "", ErrProxyProtoMalform},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 65536\r\n", 0, "", "", ErrProxyProtoMalform},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", 0, "", "", ErrProxyProtoMalform},
+		{"PROXY " + strings.Repeat("x", 120) + "\r\n", 0, "", "", ErrProxyProtoMalform},
+		{"GET / HTTP/1.1\r\n", 0, "", "", ErrProxyProtoNoHeader},
+	}
+	for _, tt := range tests {
+		header, err := ReadProxyProtoHeader(bufio.NewReader(strings.NewReader(tt.input + "payload")))
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("ReadProxyProtoHeader(%q) err = %v, want %v", tt.input, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadProxyProtoHeader(%q): %v", tt.input, err)
+			continue
+		}
+		if header.Version != 1 || header.Command != tt.command ||
+			addrString(header.Source) != tt.src || addrString(header.Destination) != tt.dst {
+			t.Errorf("ReadProxyProtoHeader(%q) = %+v", tt.input, header)
+		}
+	}
+}
+
+func proxyProtoV2(command, family byte, payload []byte) []byte {
+	b := append([]byte{}, proxyProtoV2Sign...)
+	b = append(b, 0x20|command, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func proxyProtoTLV(t byte, value []byte) []byte {
+	b := []byte{t}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+func TestReadProxyProtoHeaderV2(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...)
+	ipv6 = append(ipv6, 0xdc, 0x04, 0x01, 0xbb)
+	tlvs := append(proxyProtoTLV(ProxyProtoTLVTypeALPN, []byte("h2")), proxyProtoTLV(ProxyProtoTLVTypeAuthority, []byte("example.com"))...)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		command byte
+		src     string
+		dst     string
+		tlvs    int
+		err     error
+	}{
+		{"tcp4", proxyProtoV2(ProxyProtoCommandProxy, 0x11, ipv4), ProxyProtoCommandProxy, "tcp 192.0.2.1:56324", "tcp 198.51.100.1:443", 0, nil},
+		{"udp4", proxyProtoV2(ProxyProtoCommandProxy, 0x12, ipv4), ProxyProtoCommandProxy, "udp 192.0.2.1:56324", "udp 198.51.100.1:443", 0, nil},
+		{"tcp6", proxyProtoV2(ProxyProtoCommandProxy, 0x21, ipv6), ProxyProtoCommandProxy, "tcp [2001:db8::1]:56324", "tcp [2001:db8::2]:443", 0, nil},
+		{"tlvs", proxyProtoV2(ProxyProtoCommandProxy, 0x11, append(ipv4, tlvs...)), ProxyProtoCommandProxy, "tcp 192.0.2.1:56324", "tcp 198.51.100.1:443", 2, nil},
+		{"local", proxyProtoV2(ProxyProtoCommandLocal, 0x00, nil), ProxyProtoCommandLocal, "", "", 0, nil},
+		{"local with addr", proxyProtoV2(ProxyProtoCommandLocal, 0x11, ipv4), ProxyProtoCommandLocal, "", "", 0, nil},
+		{"unspec", proxyProtoV2(ProxyProtoCommandProxy, 0x00, tlvs), ProxyProtoCommandProxy, "", "", 2, nil},
+		{"unknown command", proxyProtoV2(0x02, 0x11, ipv4), 0, "", "", 0, ErrProxyProtoMalform},
+		{"short addr", proxyProtoV2(ProxyProtoCommandProxy, 0x21, ipv4), 0, "", "", 0, ErrProxyProtoMalform},
+		{"short tlv", proxyProtoV2(ProxyProtoCommandProxy, 0x11, append(ipv4, tlvs[:len(tlvs)-1]...)), 0, "", "", 0, ErrProxyProtoMalform},
+		{"truncated", proxyProtoV2(ProxyProtoCommandProxy, 0x11, ipv4)[:20], 0, "", "", 0, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		header, err := ReadProxyProtoHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%v: ReadProxyProtoHeader err = %v, want %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: ReadProxyProtoHeader: %v", tt.name, err)
+			continue
+		}
+		if header.Version != 2 || header.Command != tt.command || len(header.TLVs) != tt.tlvs ||
+			addrString(header.Source) != tt.src || addrString(header.Destination) != tt.dst {
+			t.Errorf("%v: ReadProxyProtoHeader = %+v", tt.name, header)
+		}
+	}
+
+	// 版本不是2时不是合法的v2头部
+	input := proxyProtoV2(ProxyProtoCommandProxy, 0x11, ipv4)
+	input[12] = 0x11
+	if _, err := ReadProxyProtoHeader(bufio.NewReader(bytes.NewReader(input))); !errors.Is(err, ErrProxyProtoMalform) {
+		t.Errorf("ReadProxyProtoHeader with version 1 err = %v, want %v", err, ErrProxyProtoMalform)
+	}
+}
+
+func TestProxyProtoHeaderTLV(t *testing.T) {
+	ssl := []byte{ProxyProtoSSLClientSSL | ProxyProtoSSLClientCertConn, 0, 0, 0, 0}
+	ssl = append(ssl, proxyProtoTLV(ProxyProtoSSLSubTypeVersion, []byte("TLSv1.3"))...)
+	ssl = append(ssl, proxyProtoTLV(ProxyProtoSSLSubTypeCN, []byte("client"))...)
+	ssl = append(ssl, proxyProtoTLV(ProxyProtoSSLSubTypeCipher, []byte("TLS_AES_128_GCM_SHA256"))...)
+
+	header := &ProxyProtoHeader{TLVs: []ProxyProtoTLV{
+		{Type: ProxyProtoTLVTypeALPN, Value: []byte("h2")},
+		{Type: ProxyProtoTLVTypeAuthority, Value: []byte("example.com")},
+		{Type: ProxyProtoTLVTypeSSL, Value: ssl},
+	}}
+	if got := header.ALPN(); got != "h2" {
+		t.Errorf("ALPN() = %v, want h2", got)
+	}
+	if got := header.Authority(); got != "example.com" {
+		t.Errorf("Authority() = %v, want example.com", got)
+	}
+	if _, ok := header.TLV(ProxyProtoTLVTypeNetNS); ok {
+		t.Errorf("TLV(NetNS) found, want missing")
+	}
+
+	got, ok := header.SSL()
+	want := &ProxyProtoSSL{
+		Client:  ProxyProtoSSLClientSSL | ProxyProtoSSLClientCertConn,
+		Version: "TLSv1.3",
+		CN:      "client",
+		Cipher:  "TLS_AES_128_GCM_SHA256",
+	}
+	if !ok || *got != *want {
+		t.Errorf("SSL() = %+v, %v, want %+v", got, ok, want)
+	}
+
+	for _, v := range [][]byte{ssl[:4], append(append([]byte{}, ssl...), 0x21, 0x00)} {
+		header := &ProxyProtoHeader{TLVs: []ProxyProtoTLV{{Type: ProxyProtoTLVTypeSSL, Value: v}}}
+		if _, ok := header.SSL(); ok {
+			t.Errorf("SSL() with malform value %x should fail", v)
+		}
+	}
+}
+
+func TestProxyProtoHeaderFormat(t *testing.T) {
+	tcp := func(s string) net.Addr { return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s)) }
+
+	tests := []struct {
+		src     net.Addr
+		dst     net.Addr
+		command byte
+		v1      string
+		wantSrc string
+		wantDst string
+	}{
+		{tcp("192.0.2.1:56324"), tcp("198.51.100.1:443"), ProxyProtoCommandProxy,
+			"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "tcp 192.0.2.1:56324", "tcp 198.51.100.1:443"},
+		{tcp("[2001:db8::1]:56324"), tcp("[2001:db8::2]:443"), ProxyProtoCommandProxy,
+			"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "tcp [2001:db8::1]:56324", "tcp [2001:db8::2]:443"},
+		// 地址族不一致时转换成ipv6
+		{tcp("192.0.2.1:56324"), tcp("[2001:db8::2]:443"), ProxyProtoCommandProxy,
+			"PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n", "tcp 192.0.2.1:56324", "tcp [2001:db8::2]:443"},
+		{nil, tcp("198.51.100.1:443"), ProxyProtoCommandProxy, "PROXY UNKNOWN\r\n", "", ""},
+		{tcp("192.0.2.1:56324"), tcp("198.51.100.1:443"), ProxyProtoCommandLocal, "PROXY UNKNOWN\r\n", "", ""},
+	}
+	for _, tt := range tests {
+		for _, version := range []int{1, 2} {
+			header := &ProxyProtoHeader{Version: version, Command: tt.command, Source: tt.src, Destination: tt.dst}
+			authority := ""
+			if version == 2 && tt.wantSrc != "" {
+				authority = "example.com"
+				header.TLVs = []ProxyProtoTLV{{Type: ProxyProtoTLVTypeAuthority, Value: []byte(authority)}}
+			}
+			data, err := header.Format()
+			if err != nil {
+				t.Errorf("v%v Format(%v, %v): %v", version, tt.src, tt.dst, err)
+				continue
+			}
+			if version == 1 && string(data) != tt.v1 {
+				t.Errorf("v1 Format(%v, %v) = %q, want %q", tt.src, tt.dst, data, tt.v1)
+			}
+
+			parsed, err := ReadProxyProtoHeader(bufio.NewReader(bytes.NewReader(data)))
+			if err != nil {
+				t.Errorf("v%v ReadProxyProtoHeader(Format(%v, %v)): %v", version, tt.src, tt.dst, err)
+				continue
+			}
+			if parsed.Version != version || addrString(parsed.Source) != tt.wantSrc || addrString(parsed.Destination) != tt.wantDst ||
+				parsed.Authority() != authority {
+				t.Errorf("v%v round trip of (%v, %v) = %+v", version, tt.src, tt.dst, parsed)
+			}
+		}
+	}
+
+	if _, err := (&ProxyProtoHeader{Version: 3}).Format(); err == nil {
+		t.Errorf("Format with version 3 should fail")
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	header := []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+	tests := []struct {
+		allow  []netip.Prefix
+		remote string
+		data   string
+	}{
+		// 允许列表为空时不解析头部
+		{nil, "127.0.0.1", string(header) + "hello"},
+		{[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, "127.0.0.1", string(header) + "hello"},
+		{[]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, "192.0.2.1", "hello"},
+	}
+	for _, tt := range tests {
+		l := &ProxyProtoListener{Listener: ln, Allow: tt.allow, HeaderTimeout: time.Second}
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write(append(header, "hello"...))
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, len(tt.data))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil || string(buf) != tt.data {
+			t.Errorf("allow %v: read %q, %v, want %q", tt.allow, buf, err, tt.data)
+		}
+		if got := ParseAddr(conn.RemoteAddr().String()); got.String() != tt.remote {
+			t.Errorf("allow %v: RemoteAddr() = %v, want %v", tt.allow, got, tt.remote)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+func TestProxyProtoConnDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := &ProxyProtoListener{Listener: ln, Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, HeaderTimeout: 5 * time.Second}
+
+	// 调用方的读超时早于头部超时时，解析头部也按调用方的超时结束
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Errorf("Read without header err = %v, want timeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Read without header returned after %v, want about 100ms", d)
+	}
+	conn.Close()
+
+	// 解析完头部后恢复调用方设置的读超时
+	client2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+	client2.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	conn, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start = time.Now()
+	conn.SetDeadline(start.Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Errorf("Read after header err = %v, want timeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Read after header returned after %v, want about 200ms", d)
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func TestPipeProxyProtoConnHalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := &ProxyProtoListener{Listener: ln, Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+
+	upstreamLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstreamLn.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := net.Dial("tcp", upstreamLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := upstreamLn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		Pipe(conn, upstream)
+		close(done)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 上游先关闭写端，客户端到上游的方向仍然可以继续发送
+	server.Write([]byte("response"))
+	server.(*net.TCPConn).CloseWrite()
+	if data, err := io.ReadAll(client); err != nil || string(data) != "response" {
+		t.Fatalf("client read %q, %v, want response", data, err)
+	}
+
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatalf("client write after half close: %v", err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+	if data, err := io.ReadAll(server); err != nil || string(data) != "request" {
+		t.Errorf("upstream read %q, %v, want request", data, err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Pipe did not return after both directions ended")
+	}
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+)
+
+type quicConnKey struct{}
+
+// WithQUICConn 用于http3.Server的ConnContext，把连接挂到context上以便判断请求是否为0-RTT早期数据
+func WithQUICConn(ctx context.Context, conn quic.Connection) context.Context {
+	return context.WithValue(ctx, quicConnKey{}, conn)
+}
+
+// IsEarlyData 请求是否在握手完成前收到，被重放的早期数据所在的连接永远不会完成握手
+func IsEarlyData(req *http.Request) bool {
+	// http3.Server使用的连接都是EarlyConnection
+	conn, ok := req.Context().Value(quicConnKey{}).(quic.EarlyConnection)
+	if !ok {
+		return false
+	}
+	select {
+	case <-conn.HandshakeComplete():
+		return false
+	default:
+		return true
+	}
+}
+
+// IsIdempotent RFC 9110中定义的幂等方法，重放不会产生额外的副作用
+func IsIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
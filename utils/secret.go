@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// sealedPrefix 加密后的内容格式为 enc:v2:scrypt:<密钥id>:<base64(nonce+密文)>，
+// 主密钥通常是口令，用scrypt派生AES密钥
+const sealedPrefix = "enc:v2:scrypt:"
+
+// legacySealedPrefix 旧版本直接用sha256(主密钥)作为AES密钥，只用于解密，启动时会重新加密
+const legacySealedPrefix = "enc:v1:"
+
+// scrypt参数，派生只在设置主密钥时进行一次
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// scryptSalt 密文中没有保存盐，所有主密钥使用同一个固定的盐
+var scryptSalt = []byte("go-vhostd master key")
+
+var ErrMasterKeyNotFound = errors.New("master key not found")
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+
+	legacyID   string
+	legacyAEAD cipher.AEAD
+}
+
+var (
+	masterKeysLock sync.RWMutex
+	masterKeys     []*masterKey
+)
+
+// SetMasterKeys 设置用于加密私钥的主密钥，第一个用于加密，其余的只用于解密，方便轮换
+func SetMasterKeys(secrets []string) error {
+	keys := make([]*masterKey, 0, len(secrets))
+	for _, secret := range secrets {
+		derived, err := scrypt.Key([]byte(secret), scryptSalt, scryptN, scryptR, scryptP, scryptKeyLen)
+		if err != nil {
+			return err
+		}
+		key := &masterKey{}
+		if key.id, key.aead, err = newMasterKeyAEAD(derived); err != nil {
+			return err
+		}
+
+		legacy := sha256.Sum256([]byte(secret))
+		if key.legacyID, key.legacyAEAD, err = newMasterKeyAEAD(legacy[:]); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	masterKeysLock.Lock()
+	masterKeys = keys
+	masterKeysLock.Unlock()
+	return nil
+}
+
+// newMasterKeyAEAD 密钥id是AES密钥哈希的前4个字节，用于解密时找到对应的主密钥
+func newMasterKeyAEAD(key []byte) (string, cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", nil, err
+	}
+	id := sha256.Sum256(key)
+	return hex.EncodeToString(id[:4]), aead, nil
+}
+
+func HasMasterKey() bool {
+	masterKeysLock.RLock()
+	defer masterKeysLock.RUnlock()
+	return len(masterKeys) > 0
+}
+
+func IsSealed(s string) bool {
+	return strings.HasPrefix(s, sealedPrefix) || strings.HasPrefix(s, legacySealedPrefix)
+}
+
+// NeedReseal 未加密、旧格式或者不是用当前主密钥加密的内容需要重新加密
+func NeedReseal(s string) bool {
+	masterKeysLock.RLock()
+	defer masterKeysLock.RUnlock()
+	if len(masterKeys) == 0 {
+		return false
+	}
+	return !strings.HasPrefix(s, sealedPrefix+masterKeys[0].id+":")
+}
+
+func Seal(plaintext []byte) (string, error) {
+	masterKeysLock.RLock()
+	defer masterKeysLock.RUnlock()
+	if len(masterKeys) == 0 {
+		return "", ErrMasterKeyNotFound
+	}
+
+	key := masterKeys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := key.aead.Seal(nonce, nonce, plaintext, []byte(key.id))
+	return sealedPrefix + key.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open 解密Seal的结果，未加密的内容原样返回
+func Open(s string) ([]byte, error) {
+	var (
+		rest   string
+		legacy bool
+	)
+	switch {
+	case strings.HasPrefix(s, sealedPrefix):
+		rest = strings.TrimPrefix(s, sealedPrefix)
+	case strings.HasPrefix(s, legacySealedPrefix):
+		rest, legacy = strings.TrimPrefix(s, legacySealedPrefix), true
+	default:
+		return []byte(s), nil
+	}
+
+	id, data, ok := strings.Cut(rest, ":")
+	if !ok {
+		return nil, errors.New("malform sealed content")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	masterKeysLock.RLock()
+	defer masterKeysLock.RUnlock()
+	for _, key := range masterKeys {
+		keyID, aead := key.id, key.aead
+		if legacy {
+			keyID, aead = key.legacyID, key.legacyAEAD
+		}
+		if keyID != id {
+			continue
+		}
+		if len(sealed) < aead.NonceSize() {
+			return nil, errors.New("malform sealed content")
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		return aead.Open(nil, nonce, ciphertext, []byte(id))
+	}
+	return nil, ErrMasterKeyNotFound
+}
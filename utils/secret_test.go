@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func setMasterKeys(t *testing.T, secrets ...string) {
+	t.Helper()
+	if err := SetMasterKeys(secrets); err != nil {
+		t.Fatalf("SetMasterKeys: %v", err)
+	}
+	t.Cleanup(func() { SetMasterKeys(nil) })
+}
+
+func TestSealOpen(t *testing.T) {
+	setMasterKeys(t, "secret")
+
+	for _, plaintext := range []string{"", "password", strings.Repeat("x", 4096)} {
+		sealed, err := Seal([]byte(plaintext))
+		if err != nil {
+			t.Fatalf("Seal(%q): %v", plaintext, err)
+		}
+		if !IsSealed(sealed) {
+			t.Errorf("Seal(%q) = %v, not sealed", plaintext, sealed)
+		}
+		if NeedReseal(sealed) {
+			t.Errorf("NeedReseal(%v) = true, want false", sealed)
+		}
+		opened, err := Open(sealed)
+		if err != nil {
+			t.Fatalf("Open(%v): %v", sealed, err)
+		}
+		if string(opened) != plaintext {
+			t.Errorf("Open(Seal(%q)) = %q", plaintext, opened)
+		}
+	}
+
+	// 同样的内容每次加密的结果都不同
+	a, _ := Seal([]byte("password"))
+	b, _ := Seal([]byte("password"))
+	if a == b {
+		t.Errorf("Seal returned the same result twice: %v", a)
+	}
+}
+
+func TestOpenPlaintext(t *testing.T) {
+	for _, s := range []string{"", "password", "enc:v2:x"} {
+		opened, err := Open(s)
+		if err != nil || string(opened) != s {
+			t.Errorf("Open(%q) = %q, %v, want it unchanged", s, opened, err)
+		}
+	}
+}
+
+func TestOpenMalform(t *testing.T) {
+	setMasterKeys(t, "secret")
+	sealed, err := Seal([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, data, _ := strings.Cut(strings.TrimPrefix(sealed, sealedPrefix), ":")
+
+	tests := []string{
+		sealedPrefix,
+		sealedPrefix + id,
+		sealedPrefix + id + ":!!!",
+		sealedPrefix + id + ":AAAA",
+		sealedPrefix + id + ":" + data[:len(data)-4] + "AAAA",
+		sealedPrefix + "00000000:" + data,
+	}
+	for _, s := range tests {
+		if _, err := Open(s); err == nil {
+			t.Errorf("Open(%q) should fail", s)
+		}
+	}
+}
+
+func TestMasterKeyRotation(t *testing.T) {
+	setMasterKeys(t, "old")
+	old, err := Seal([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 新密钥放在第一个，旧密钥只用于解密
+	setMasterKeys(t, "new", "old")
+	if !NeedReseal(old) {
+		t.Errorf("NeedReseal(%v) = false after rotation, want true", old)
+	}
+	if opened, err := Open(old); err != nil || string(opened) != "password" {
+		t.Errorf("Open(%v) = %q, %v after rotation", old, opened, err)
+	}
+	resealed, err := Seal([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NeedReseal(resealed) {
+		t.Errorf("NeedReseal(%v) = true, want false", resealed)
+	}
+
+	// 去掉旧密钥后无法解密旧内容
+	setMasterKeys(t, "new")
+	if _, err := Open(old); err != ErrMasterKeyNotFound {
+		t.Errorf("Open(%v) err = %v, want %v", old, err, ErrMasterKeyNotFound)
+	}
+	if opened, err := Open(resealed); err != nil || string(opened) != "password" {
+		t.Errorf("Open(%v) = %q, %v", resealed, opened, err)
+	}
+}
+
+func TestNoMasterKey(t *testing.T) {
+	setMasterKeys(t)
+	if HasMasterKey() {
+		t.Errorf("HasMasterKey() = true, want false")
+	}
+	if _, err := Seal([]byte("password")); err != ErrMasterKeyNotFound {
+		t.Errorf("Seal err = %v, want %v", err, ErrMasterKeyNotFound)
+	}
+	// 没有主密钥时不需要加密
+	if NeedReseal("password") {
+		t.Errorf("NeedReseal = true without master key, want false")
+	}
+
+	setMasterKeys(t, "secret")
+	if !HasMasterKey() {
+		t.Errorf("HasMasterKey() = false, want true")
+	}
+	if !NeedReseal("password") {
+		t.Errorf("NeedReseal(plaintext) = false, want true")
+	}
+}
+
+// sealLegacy 按v1格式加密，AES密钥是sha256(主密钥)
+func sealLegacy(t *testing.T, secret string, plaintext []byte) string {
+	t.Helper()
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(key[:])
+	id := hex.EncodeToString(sum[:4])
+	nonce := make([]byte, aead.NonceSize())
+	return legacySealedPrefix + id + ":" + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, []byte(id)))
+}
+
+func TestOpenLegacy(t *testing.T) {
+	legacy := sealLegacy(t, "secret", []byte("password"))
+
+	setMasterKeys(t, "secret")
+	if !IsSealed(legacy) {
+		t.Errorf("IsSealed(%v) = false, want true", legacy)
+	}
+	if opened, err := Open(legacy); err != nil || string(opened) != "password" {
+		t.Errorf("Open(%v) = %q, %v", legacy, opened, err)
+	}
+	// 旧格式需要用scrypt派生的密钥重新加密
+	if !NeedReseal(legacy) {
+		t.Errorf("NeedReseal(%v) = false, want true", legacy)
+	}
+	sealed, err := Seal([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, sealedPrefix) || strings.Contains(sealed, legacy[len(legacySealedPrefix):][:8]) {
+		t.Errorf("Seal = %v, want %v prefix with a new key id", sealed, sealedPrefix)
+	}
+
+	setMasterKeys(t, "other")
+	if _, err := Open(legacy); err != ErrMasterKeyNotFound {
+		t.Errorf("Open(%v) with another key err = %v, want %v", legacy, err, ErrMasterKeyNotFound)
+	}
+}
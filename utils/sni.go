@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+// PeekClientHello 读取TLS ClientHello但不完成握手，
+// 返回读取到的原始数据，调用方需要把这些数据重新交给后续的处理者
+func PeekClientHello(r io.Reader) (*tls.ClientHelloInfo, []byte, error) {
+	var (
+		buf   = bytes.NewBuffer(nil)
+		hello *tls.ClientHelloInfo
+	)
+
+	err := tls.Server(&readOnlyConn{r: io.TeeReader(r, buf)}, &tls.Config{
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *chi
+			hello.Conn = nil
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+
+	if hello == nil {
+		return nil, buf.Bytes(), err
+	}
+	return hello, buf.Bytes(), nil
+}
+
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// MatchDomain 匹配域名，pattern支持*.example.com形式的通配符，只匹配一级子域名
+func MatchDomain(pattern, domain string) bool {
+	pattern = strings.ToLower(pattern)
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if pattern == domain {
+		return true
+	}
+
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	if !ok || !strings.HasPrefix(suffix, ".") {
+		return false
+	}
+	label, ok := strings.CutSuffix(domain, suffix)
+	return ok && label != "" && !strings.Contains(label, ".")
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// TargetRule 允许访问的目标，host可以是域名、*.域名、IP、CIDR或*，port可以是端口、端口范围或*
+type TargetRule struct {
+	// Domain 按客户端请求的域名匹配，为空时按IP匹配
+	Domain  string
+	Prefix  netip.Prefix
+	AnyHost bool
+
+	PortMin uint16
+	PortMax uint16
+}
+
+// ParseTargetRules 解析host:port格式的规则，ipv6地址和网段需要放在方括号中
+func ParseTargetRules(ss []string) ([]*TargetRule, error) {
+	rules := make([]*TargetRule, 0, len(ss))
+	for _, s := range ss {
+		rule, err := parseTargetRule(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("malform target rule %v: %w", s, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseTargetRule(s string) (*TargetRule, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || port == "" {
+		return nil, errors.New("missing host or port")
+	}
+
+	rule := &TargetRule{}
+	switch {
+	case host == "*":
+		rule.AnyHost = true
+	case strings.Contains(host, "/"):
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return nil, err
+		}
+		rule.Prefix = prefix.Masked()
+	default:
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addr = addr.Unmap()
+			rule.Prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else {
+			rule.Domain = strings.ToLower(host)
+		}
+	}
+
+	if port == "*" {
+		rule.PortMin, rule.PortMax = 1, 65535
+		return rule, nil
+	}
+	minPort, maxPort, isRange := strings.Cut(port, "-")
+	if !isRange {
+		maxPort = minPort
+	}
+	min, err := strconv.ParseUint(minPort, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	max, err := strconv.ParseUint(maxPort, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if min == 0 || min > max {
+		return nil, errors.New("invalid port range")
+	}
+	rule.PortMin, rule.PortMax = uint16(min), uint16(max)
+	return rule, nil
+}
+
+func (r *TargetRule) matchPort(port uint16) bool {
+	return port >= r.PortMin && port <= r.PortMax
+}
+
+// MatchDomain 客户端请求的是域名时，按域名规则匹配，解析后的地址不再检查
+func (r *TargetRule) MatchDomain(domain string, port uint16) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+	return r.AnyHost || (r.Domain != "" && MatchDomain(r.Domain, domain))
+}
+
+func (r *TargetRule) MatchAddr(addr netip.Addr, port uint16) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+	return r.AnyHost || r.matchPrefix(addr)
+}
+
+func (r *TargetRule) matchPrefix(addr netip.Addr) bool {
+	return r.Prefix.IsValid() && r.Prefix.Contains(addr.Unmap())
+}
+
+// AllowAddr 检查最终要访问的地址，domainAllowed表示客户端请求的域名已经被域名规则允许，
+// 内部地址只能由包含它的IP或CIDR规则允许，避免通过域名或*访问内网
+func AllowAddr(rules []*TargetRule, addr netip.Addr, port uint16, domainAllowed bool) bool {
+	for _, rule := range rules {
+		if rule.matchPort(port) && rule.matchPrefix(addr) {
+			return true
+		}
+	}
+	if IsInternalAddr(addr) {
+		return false
+	}
+	if domainAllowed {
+		return true
+	}
+	for _, rule := range rules {
+		if rule.MatchAddr(addr, port) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func mustParseTargetRules(t *testing.T, ss ...string) []*TargetRule {
+	t.Helper()
+	rules, err := ParseTargetRules(ss)
+	if err != nil {
+		t.Fatalf("ParseTargetRules(%q): %v", ss, err)
+	}
+	return rules
+}
+
+func TestParseTargetRules(t *testing.T) {
+	tests := []struct {
+		rule string
+		want TargetRule
+	}{
+		{"*:*", TargetRule{AnyHost: true, PortMin: 1, PortMax: 65535}},
+		{"example.com:53", TargetRule{Domain: "example.com", PortMin: 53, PortMax: 53}},
+		{"*.Example.com:1000-2000", TargetRule{Domain: "*.example.com", PortMin: 1000, PortMax: 2000}},
+		{" 10.0.0.1:53 ", TargetRule{Prefix: netip.MustParsePrefix("10.0.0.1/32"), PortMin: 53, PortMax: 53}},
+		{"10.1.2.3/8:*", TargetRule{Prefix: netip.MustParsePrefix("10.0.0.0/8"), PortMin: 1, PortMax: 65535}},
+		{"[::ffff:10.0.0.1]:53", TargetRule{Prefix: netip.MustParsePrefix("10.0.0.1/32"), PortMin: 53, PortMax: 53}},
+		{"[2001:db8::/32]:443", TargetRule{Prefix: netip.MustParsePrefix("2001:db8::/32"), PortMin: 443, PortMax: 443}},
+	}
+	for _, tt := range tests {
+		rules, err := ParseTargetRules([]string{tt.rule})
+		if err != nil {
+			t.Errorf("ParseTargetRules(%q): %v", tt.rule, err)
+			continue
+		}
+		if *rules[0] != tt.want {
+			t.Errorf("ParseTargetRules(%q) = %+v, want %+v", tt.rule, *rules[0], tt.want)
+		}
+	}
+
+	for _, rule := range []string{
+		"",
+		"example.com",
+		":53",
+		"example.com:",
+		"example.com:0",
+		"example.com:65536",
+		"example.com:2000-1000",
+		"example.com:a-b",
+		"10.0.0.0/33:53",
+		"2001:db8::1:53",
+	} {
+		if _, err := ParseTargetRules([]string{rule}); err == nil {
+			t.Errorf("ParseTargetRules(%q) should fail", rule)
+		}
+	}
+}
+
+func TestTargetRuleMatchDomain(t *testing.T) {
+	tests := []struct {
+		rule   string
+		domain string
+		port   uint16
+		want   bool
+	}{
+		{"example.com:53", "example.com", 53, true},
+		{"example.com:53", "EXAMPLE.com.", 53, true},
+		{"example.com:53", "example.com", 54, false},
+		{"example.com:53", "www.example.com", 53, false},
+		{"*.example.com:*", "www.example.com", 443, true},
+		{"*.example.com:*", "example.com", 443, false},
+		{"*.example.com:*", "a.b.example.com", 443, false},
+		{"*:1000-2000", "example.org", 1500, true},
+		{"*:1000-2000", "example.org", 2001, false},
+		{"10.0.0.0/8:*", "example.com", 53, false},
+	}
+	for _, tt := range tests {
+		rule := mustParseTargetRules(t, tt.rule)[0]
+		if got := rule.MatchDomain(tt.domain, tt.port); got != tt.want {
+			t.Errorf("%v MatchDomain(%v, %v) = %v, want %v", tt.rule, tt.domain, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestTargetRuleMatchAddr(t *testing.T) {
+	tests := []struct {
+		rule string
+		addr string
+		port uint16
+		want bool
+	}{
+		{"10.0.0.0/8:53", "10.1.2.3", 53, true},
+		{"10.0.0.0/8:53", "::ffff:10.1.2.3", 53, true},
+		{"10.0.0.0/8:53", "11.0.0.1", 53, false},
+		{"10.0.0.0/8:53", "10.1.2.3", 54, false},
+		{"[2001:db8::/32]:*", "2001:db8::1", 443, true},
+		{"[2001:db8::/32]:*", "2001:db9::1", 443, false},
+		{"*:*", "192.0.2.1", 443, true},
+		{"example.com:*", "192.0.2.1", 443, false},
+	}
+	for _, tt := range tests {
+		rule := mustParseTargetRules(t, tt.rule)[0]
+		if got := rule.MatchAddr(netip.MustParseAddr(tt.addr), tt.port); got != tt.want {
+			t.Errorf("%v MatchAddr(%v, %v) = %v, want %v", tt.rule, tt.addr, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestAllowAddr(t *testing.T) {
+	tests := []struct {
+		rules         []string
+		addr          string
+		port          uint16
+		domainAllowed bool
+		want          bool
+	}{
+		// 公网地址
+		{[]string{"*:*"}, "192.0.2.1", 53, false, true},
+		{[]string{"198.51.100.0/24:53"}, "198.51.100.7", 53, false, true},
+		{[]string{"198.51.100.0/24:53"}, "198.51.100.7", 54, false, false},
+		{[]string{"example.com:53"}, "192.0.2.1", 53, false, false},
+		{[]string{"example.com:53"}, "192.0.2.1", 53, true, true},
+		{nil, "192.0.2.1", 53, false, false},
+
+		// 内部地址不能通过*或域名规则访问
+		{[]string{"*:*"}, "127.0.0.1", 53, false, false},
+		{[]string{"*:*"}, "::1", 53, false, false},
+		{[]string{"*:*"}, "10.0.0.1", 53, false, false},
+		{[]string{"*:*"}, "192.168.1.1", 53, false, false},
+		{[]string{"*:*"}, "169.254.169.254", 80, false, false},
+		{[]string{"*:*"}, "fe80::1", 53, false, false},
+		{[]string{"*:*"}, "fd00::1", 53, false, false},
+		{[]string{"*:*"}, "0.0.0.0", 53, false, false},
+		{[]string{"*:*"}, "::ffff:127.0.0.1", 53, false, false},
+		{[]string{"example.com:53"}, "127.0.0.1", 53, true, false},
+		{[]string{"*:*"}, "0.1.2.3", 53, false, false},
+		{[]string{"*:*"}, "100.64.0.1", 53, false, false},
+		{[]string{"*:*"}, "100.127.255.254", 53, false, false},
+		{[]string{"*:*"}, "224.0.0.251", 5353, false, false},
+		{[]string{"*:*"}, "239.255.255.250", 1900, false, false},
+		{[]string{"*:*"}, "255.255.255.255", 53, false, false},
+		{[]string{"*:*"}, "ff02::fb", 5353, false, false},
+		{[]string{"*:*"}, "ff0e::1", 53, false, false},
+
+		// 内嵌ipv4的地址按内嵌的地址判断
+		{[]string{"*:*"}, "64:ff9b::10.0.0.1", 53, false, false},
+		{[]string{"*:*"}, "64:ff9b::7f00:1", 53, false, false},
+		{[]string{"*:*"}, "64:ff9b::c000:201", 53, false, true},
+		{[]string{"*:*"}, "64:ff9b:1::1", 53, false, false},
+		{[]string{"*:*"}, "2002:c0a8:101::1", 53, false, false},
+		{[]string{"*:*"}, "2002:a9fe:a9fe::1", 80, false, false},
+		{[]string{"*:*"}, "2002:c000:201::1", 53, false, true},
+		{[]string{"*:*"}, "::10.0.0.1", 53, false, false},
+		{[]string{"*:*"}, "::c000:201", 53, false, true},
+		{[]string{"example.com:53"}, "64:ff9b::a9fe:a9fe", 53, true, false},
+
+		// 显式的IP或CIDR规则可以允许内部地址
+		{[]string{"127.0.0.1:53"}, "127.0.0.1", 53, false, true},
+		{[]string{"127.0.0.1:53"}, "::ffff:127.0.0.1", 53, false, true},
+		{[]string{"127.0.0.1:53"}, "127.0.0.1", 54, false, false},
+		{[]string{"10.0.0.0/8:*"}, "10.1.2.3", 53, true, true},
+		{[]string{"10.0.0.0/8:*"}, "192.168.1.1", 53, false, false},
+		{[]string{"100.64.0.0/10:*"}, "100.64.0.1", 53, false, true},
+		{[]string{"[64:ff9b::/96]:*"}, "64:ff9b::10.0.0.1", 53, false, true},
+	}
+	for _, tt := range tests {
+		rules := mustParseTargetRules(t, tt.rules...)
+		got := AllowAddr(rules, netip.MustParseAddr(tt.addr), tt.port, tt.domainAllowed)
+		if got != tt.want {
+			t.Errorf("AllowAddr(%q, %v, %v, %v) = %v, want %v",
+				tt.rules, tt.addr, tt.port, tt.domainAllowed, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+#!/bin/sh
+# 用openssl 3生成pkcs_test.go使用的证书、PKCS#12和加密私钥，重新生成后测试中的期望值不需要修改
+set -e
+cd "$(dirname "$0")"
+
+openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:P-256 -nodes -keyout ca.key -out ca.crt \
+	-subj "/CN=Test CA" -days 36500 -addext basicConstraints=critical,CA:TRUE
+openssl req -newkey ec -pkeyopt ec_paramgen_curve:P-256 -nodes -keyout leaf.key -out leaf.csr -subj "/CN=leaf.test"
+openssl x509 -req -in leaf.csr -CA ca.crt -CAkey ca.key -CAcreateserial -out leaf.crt -days 36500 \
+	-extfile /dev/stdin <<EXT
+subjectAltName=DNS:leaf.test
+EXT
+openssl req -newkey rsa:2048 -nodes -keyout rsa.key -out rsa.csr -subj "/CN=rsa.test"
+openssl x509 -req -in rsa.csr -CA ca.crt -CAkey ca.key -CAcreateserial -out rsa.crt -days 36500
+openssl req -x509 -newkey ed25519 -nodes -keyout ed25519.key -out ed25519.crt -subj "/CN=ed25519.test" -days 36500
+rm -f leaf.csr rsa.csr ca.srl
+
+export_p12() {
+	out=$1
+	shift
+	openssl pkcs12 -export -inkey leaf.key -in leaf.crt -certfile ca.crt -out "$out" "$@"
+}
+
+# openssl 3默认：PBES2/PBKDF2-hmacWithSHA256/AES-256-CBC，MAC使用SHA-256
+export_p12 modern.p12 -passout pass:secret
+# 老格式：证书使用RC2-40，私钥使用pbeWithSHAAnd3-KeyTripleDES-CBC，MAC使用SHA-1
+export_p12 legacy.p12 -passout pass:secret -legacy
+export_p12 empty.p12 -passout pass:
+export_p12 unicode.p12 -passout "pass:пароль密码"
+export_p12 aes128.p12 -passout pass:secret -keypbe AES-128-CBC -certpbe AES-128-CBC
+export_p12 des3.p12 -passout pass:secret -keypbe DES-EDE3-CBC -certpbe DES-EDE3-CBC
+export_p12 sha512.p12 -passout pass:secret -macalg sha512
+openssl pkcs12 -export -inkey rsa.key -in rsa.crt -certfile ca.crt -out rsa.p12 -passout pass:secret
+openssl pkcs12 -export -inkey ed25519.key -in ed25519.crt -out ed25519.p12 -passout pass:secret
+
+# 加密的PKCS#8私钥
+openssl pkcs8 -topk8 -in leaf.key -out leaf-aes256-sha512.key -v2 aes-256-cbc -v2prf hmacWithSHA512 -passout pass:secret
+openssl pkcs8 -topk8 -in leaf.key -out leaf-aes128.key -v2 aes-128-cbc -passout pass:secret
+openssl pkcs8 -topk8 -in leaf.key -out leaf-des3.key -v2 des3 -passout pass:secret
+openssl pkcs8 -topk8 -in leaf.key -out leaf-pbe-sha1-3des.key -v1 PBE-SHA1-3DES -passout pass:secret
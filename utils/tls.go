@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// LegacyCipherSuites 兼容只支持老旧加密套件的后端
+var LegacyCipherSuites = []uint16{
+	tls.TLS_RSA_WITH_RC4_128_SHA,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_AES_128_GCM_SHA256,
+	tls.TLS_AES_256_GCM_SHA384,
+	tls.TLS_CHACHA20_POLY1305_SHA256,
+}
+
+// ParseTLSVersion 解析1.0/1.1/1.2/1.3形式的版本号，为空时返回0表示使用默认值
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported tls version %v", s)
+}
+
+// ParseCipherSuites 按Go中的名称解析加密套件，只允许安全的套件
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	ids := make([]uint16, 0, len(names))
+NEXT:
+	for _, name := range names {
+		for _, suite := range tls.CipherSuites() {
+			if strings.EqualFold(suite.Name, name) {
+				ids = append(ids, suite.ID)
+				continue NEXT
+			}
+		}
+		return nil, fmt.Errorf("unsupported cipher suite %v", name)
+	}
+	return ids, nil
+}
+
+var curves = map[string]tls.CurveID{
+	"x25519":         tls.X25519,
+	"p-256":          tls.CurveP256,
+	"p256":           tls.CurveP256,
+	"p-384":          tls.CurveP384,
+	"p384":           tls.CurveP384,
+	"p-521":          tls.CurveP521,
+	"p521":           tls.CurveP521,
+	"x25519mlkem768": tls.X25519MLKEM768,
+}
+
+// ParseCurves 解析椭圆曲线名称，支持X25519、P-256、P-384、P-521、X25519MLKEM768
+func ParseCurves(names []string) ([]tls.CurveID, error) {
+	ids := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		id, ok := curves[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %v", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// WebSocketCloseMessageTooBig RFC 6455 关闭码，消息超过了接收方的限制
+const WebSocketCloseMessageTooBig = 1009
+
+var ErrWebSocketFrameTooLarge = errors.New("websocket frame too large")
+
+// CopyWebSocketFrames 按RFC 6455的帧格式把src的数据转发给dst，帧头原样转发，
+// 单个帧的负载超过maxFrameSize时在转发该帧之前返回ErrWebSocketFrameTooLarge，maxFrameSize为0时不限制，
+// 每转发一个帧调用一次active
+func CopyWebSocketFrames(dst io.Writer, src io.Reader, maxFrameSize int64, active func()) error {
+	header := make([]byte, 14)
+	for {
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return err
+		}
+
+		n := 2
+		length := int64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(src, header[n:n+2]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint16(header[n:]))
+			n += 2
+		case 127:
+			if _, err := io.ReadFull(src, header[n:n+8]); err != nil {
+				return err
+			}
+			// 最高位必须为0
+			length = int64(binary.BigEndian.Uint64(header[n:]))
+			if length < 0 {
+				return errors.New("malform websocket frame length")
+			}
+			n += 8
+		}
+		if header[1]&0x80 != 0 {
+			if _, err := io.ReadFull(src, header[n:n+4]); err != nil {
+				return err
+			}
+			n += 4
+		}
+
+		if maxFrameSize > 0 && length > maxFrameSize {
+			return ErrWebSocketFrameTooLarge
+		}
+		if active != nil {
+			active()
+		}
+
+		if _, err := dst.Write(header[:n]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, src, length); err != nil {
+			return err
+		}
+	}
+}
+
+// WebSocketCloseFrame 生成带关闭码的关闭帧，客户端发给服务端的帧必须加掩码
+func WebSocketCloseFrame(code uint16, masked bool) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	if !masked {
+		return append([]byte{0x88, byte(len(payload))}, payload...)
+	}
+
+	frame := []byte{0x88, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	rand.Read(frame[2:6])
+	for i, b := range payload {
+		frame = append(frame, b^frame[2+i%4])
+	}
+	return frame
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// webSocketFrame 生成一个完整的帧，masked时使用固定的掩码
+func webSocketFrame(opcode byte, payload []byte, masked bool) []byte {
+	frame := []byte{0x80 | opcode, 0}
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	frame[1] |= 0x80
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestCopyWebSocketFrames(t *testing.T) {
+	frames := [][]byte{
+		webSocketFrame(0x1, []byte("hello"), true),
+		webSocketFrame(0x1, nil, false),
+		webSocketFrame(0x2, bytes.Repeat([]byte{'a'}, 125), false),
+		webSocketFrame(0x2, bytes.Repeat([]byte{'b'}, 126), true),
+		webSocketFrame(0x2, bytes.Repeat([]byte{'c'}, 0xffff), false),
+		webSocketFrame(0x2, bytes.Repeat([]byte{'d'}, 0x10000), true),
+		webSocketFrame(0x9, []byte("ping"), true),
+	}
+	src := bytes.Join(frames, nil)
+
+	// 帧原样转发，每个帧调用一次active
+	var dst bytes.Buffer
+	active := 0
+	err := CopyWebSocketFrames(&dst, bytes.NewReader(src), 0, func() { active++ })
+	if err != io.EOF {
+		t.Errorf("CopyWebSocketFrames err = %v, want %v", err, io.EOF)
+	}
+	if !bytes.Equal(dst.Bytes(), src) {
+		t.Errorf("CopyWebSocketFrames changed the frames")
+	}
+	if active != len(frames) {
+		t.Errorf("active called %v times, want %v", active, len(frames))
+	}
+}
+
+func TestCopyWebSocketFramesMaxFrameSize(t *testing.T) {
+	small := webSocketFrame(0x1, bytes.Repeat([]byte{'a'}, 100), true)
+	large := webSocketFrame(0x2, bytes.Repeat([]byte{'b'}, 101), true)
+	src := bytes.Join([][]byte{small, small, large, small}, nil)
+
+	// 超过限制的帧之前的帧全部转发，超过限制的帧一个字节都不转发
+	var dst bytes.Buffer
+	err := CopyWebSocketFrames(&dst, bytes.NewReader(src), 100, nil)
+	if err != ErrWebSocketFrameTooLarge {
+		t.Errorf("CopyWebSocketFrames err = %v, want %v", err, ErrWebSocketFrameTooLarge)
+	}
+	if want := bytes.Join([][]byte{small, small}, nil); !bytes.Equal(dst.Bytes(), want) {
+		t.Errorf("forwarded %v bytes, want %v", dst.Len(), len(want))
+	}
+
+	// 64位长度的最高位不能为1
+	malform := []byte{0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 0}
+	if err := CopyWebSocketFrames(io.Discard, bytes.NewReader(malform), 0, nil); err == nil || err == io.EOF {
+		t.Errorf("CopyWebSocketFrames of malform length err = %v, want error", err)
+	}
+}
+
+func TestCopyWebSocketFramesTruncated(t *testing.T) {
+	frame := webSocketFrame(0x2, bytes.Repeat([]byte{'a'}, 300), true)
+	for _, n := range []int{1, 3, 6, 100} {
+		err := CopyWebSocketFrames(io.Discard, bytes.NewReader(frame[:n]), 0, nil)
+		if !errors.Is(err, io.ErrUnexpectedEOF) && err != io.EOF {
+			t.Errorf("CopyWebSocketFrames of %v bytes err = %v, want unexpected EOF", n, err)
+		}
+	}
+}
+
+func TestWebSocketCloseFrame(t *testing.T) {
+	frame := WebSocketCloseFrame(WebSocketCloseMessageTooBig, false)
+	if want := []byte{0x88, 0x02, 0x03, 0xf1}; !bytes.Equal(frame, want) {
+		t.Errorf("WebSocketCloseFrame unmasked = %x, want %x", frame, want)
+	}
+
+	frame = WebSocketCloseFrame(WebSocketCloseMessageTooBig, true)
+	if len(frame) != 8 || frame[0] != 0x88 || frame[1] != 0x82 {
+		t.Fatalf("WebSocketCloseFrame masked = %x, want masked close frame with 2 bytes payload", frame)
+	}
+	mask := frame[2:6]
+	code := []byte{frame[6] ^ mask[0], frame[7] ^ mask[1]}
+	if got := binary.BigEndian.Uint16(code); got != WebSocketCloseMessageTooBig {
+		t.Errorf("WebSocketCloseFrame masked code = %v, want %v", got, WebSocketCloseMessageTooBig)
+	}
+
+	// 关闭帧本身也能按帧转发
+	var dst bytes.Buffer
+	CopyWebSocketFrames(&dst, bytes.NewReader(frame), 0, nil)
+	if !bytes.Equal(dst.Bytes(), frame) {
+		t.Errorf("close frame not forwarded as a frame")
+	}
+}